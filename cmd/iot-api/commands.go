@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+)
+
+// commandsExchange is the default exchange, which routes a command straight to the command
+// queue of its sensor. Unlike iot, it has no alternate exchange: a command to a sensor without
+// a queue, never subscribed or gone since, is returned to the confirming publisher and answered
+// with 404, see respondWithPublishError. The command travels in the message, so the sensor
+// does not miss the action of a routing key.
+const commandsExchange = ""
+
+// requireQueue responds with code and msg unless the queue is declared.
+func (cfg *apiConfig) requireQueue(w http.ResponseWriter, queue string, code int, msg string) bool {
+	exists, err := pubsub.QueueExists(cfg.rabbitConn, queue)
+	if err != nil {
+		respondWithError(w, 500, "could not check queue "+queue, err)
+		return false
+	}
+	if !exists {
+		respondWithError(w, code, msg, nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/jackc/pgx/v5"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func (cfg *apiConfig) handlerDeadLettersRetrieve(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	filter, err := deadLetterFilterFromQuery(req)
+	if err != nil {
+		respondWithError(w, 400, err.Error(), nil)
+		return
+	}
+
+	deadLetters, err := cfg.db.GetDeadLetters(ctx, filter)
+	if err != nil {
+		log.Printf("Could not retrieve dead letters: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	respondWithJSON(w, 200, deadLetters)
+}
+
+func (cfg *apiConfig) handlerDeadLettersGet(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	id, err := strconv.ParseInt(req.PathValue("deadLetterID"), 10, 64)
+	if err != nil {
+		respondWithError(w, 400, "dead letter id must be an integer", err)
+		return
+	}
+
+	deadLetter, err := cfg.db.GetDeadLetter(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		respondWithError(w, 404, "dead letter not found", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not retrieve dead letter %v: %s", id, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	type response struct {
+		storage.DeadLetterRecord
+		Decoded     interface{} `json:"decoded,omitempty"`
+		DecodeError string      `json:"decode_error,omitempty"`
+	}
+	resp := response{DeadLetterRecord: deadLetter}
+	resp.Decoded, err = decodeDeadLetter(deadLetter)
+	if err != nil {
+		resp.DecodeError = err.Error()
+	}
+	respondWithJSON(w, 200, resp)
+}
+
+// decodeDeadLetter decodes the payload with the same decoder its consumer would have used,
+// picking the DTO out of the channel of the routing key.
+func decodeDeadLetter(dl storage.DeadLetterRecord) (interface{}, error) {
+	key, err := routing.ParseKey(dl.RoutingKey)
+	if err != nil {
+		return nil, fmt.Errorf("no known message type: %w", err)
+	}
+
+	// the headers tell whether the payload came in an envelope
+	headers := amqp.Table{}
+	if len(dl.Headers) > 0 {
+		err = json.Unmarshal(dl.Headers, &headers)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode headers: %v", err)
+		}
+	}
+
+	switch key.Channel {
+	case routing.ChannelLogs:
+		return pubsub.DecodeMessage[routing.SensorLog](dl.ContentType, headers, dl.Payload)
+	case routing.ChannelRegistry:
+		if key.Action == routing.RegistryRequestRegister || key.Action == routing.RegistryRequestDeregister {
+			return pubsub.DecodeMessage[routing.Sensor](dl.ContentType, headers, dl.Payload)
+		}
+		return pubsub.DecodeMessage[routing.SensorRegistryEvent](dl.ContentType, headers, dl.Payload)
+	case routing.ChannelCommands:
+		return pubsub.DecodeMessage[routing.SensorCommandMessage](dl.ContentType, headers, dl.Payload)
+	case routing.ChannelMeasurements:
+		return pubsub.DecodeMessage[[]routing.SensorMeasurement](dl.ContentType, headers, dl.Payload)
+	}
+	return nil, fmt.Errorf("no known message type for routing key %q", dl.RoutingKey)
+}
+
+func deadLetterFilterFromQuery(req *http.Request) (storage.DeadLetterFilter, error) {
+	query := req.URL.Query()
+	filter := storage.DeadLetterFilter{
+		RoutingKey:   query.Get("routing_key"),
+		SerialNumber: query.Get("sensor"),
+		Reason:       query.Get("reason"),
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return storage.DeadLetterFilter{}, fmt.Errorf("since must be an RFC3339 timestamp")
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return storage.DeadLetterFilter{}, fmt.Errorf("until must be an RFC3339 timestamp")
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 0 {
+			return storage.DeadLetterFilter{}, fmt.Errorf("limit must be a positive integer")
+		}
+	}
+
+	return filter, nil
+}
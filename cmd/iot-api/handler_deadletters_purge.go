@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+)
+
+func (cfg *apiConfig) handlerDeadLettersPurge(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	filter, err := deadLetterFilterFromQuery(req)
+	if err != nil {
+		respondWithError(w, 400, err.Error(), nil)
+		return
+	}
+	// a purge without filters empties the quarantine, callers have to mean it
+	unfiltered := filter == storage.DeadLetterFilter{Limit: filter.Limit}
+	if unfiltered && req.URL.Query().Get("all") != "true" {
+		respondWithError(w, 400, "purging every dead letter requires all=true", nil)
+		return
+	}
+
+	purged, err := cfg.db.PurgeDeadLetters(ctx, filter)
+	if err != nil {
+		respondWithError(w, 500, "could not purge dead letters", err)
+		return
+	}
+
+	type response struct {
+		Purged int64 `json:"purged"`
+	}
+	respondWithJSON(w, 200, response{Purged: purged})
+}
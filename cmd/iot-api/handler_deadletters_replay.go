@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/jackc/pgx/v5"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// handlerDeadLettersReplay republishes a quarantined message to the iot exchange with its
+// original routing key, and removes it from quarantine once the broker confirmed it. The iot
+// exchange confirms messages it could only hand to its alternate exchange too, so the queue
+// the message was rejected from must still exist, otherwise the row is the only copy left.
+func (cfg *apiConfig) handlerDeadLettersReplay(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	id, err := strconv.ParseInt(req.PathValue("deadLetterID"), 10, 64)
+	if err != nil {
+		respondWithError(w, 400, "dead letter id must be an integer", err)
+		return
+	}
+
+	deadLetter, err := cfg.db.GetDeadLetter(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		respondWithError(w, 404, "dead letter not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, 500, "could not retrieve dead letter", err)
+		return
+	}
+
+	if deadLetter.SourceQueue == "" {
+		respondWithError(w, 409, "dead letter has no source queue to replay to", nil)
+		return
+	}
+	if !cfg.requireQueue(w, deadLetter.SourceQueue, 409, "source queue of the dead letter no longer exists") {
+		return
+	}
+
+	headers := amqp.Table{}
+	if len(deadLetter.Headers) > 0 {
+		err = json.Unmarshal(deadLetter.Headers, &headers)
+		if err != nil {
+			respondWithError(w, 500, "could not decode dead letter headers", err)
+			return
+		}
+	}
+
+	err = cfg.publisher.Publish(
+		ctx,
+		routing.ExchangeTopicIoT, // exchange
+		deadLetter.RoutingKey,    // original routing key
+		pubsub.NewRepublishing(deadLetter.ContentType, headers, deadLetter.Payload),
+	)
+	if err != nil {
+		// the row stays in quarantine so the replay can be retried
+		respondWithPublishError(w, "could not replay dead letter", err)
+		return
+	}
+
+	err = cfg.db.DeleteDeadLetter(ctx, id)
+	if err != nil {
+		// the message is already back in the broker, keeping the row only risks a double replay
+		log.Printf("could not remove replayed dead letter %v: %v", id, err)
+	}
+
+	respondWithJSON(w, 200, "Dead letter replayed!")
+}
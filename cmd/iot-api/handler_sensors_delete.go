@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+)
+
+// handlerSensorsDelete asks the registry to deregister the sensor, which deletes it along with
+// its measurements and tells the other services once done.
+func (cfg *apiConfig) handlerSensorsDelete(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	sensorSerialNumber := req.PathValue("sensorSerialNumber")
+
+	key, err := routing.SensorRegistryKey(sensorSerialNumber, routing.RegistryRequestDeregister)
+	if err != nil {
+		respondWithError(w, 400, "invalid sensor serial number", err)
+		return
+	}
+
+	err = pubsub.PublishConfirmed(
+		ctx,
+		cfg.publisher,            // confirming publisher
+		routing.ExchangeTopicIoT, // exchange
+		key,                      // routing key
+		pubsub.GobCodec{},
+		routing.Sensor{
+			SerialNumber: sensorSerialNumber,
+		}, // value
+	)
+	if err != nil {
+		respondWithPublishError(w, "could not publish sensor deregistration", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
 	"time"
 
@@ -26,18 +24,18 @@ func (cfg *apiConfig) handlerSensorsChangeSampleFrequency(w http.ResponseWriter,
 	params := parameters{}
 	decoder.Decode(&params)
 
-	publishCh, err := cfg.rabbitConn.Channel()
+	queue, err := routing.SensorCommandsQueue(sensorSerialNumber)
 	if err != nil {
-		respondWithError(w, 500, "could not create channel to publish sensor's new sample frequency:", err)
+		respondWithError(w, 400, "invalid sensor serial number", err)
 		return
 	}
-	defer publishCh.Close()
 
-	err = pubsub.PublishGob(
+	err = pubsub.PublishConfirmed(
 		ctx,
-		publishCh,                // amqp.Channel
-		routing.ExchangeTopicIoT, // exchange
-		fmt.Sprintf(routing.KeySensorCommandsFormat, sensorSerialNumber)+"."+"change_sample_frequency", // routing key
+		cfg.publisher,    // confirming publisher
+		commandsExchange, // exchange
+		queue,            // routing key, the command queue of the sensor
+		pubsub.GobCodec{},
 		routing.SensorCommandMessage{
 			SerialNumber: sensorSerialNumber,
 			Timestamp:    time.Now(),
@@ -48,6 +46,7 @@ func (cfg *apiConfig) handlerSensorsChangeSampleFrequency(w http.ResponseWriter,
 		}, // value
 	)
 	if err != nil {
-		log.Printf("could not publish change sample frequency command: %v", err)
+		respondWithPublishError(w, "could not publish change sample frequency command", err)
+		return
 	}
 }
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 	"time"
 
@@ -14,18 +12,18 @@ func (cfg *apiConfig) handlerSensorsSleep(w http.ResponseWriter, req *http.Reque
 	ctx := req.Context()
 	sensorSerialNumber := req.PathValue("sensorSerialNumber")
 
-	publishCh, err := cfg.rabbitConn.Channel()
+	queue, err := routing.SensorCommandsQueue(sensorSerialNumber)
 	if err != nil {
-		respondWithError(w, 500, "could not create channel to publish sensor's sleep command", err)
+		respondWithError(w, 400, "invalid sensor serial number", err)
 		return
 	}
-	defer publishCh.Close()
 
-	err = pubsub.PublishGob(
+	err = pubsub.PublishConfirmed(
 		ctx,
-		publishCh,                // amqp.Channel
-		routing.ExchangeTopicIoT, // exchange
-		fmt.Sprintf(routing.KeySensorCommandsFormat, sensorSerialNumber)+"."+"sleep", // routing key
+		cfg.publisher,    // confirming publisher
+		commandsExchange, // exchange
+		queue,            // routing key, the command queue of the sensor
+		pubsub.GobCodec{},
 		routing.SensorCommandMessage{
 			SerialNumber: sensorSerialNumber,
 			Timestamp:    time.Now(),
@@ -34,7 +32,8 @@ func (cfg *apiConfig) handlerSensorsSleep(w http.ResponseWriter, req *http.Reque
 		}, // value
 	)
 	if err != nil {
-		log.Printf("could not publish sleep command: %v", err)
+		respondWithPublishError(w, "could not publish sleep command", err)
+		return
 	}
 
 }
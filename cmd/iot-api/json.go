@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
@@ -19,6 +22,21 @@ func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
 	respondWithJSON(w, code, errorResponse{Error: msg})
 }
 
+// respondWithPublishError maps the broker verdict on a confirmed publish to a status code: a
+// returned message had no queue to go to, e.g. a command to a sensor not subscribed to
+// commands, and a nack or a missing confirm means the broker could not take it right now. The
+// iot exchange never returns messages, it hands them to its alternate exchange instead.
+func respondWithPublishError(w http.ResponseWriter, msg string, err error) {
+	switch {
+	case errors.Is(err, pubsub.ErrUnroutable):
+		respondWithError(w, 404, msg+": no queue takes it", err)
+	case errors.Is(err, pubsub.ErrNacked), errors.Is(err, pubsub.ErrConfirmTimeout):
+		respondWithError(w, 503, msg+": broker did not accept it", err)
+	default:
+		respondWithError(w, 500, msg, err)
+	}
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -1,28 +1,62 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/iferdel/sensor-data-streaming-server/internal/topology"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 )
 
+type serviceConfig struct {
+	RabbitMQ config.RabbitMQ `json:"rabbitmq"`
+	Postgres config.Postgres `json:"postgres"`
+	Tracing  tracing.Config  `json:"tracing"`
+	Port     int             `json:"port" env:"PORT" flag:"port" default:"8080" help:"port the api listens on"`
+}
+
+func (c *serviceConfig) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	return nil
+}
+
 type apiConfig struct {
-	rabbitConn *amqp.Connection
+	rabbitConn *pubsub.Connection
+	publisher  *pubsub.ConfirmPublisher
 	db         *storage.DB
 }
 
-func NewApiConfig() (*apiConfig, error) {
-	conn, err := amqp.Dial(routing.RabbitConnString)
+func NewApiConfig(cfg serviceConfig) (*apiConfig, error) {
+	conn, err := pubsub.Dial(cfg.RabbitMQ.URL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
-	db, err := storage.NewDBPool(storage.PostgresConnString)
+	// exchanges and queues the service relies on, declared again after every reconnect
+	err = pubsub.DeclareTopology(conn, topology.Topology())
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare topology: %w", err)
+	}
+
+	publisher, err := pubsub.NewConfirmPublisher(conn, pubsub.DefaultConfirmTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create confirming publisher: %w", err)
+	}
+
+	db, err := storage.NewDBPool(cfg.Postgres.URL)
 	if err != nil {
 		// ideally this should be more flexible, similarly to what one sees in DDD approaches
 		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
@@ -30,22 +64,35 @@ func NewApiConfig() (*apiConfig, error) {
 
 	return &apiConfig{
 		rabbitConn: conn,
+		publisher:  publisher,
 		db:         db,
 	}, nil
 }
 
-const PORT = "8080"
+// shutdownTimeout bounds the graceful shutdown, within the 10s docker waits before killing
+const shutdownTimeout = 8 * time.Second
 
 func main() {
+	cfg := config.MustLoad[serviceConfig]("iot-api")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	router := http.NewServeMux()
 
 	server := http.Server{
-		Addr:              ":" + PORT, // within a container, setting localhost would only enable communication from within the container
-		Handler:           router,
+		Addr:              ":" + strconv.Itoa(cfg.Port), // within a container, setting localhost would only enable communication from within the container
+		Handler:           middlewareTrace(router),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	apiCfg, err := NewApiConfig()
+	pubsub.Producer = "iot-api"
+	tracer, err := tracing.Init("iot-api", cfg.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	apiCfg, err := NewApiConfig(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -58,7 +105,7 @@ func main() {
 	// router.HandleFunc("POST /api/v1/regenerate-key", apiCfg.handlerAccountRegenerateKey)
 	router.HandleFunc("GET /api/v1/sensors", apiCfg.handlerSensorsRetrieve)
 	router.HandleFunc("GET /api/v1/sensors/{sensorSerialNumber}", apiCfg.handlerSensorsGet)
-	// router.HandleFunc("DELETE /api/v1/sensors/{sensorSerialNumber}", apiCfg.handlerTargetsCreate)
+	router.HandleFunc("DELETE /api/v1/sensors/{sensorSerialNumber}", apiCfg.handlerSensorsDelete)
 	router.HandleFunc("GET /api/v1/targets", apiCfg.handlerTargetsGet)
 	router.HandleFunc("POST /api/v1/targets", apiCfg.handlerTargetsCreate)
 	// router.HandleFunc("DELETE /api/v1/targets/{sensorSerialNumber}", apiCfg.handlerTargetsDelete)
@@ -66,11 +113,69 @@ func main() {
 	router.HandleFunc("PUT /api/v1/sensors/{sensorSerialNumber}/sleep", apiCfg.handlerSensorsSleep)
 	router.HandleFunc("PUT /api/v1/sensors/{sensorSerialNumber}/awake", apiCfg.handlerSensorsAwake)
 	router.HandleFunc("PUT /api/v1/sensors/{sensorSerialNumber}/change-sample-frequency", apiCfg.handlerSensorsChangeSampleFrequency)
+	router.HandleFunc("GET /api/v1/deadletters", apiCfg.handlerDeadLettersRetrieve)
+	router.HandleFunc("GET /api/v1/deadletters/{deadLetterID}", apiCfg.handlerDeadLettersGet)
+	router.HandleFunc("POST /api/v1/deadletters/{deadLetterID}/replay", apiCfg.handlerDeadLettersReplay)
+	router.HandleFunc("DELETE /api/v1/deadletters", apiCfg.handlerDeadLettersPurge)
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("error in listen and serve: %v\n", err)
+			stop()
+		}
+	}()
 
-	err = server.ListenAndServe()
+	<-ctx.Done()
+	fmt.Println("Shutting down gracefully...")
+
+	// requests in flight get their publish confirmed before the connection goes away
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not shut down server: %v\n", err)
+	}
+	apiCfg.publisher.Close()
+	err = apiCfg.rabbitConn.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not close RabbitMQ connection: %v\n", err)
+	}
+	err = tracer.Shutdown(shutdownCtx)
 	if err != nil {
-		fmt.Printf("error in listen and serve: %v", err)
+		fmt.Printf("could not export remaining spans: %v\n", err)
 	}
+	fmt.Println("Shutdown complete.")
+}
+
+// middlewareTrace serves every request under a span, continuing the trace of the caller (e.g.
+// iotctl) when it sent a traceparent. Commands published while handling the request carry it on.
+func middlewareTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := tracing.Extract(req.Context(), req.Header.Get(tracing.TraceParentHeader))
+		ctx, span := tracing.Start(ctx, req.Method+" "+req.URL.Path, tracing.SpanKindServer)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		req = req.WithContext(ctx)
+		next.ServeHTTP(rec, req)
+
+		span.SetAttribute("http.route", req.Pattern) // set by the router on the request it was handed
+		span.SetAttribute("http.response.status_code", strconv.Itoa(rec.status))
+		if rec.status >= 500 {
+			span.SetError(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
 }
 
 // func (cfg *apiConfig) middelwareLog(next http.Handler) http.Handler {
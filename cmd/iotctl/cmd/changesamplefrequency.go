@@ -51,7 +51,7 @@ var changeSampleFrequencyCmd = &cobra.Command{
 			return
 		}
 
-		url := fmt.Sprintf("%s/sensors/%s/change-sample-frequency", API_URL, sensorSerialNumber)
+		url := fmt.Sprintf("%s/sensors/%s/change-sample-frequency", cfg.APIURL, sensorSerialNumber)
 		req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(jsonData))
 
 		req.Header.Set("Content-Type", "application/json")
@@ -61,14 +61,17 @@ var changeSampleFrequencyCmd = &cobra.Command{
 			return
 		}
 
-		client := &http.Client{}
-		res, err := client.Do(req)
+		res, err := apiClient.Do(req)
 		if err != nil {
 			fmt.Println("error making request: %w", err)
 			return
 		}
 		defer res.Body.Close()
 
+		if res.StatusCode == http.StatusNotFound {
+			fmt.Printf("sensor %s is not subscribed to commands, command not delivered\n", sensorSerialNumber)
+			return
+		}
 		if res.StatusCode < 200 || res.StatusCode >= 300 {
 			fmt.Printf("received non-2xx response code: %d", res.StatusCode)
 			return
@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+var deadLettersCmd = &cobra.Command{
+	Use:   "deadletters",
+	Short: "Inspect, replay and purge messages quarantined after being rejected by a consumer",
+}
+
+var deadLettersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List quarantined messages, most recent first",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		query, err := deadLettersFilterQuery(cmd)
+		if err != nil {
+			log.Printf("error retrieving filter flags: %v", err)
+			return
+		}
+		limit, err := cmd.Flags().GetInt("limit")
+		if err != nil {
+			log.Printf("error retrieving limit flag: %v", err)
+			return
+		}
+		if limit > 0 {
+			query.Set("limit", strconv.Itoa(limit))
+		}
+
+		url := fmt.Sprintf("%s/deadletters?%s", cfg.APIURL, query.Encode())
+		resp, err := apiClient.Get(url)
+		if err != nil {
+			fmt.Println("error making request: %w", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			fmt.Printf("received non-2xx response code: %d", resp.StatusCode)
+			return
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		deadLetters := []storage.DeadLetterRecord{}
+		err = decoder.Decode(&deadLetters)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		fmt.Println("Dead letters")
+		for _, dl := range deadLetters {
+			fmt.Printf("id: %d\treceived_at: %s\treason: %s\trouting_key: %s\tqueue: %s\n",
+				dl.ID,
+				dl.ReceivedAt.Format("2006-01-02T15:04:05Z07:00"),
+				dl.Reason,
+				dl.RoutingKey,
+				dl.SourceQueue,
+			)
+		}
+	},
+}
+
+var deadLettersShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show a quarantined message with its decoded payload",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			log.Printf("dead letter id must be an integer")
+			return
+		}
+
+		url := fmt.Sprintf("%s/deadletters/%d", cfg.APIURL, id)
+		resp, err := apiClient.Get(url)
+		if err != nil {
+			fmt.Println("error making request: %w", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			fmt.Printf("received non-2xx response code: %d", resp.StatusCode)
+			return
+		}
+
+		var deadLetter map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&deadLetter)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		delete(deadLetter, "payload") // raw bytes, the decoded version is far more readable
+
+		out, err := json.MarshalIndent(deadLetter, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(string(out))
+	},
+}
+
+var deadLettersReplayCmd = &cobra.Command{
+	Use:   "replay <id> [id...]",
+	Short: "Republish quarantined messages to the iot exchange with their original routing key",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				log.Printf("dead letter id must be an integer: %v", arg)
+				continue
+			}
+
+			url := fmt.Sprintf("%s/deadletters/%d/replay", cfg.APIURL, id)
+			req, err := http.NewRequest(http.MethodPost, url, nil)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			res, err := apiClient.Do(req)
+			if err != nil {
+				fmt.Println("error making request: %w", err)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode < 200 || res.StatusCode >= 300 {
+				fmt.Printf("dead letter %d: received non-2xx response code: %d\n", id, res.StatusCode)
+				continue
+			}
+			fmt.Printf("dead letter %d replayed\n", id)
+		}
+	},
+}
+
+var deadLettersPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete quarantined messages matching the filters",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		query, err := deadLettersFilterQuery(cmd)
+		if err != nil {
+			log.Printf("error retrieving filter flags: %v", err)
+			return
+		}
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			log.Printf("error retrieving all flag: %v", err)
+			return
+		}
+		if len(query) == 0 {
+			if !all {
+				log.Printf("refusing to purge every dead letter without --all")
+				return
+			}
+			query.Set("all", "true")
+		}
+
+		url := fmt.Sprintf("%s/deadletters?%s", cfg.APIURL, query.Encode())
+		req, err := http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		res, err := apiClient.Do(req)
+		if err != nil {
+			fmt.Println("error making request: %w", err)
+			return
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			fmt.Printf("received non-2xx response code: %d", res.StatusCode)
+			return
+		}
+
+		var purged struct {
+			Purged int64 `json:"purged"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&purged)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%d dead letters purged\n", purged.Purged)
+	},
+}
+
+// deadLettersFilterQuery maps the filter flags shared by list and purge into query parameters.
+func deadLettersFilterQuery(cmd *cobra.Command) (url.Values, error) {
+	query := url.Values{}
+	for flag, param := range map[string]string{
+		"routing-key": "routing_key",
+		"sensor":      "sensor",
+		"reason":      "reason",
+		"since":       "since",
+		"until":       "until",
+	} {
+		value, err := cmd.Flags().GetString(flag)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	return query, nil
+}
+
+func addDeadLettersFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("routing-key", "k", "", "original routing key")
+	cmd.Flags().StringP("sensor", "s", "", "sensorid")
+	cmd.Flags().StringP("reason", "r", "", "dead-letter reason (rejected, expired, maxlen, delivery_limit)")
+	cmd.Flags().String("since", "", "received at or after (RFC3339)")
+	cmd.Flags().String("until", "", "received before (RFC3339)")
+}
+
+func init() {
+	rootCmd.AddCommand(deadLettersCmd)
+
+	deadLettersCmd.AddCommand(deadLettersListCmd)
+	addDeadLettersFilterFlags(deadLettersListCmd)
+	deadLettersListCmd.Flags().IntP("limit", "l", 50, "maximum number of dead letters to list")
+
+	deadLettersCmd.AddCommand(deadLettersShowCmd)
+	deadLettersCmd.AddCommand(deadLettersReplayCmd)
+
+	deadLettersCmd.AddCommand(deadLettersPurgeCmd)
+	addDeadLettersFilterFlags(deadLettersPurgeCmd)
+	deadLettersPurgeCmd.Flags().BoolP("all", "a", false, "purge every dead letter when no filter is given")
+}
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
+	"net/http"
 
 	"github.com/iferdel/sensor-data-streaming-server/internal/validation"
 	"github.com/spf13/cobra"
@@ -25,6 +27,26 @@ var deleteCmd = &cobra.Command{
 			log.Printf("sensor serial number not valid")
 			return
 		}
+
+		url := fmt.Sprintf("%s/sensors/%s", cfg.APIURL, sensorSerialNumber)
+		req, err := http.NewRequest(http.MethodDelete, url, nil)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		res, err := apiClient.Do(req)
+		if err != nil {
+			fmt.Println("error making request: %w", err)
+			return
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			fmt.Printf("received non-2xx response code: %d", res.StatusCode)
+			return
+		}
+		fmt.Printf("sensor %s deregistration requested\n", sensorSerialNumber)
 	},
 }
 
@@ -3,7 +3,6 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
 
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
 	"github.com/spf13/cobra"
@@ -14,8 +13,8 @@ var getCmd = &cobra.Command{
 	Short: "Retrieve all registered sensors",
 	Run: func(cmd *cobra.Command, args []string) {
 
-		url := fmt.Sprintf("%s/sensors", API_URL)
-		resp, err := http.Get(url)
+		url := fmt.Sprintf("%s/sensors", cfg.APIURL)
+		resp, err := apiClient.Get(url)
 		if err != nil {
 			fmt.Println("error making request: %w", err)
 			return
@@ -1,10 +1,28 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 	"github.com/spf13/cobra"
 )
 
-const API_URL = "http://localhost:8080/api/v1"
+type cliConfig struct {
+	APIURL  string         `json:"api_url" env:"IOTCTL_API_URL" flag:"api-url" default:"http://localhost:8080/api/v1" help:"base URL of iot-api"`
+	Tracing tracing.Config `json:"tracing"`
+}
+
+// cfg is loaded before every command runs, its flags being persistent flags of the root command
+var (
+	cfgSet = config.NewSet[cliConfig]("iotctl")
+	cfg    cliConfig
+)
 
 var rootCmd = &cobra.Command{
 	Use:   "iotctl",
@@ -12,9 +30,74 @@ var rootCmd = &cobra.Command{
 	Long: `This CLI tool allows you to manage resources (sensors) 
 It allows the use of keywords to alter the behaviour of the available sensors in the cluster. 
 Every command has some flags such as sensor id or parameters related to the command itself.`,
+	PersistentPreRun:  loadConfig,
+	PersistentPostRun: endCommandTrace,
+}
+
+// every command runs under a span of its own, which the requests it makes through apiClient
+// carry on to iot-api and from there to the sensors
+var (
+	tracer      *tracing.Tracer
+	commandSpan *tracing.Span
+	apiClient   = &http.Client{}
+)
+
+func loadConfig(cmd *cobra.Command, args []string) {
+	var err error
+	cfg, err = cfgSet.Load()
+	if errors.Is(err, config.ErrConfigPrinted) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	startCommandTrace(cmd)
+}
+
+func startCommandTrace(cmd *cobra.Command) {
+	var err error
+	tracer, err = tracing.Init("iotctl", cfg.Tracing)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_, commandSpan = tracing.Start(context.Background(), "iotctl "+cmd.Name(), tracing.SpanKindClient)
+	apiClient.Transport = traceTransport{base: http.DefaultTransport, span: commandSpan}
+
+	if printTrace, _ := cmd.Flags().GetBool("trace"); printTrace {
+		fmt.Printf("trace id: %s\n", commandSpan.TraceID())
+	}
+}
+
+func endCommandTrace(cmd *cobra.Command, args []string) {
+	if tracer == nil {
+		return
+	}
+	commandSpan.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tracer.Shutdown(ctx)
+}
+
+// traceTransport sends the traceparent of the command span along with every request.
+type traceTransport struct {
+	base http.RoundTripper
+	span *tracing.Span
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(tracing.TraceParentHeader, t.span.TraceParent())
+	return t.base.RoundTrip(req)
 }
 
 // Execute executes the root command.
 func Execute() error {
 	return rootCmd.Execute()
 }
+
+func init() {
+	rootCmd.PersistentFlags().AddGoFlagSet(cfgSet.FlagSet())
+	rootCmd.PersistentFlags().Bool("trace", false, "print the trace id of the command, to look it up in the collector")
+}
@@ -39,21 +39,24 @@ var sleepCmd = &cobra.Command{
 			return
 		}
 
-		url := fmt.Sprintf("%s/sensors/%s/sleep", API_URL, sensorSerialNumber)
+		url := fmt.Sprintf("%s/sensors/%s/sleep", cfg.APIURL, sensorSerialNumber)
 		req, err := http.NewRequest(http.MethodPut, url, nil)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		client := &http.Client{}
-		res, err := client.Do(req)
+		res, err := apiClient.Do(req)
 		if err != nil {
 			fmt.Println("error making request: %w", err)
 			return
 		}
 		defer res.Body.Close()
 
+		if res.StatusCode == http.StatusNotFound {
+			fmt.Printf("sensor %s is not subscribed to commands, command not delivered\n", sensorSerialNumber)
+			return
+		}
 		if res.StatusCode < 200 || res.StatusCode >= 300 {
 			fmt.Printf("received non-2xx response code: %d", res.StatusCode)
 			return
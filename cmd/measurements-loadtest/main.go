@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
+	"github.com/iferdel/sensor-data-streaming-server/internal/loadtest"
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+)
+
+type loadtestConfig struct {
+	Postgres    config.Postgres `json:"postgres"`
+	Strategies  string          `json:"strategies" flag:"strategies" help:"comma separated write strategies to compare, all of them when empty"`
+	Batches     int             `json:"batches" flag:"batches" default:"100" help:"number of batches written per strategy"`
+	BatchSize   int             `json:"batch_size" flag:"batch-size" default:"5000" help:"measurements per batch"`
+	Concurrency int             `json:"concurrency" flag:"concurrency" default:"1" help:"batches written at once"`
+	Frequency   float64         `json:"frequency" flag:"frequency" default:"25000" help:"sample frequency of the synthetic sensors in Hz"`
+}
+
+// measurements-loadtest writes synthetic measurements to the database with each storage
+// write strategy and reports the throughput and write latency of each, e.g.
+//
+//	go run ./cmd/measurements-loadtest -strategies array,copy -batches 200 -batch-size 5000
+func main() {
+	cfg := config.MustLoad[loadtestConfig]("measurements-loadtest")
+	strategies := storage.WriteStrategies
+	if cfg.Strategies != "" {
+		strategies = strings.Split(cfg.Strategies, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := storage.NewDBPool(cfg.Postgres.URL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	sensors, err := db.GetSensorIDBySerialNumberMap(ctx)
+	if err != nil {
+		fmt.Printf("could not fetch sensors: %v\n", err)
+		os.Exit(1)
+	}
+	if len(sensors) == 0 {
+		fmt.Println("no registered sensors, measurements need one to reference")
+		os.Exit(1)
+	}
+	sensorIDs := make([]int, 0, len(sensors))
+	for _, id := range sensors {
+		sensorIDs = append(sensorIDs, id)
+	}
+
+	// an hour ahead keeps clear of live sensors, each strategy writes after the previous one
+	// since the (sensor_id, time) unique index would reject or skip repeated rows
+	start := time.Now().Add(time.Hour)
+	span := time.Duration(float64(cfg.Batches*cfg.BatchSize) / cfg.Frequency * float64(time.Second))
+
+	fmt.Printf("writing %d batches of %d measurements for %d sensors, %d at once\n\n", cfg.Batches, cfg.BatchSize, len(sensorIDs), cfg.Concurrency)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "strategy\trows\terrors\telapsed\trows/s\tp50\tp99\t")
+	for _, strategy := range strategies {
+		writer, err := db.MeasurementWriter(strings.TrimSpace(strategy))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		data := loadtest.SyntheticBatches(sensorIDs, start, cfg.Batches, cfg.BatchSize, cfg.Frequency)
+		start = start.Add(span)
+
+		result := loadtest.Run(ctx, writer, data, cfg.Concurrency)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%.0f\t%v\t%v\t\n",
+			strategy,
+			result.Rows,
+			result.Errors,
+			result.Elapsed.Round(time.Millisecond),
+			result.RowsPerSecond(),
+			result.P50.Round(time.Microsecond),
+			result.P99.Round(time.Microsecond),
+		)
+		w.Flush()
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func handlerDeadLetter(ctx context.Context, db *storage.DB) func(msg amqp.Delivery) pubsub.AckType {
+	return func(msg amqp.Delivery) pubsub.AckType {
+		dl := pubsub.ParseDeadLetter(msg)
+		key, _ := routing.ParseKey(dl.RoutingKey) // zero when not a sensor key
+
+		headers, err := json.Marshal(msg.Headers)
+		if err != nil {
+			fmt.Printf("could not marshal dead letter headers: %v\n", err)
+			headers = []byte("{}")
+		}
+
+		// Map delivery -to- DB Record
+		record := storage.DeadLetterRecord{
+			Reason:       dl.Reason,
+			SourceQueue:  dl.Queue,
+			RoutingKey:   dl.RoutingKey,
+			SerialNumber: key.SerialNumber,
+			ContentType:  msg.ContentType,
+			Headers:      headers,
+			Payload:      msg.Body,
+		}
+
+		err = db.WriteDeadLetter(ctx, record)
+		if err != nil {
+			fmt.Printf("error writing dead letter: %v\n", err)
+			return pubsub.NackRequeue
+		}
+
+		return pubsub.Ack
+	}
+}
+
+func handlerUnroutable(ctx context.Context, db *storage.DB) func(msg amqp.Delivery) pubsub.AckType {
+	return func(msg amqp.Delivery) pubsub.AckType {
+		// keys of a channel or action nothing is bound for do not parse, the payload still
+		// tells the sensor
+		key, _ := routing.ParseKey(msg.RoutingKey)
+		serialNumber := key.SerialNumber
+		if serialNumber == "" {
+			serialNumber = serialNumberFromPayload(msg)
+		}
+
+		// Map delivery -to- DB Record
+		record := storage.UnroutableMessageRecord{
+			Exchange:     msg.Exchange,
+			RoutingKey:   msg.RoutingKey,
+			SerialNumber: serialNumber,
+			ContentType:  msg.ContentType,
+			SizeBytes:    len(msg.Body),
+		}
+
+		err := db.WriteUnroutableMessage(ctx, record)
+		if err != nil {
+			fmt.Printf("error writing unroutable message: %v\n", err)
+			return pubsub.NackRequeue
+		}
+		// counted once written, a failed write is requeued and would be counted again
+		metricsUnroutableMessages.WithLabelValues(serialNumber).Inc()
+
+		return pubsub.Ack
+	}
+}
+
+// serialNumberFromPayload looks for a SerialNumber field in the payload, which every DTO has.
+func serialNumberFromPayload(msg amqp.Delivery) string {
+	type serialNumbered struct {
+		SerialNumber string
+	}
+	dto, err := pubsub.DecodeMessage[serialNumbered](msg.ContentType, msg.Headers, msg.Body)
+	if err != nil {
+		return ""
+	}
+	return dto.SerialNumber
+}
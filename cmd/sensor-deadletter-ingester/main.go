@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/iferdel/sensor-data-streaming-server/internal/topology"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// shutdownTimeout bounds the graceful shutdown, within the 10s docker waits before killing
+const shutdownTimeout = 8 * time.Second
+
+type serviceConfig struct {
+	RabbitMQ config.RabbitMQ `json:"rabbitmq"`
+	Postgres config.Postgres `json:"postgres"`
+	Tracing  tracing.Config  `json:"tracing"`
+}
+
+func main() {
+	cfg := config.MustLoad[serviceConfig]("sensor-deadletter-ingester")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tracer, err := tracing.Init("sensor-deadletter-ingester", cfg.Tracing)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	conn, err := pubsub.Dial(cfg.RabbitMQ.URL)
+	if err != nil {
+		msg := fmt.Sprintf("could not connect to RabbitMQ: %v", err)
+		fmt.Println(msg)
+		return
+	}
+	defer conn.Close()
+
+	// exchanges and queues the service relies on, declared again after every reconnect
+	err = pubsub.DeclareTopology(conn, topology.Topology())
+	if err != nil {
+		fmt.Printf("could not declare topology: %v\n", err)
+		return
+	}
+
+	db, err := storage.NewDBPool(cfg.Postgres.URL)
+	if err != nil {
+		fmt.Printf("could not connect to Postgres: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	// handlers finish what they started while shutting down, ctx only stops the consumers
+	handlerCtx := context.WithoutCancel(ctx)
+
+	// subscribe to the dead-letter queue, raw deliveries since we keep headers and payload as they are
+	err = pubsub.SubscribeDelivery(
+		ctx,
+		conn,
+		routing.ExchangeTopicDeadLetter,
+		routing.QueueSensorDeadLetter,
+		routing.KeyDeadLetter, // binding key
+		pubsub.QueueDurable,
+		pubsub.QueueQuorum,
+		handlerDeadLetter(handlerCtx, db),
+		// quarantined messages have no dead-letter exchange left, they wait for the database
+		pubsub.WithoutRequeueLimit(),
+		pubsub.WithMiddleware(
+			pubsub.Metrics[amqp.Delivery](routing.QueueSensorDeadLetter),
+			pubsub.Logging[amqp.Delivery](logger, routing.QueueSensorDeadLetter),
+			pubsub.Recover[amqp.Delivery](routing.QueueSensorDeadLetter),
+			pubsub.Dedup(
+				routing.QueueSensorDeadLetter,
+				pubsub.NewMemoryDedupStore(pubsub.DefaultDedupCapacity, pubsub.DefaultDedupTTL),
+				pubsub.DeadLetterMessageID,
+			),
+		),
+	)
+	if err != nil {
+		log.Fatalf("could not starting consuming dead letters: %v", err)
+	}
+
+	// subscribe to what the alternate exchange of iot collects, only metadata is kept
+	err = pubsub.SubscribeDelivery(
+		ctx,
+		conn,
+		routing.ExchangeUnroutable,
+		routing.QueueUnroutable,
+		routing.KeyUnroutable, // binding key
+		pubsub.QueueDurable,
+		pubsub.QueueQuorum,
+		handlerUnroutable(handlerCtx, db),
+		pubsub.WithoutRequeueLimit(),
+		pubsub.WithMiddleware(
+			pubsub.Metrics[amqp.Delivery](routing.QueueUnroutable),
+			pubsub.Logging[amqp.Delivery](logger, routing.QueueUnroutable),
+			pubsub.Recover[amqp.Delivery](routing.QueueUnroutable),
+		),
+	)
+	if err != nil {
+		log.Fatalf("could not starting consuming unroutable messages: %v", err)
+	}
+
+	// metrics endpoint for 'Instrumenting a Go application for Prometheus'
+	http.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{Addr: ":2112", ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("metrics server failed: %v\n", err)
+		}
+	}()
+
+	// Graceful shutdown handling
+	fmt.Println("Waiting for messages...")
+	<-ctx.Done()
+	fmt.Println("Shutting down gracefully...")
+
+	// in-flight deliveries are handled and acknowledged before the connection goes away
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = conn.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not drain consumers: %v\n", err)
+	}
+	err = metricsServer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not shut down metrics server: %v\n", err)
+	}
+	err = tracer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not export remaining spans: %v\n", err)
+	}
+	fmt.Println("Shutdown complete.")
+}
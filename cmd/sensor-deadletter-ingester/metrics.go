@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// metricsUnroutableMessages counts messages the iot exchange had no queue for, a growing
+	// series for a sensor means it publishes with a wrong routing key
+	metricsUnroutableMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "iot_unroutable_messages_total",
+			Help: "Total messages published to the iot exchange that no queue was bound for",
+		},
+		[]string{"sensor_serial"}, // empty when the serial could not be told from key nor payload
+	)
+)
@@ -6,6 +6,7 @@ import (
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
 	"github.com/iferdel/sensor-data-streaming-server/internal/sensorlogic"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func handlerLogs() func(log routing.SensorLog) pubsub.AckType {
@@ -20,3 +21,10 @@ func handlerLogs() func(log routing.SensorLog) pubsub.AckType {
 		return pubsub.Ack
 	}
 }
+
+// serialNumber orders the logs of a sensor, those with a key that does not parse share a
+// worker.
+func serialNumber(msg amqp.Delivery) string {
+	key, _ := routing.ParseKey(msg.RoutingKey)
+	return key.SerialNumber
+}
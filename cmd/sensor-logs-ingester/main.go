@@ -2,22 +2,47 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/topology"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// shutdownTimeout bounds the graceful shutdown, within the 10s docker waits before killing
+const shutdownTimeout = 8 * time.Second
+
+type serviceConfig struct {
+	RabbitMQ config.RabbitMQ `json:"rabbitmq"`
+	Tracing  tracing.Config  `json:"tracing"`
+}
+
 func main() {
+	cfg := config.MustLoad[serviceConfig]("sensor-logs-ingester")
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	conn, err := amqp.Dial(routing.RabbitConnString)
+	tracer, err := tracing.Init("sensor-logs-ingester", cfg.Tracing)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	conn, err := pubsub.Dial(cfg.RabbitMQ.URL)
 	if err != nil {
 		msg := fmt.Sprintf("could not connect to RabbitMQ: %v", err)
 		fmt.Println(msg)
@@ -25,23 +50,78 @@ func main() {
 	}
 	defer conn.Close()
 
+	// exchanges and queues the service relies on, declared again after every reconnect
+	err = pubsub.DeclareTopology(conn, topology.Topology())
+	if err != nil {
+		fmt.Printf("could not declare topology: %v\n", err)
+		return
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
 	// subscribe to Log queue
-	err = pubsub.SubscribeGob(
+	err = pubsub.Subscribe(
 		ctx,
 		conn,
 		routing.ExchangeTopicIoT,
 		routing.QueueSensorLogs,
-		fmt.Sprintf(routing.KeySensorLogsFormat, "*")+"."+"#", // binding key
+		routing.AnySensorBinding(routing.ChannelLogs, routing.AnyAction), // binding key
 		pubsub.QueueDurable,
 		pubsub.QueueQuorum,
 		handlerLogs(),
+		pubsub.WithDeadLetter(pubsub.DeadLetterConfig{
+			Exchange:      routing.ExchangeTopicDeadLetter,
+			DeliveryLimit: pubsub.MaxRedeliveries,
+		}),
+		pubsub.WithRetryPolicy(pubsub.DefaultRetryPolicy),
+		// logs of different sensors are written in parallel, those of a sensor in order
+		pubsub.WithConcurrency(4),
+		pubsub.WithPrefetch(4*pubsub.DefaultPrefetch),
+		pubsub.WithOrderingKey(serialNumber),
+		pubsub.WithMiddleware(
+			pubsub.Metrics[amqp.Delivery](routing.QueueSensorLogs),
+			pubsub.Logging[amqp.Delivery](logger, routing.QueueSensorLogs),
+			pubsub.Recover[amqp.Delivery](routing.QueueSensorLogs),
+			pubsub.Dedup(
+				routing.QueueSensorLogs,
+				pubsub.NewMemoryDedupStore(pubsub.DefaultDedupCapacity, pubsub.DefaultDedupTTL),
+				pubsub.DeliveryMessageID,
+			),
+		),
 	)
 	if err != nil {
 		log.Fatalf("could not starting consuming logs: %v", err)
 	}
 
+	// metrics endpoint for 'Instrumenting a Go application for Prometheus'
+	http.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{Addr: ":2112", ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("metrics server failed: %v\n", err)
+		}
+	}()
+
 	// Graceful shutdown handling
 	fmt.Println("Waiting for messages...")
 	<-ctx.Done()
 	fmt.Println("Shutting down gracefully...")
+
+	// in-flight deliveries are handled and acknowledged before the connection goes away
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = conn.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not drain consumers: %v\n", err)
+	}
+	err = metricsServer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not shut down metrics server: %v\n", err)
+	}
+	err = tracer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not export remaining spans: %v\n", err)
+	}
+	fmt.Println("Shutdown complete.")
 }
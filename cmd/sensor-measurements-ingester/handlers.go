@@ -1,57 +1,153 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing/pb"
 	"github.com/iferdel/sensor-data-streaming-server/internal/sensorlogic"
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 )
 
-func handlerMeasurements(ctx context.Context, db *storage.DB) func(m []routing.SensorMeasurement) pubsub.AckType {
-	return func(m []routing.SensorMeasurement) pubsub.AckType {
-		err := sensorlogic.HandleMeasurements(ctx, db, m)
+// measurementsPayload holds whichever layout a sensor sent: a columnar batch, or the
+// per-sample measurements older sensors publish.
+type measurementsPayload struct {
+	batch        *routing.SensorMeasurementBatch
+	measurements []routing.SensorMeasurement
+	traceParent  string // of per-sample protobuf batches, columnar ones keep theirs
+	messageID    string // likewise
+}
+
+// TraceParent lets the stream consumer continue the trace the sensor started on publish.
+func (p measurementsPayload) TraceParent() string {
+	if p.batch != nil {
+		return p.batch.TraceParent
+	}
+	return p.traceParent
+}
+
+// MessageID tells a batch published twice, e.g. by a sensor retrying over a new MQTT
+// connection, empty for sensors that predate message ids.
+func (p measurementsPayload) MessageID() string {
+	if p.batch != nil {
+		return p.batch.MessageID
+	}
+	return p.messageID
+}
+
+// decodeMeasurements accepts protobuf batches as published by the sensors and keeps
+// JSON measurements working for sensors that have not migrated yet.
+func decodeMeasurements(contentType string, data []byte) (measurementsPayload, error) {
+	switch contentType {
+	case pubsub.ContentTypeProtobuf:
+		batch, err := pubsub.Decode[*pb.MeasurementBatch](pubsub.ProtobufCodec{}, data)
+		if err != nil {
+			return measurementsPayload{}, fmt.Errorf("could not decode protobuf measurement batch: %v", err)
+		}
+		if !routing.IsColumnar(batch) {
+			return measurementsPayload{measurements: routing.MeasurementsFromBatch(batch), traceParent: batch.GetTraceParent(), messageID: batch.GetMessageId()}, nil
+		}
+		columnar, err := routing.SensorMeasurementBatchFromProto(batch)
+		if err != nil {
+			return measurementsPayload{}, err
+		}
+		return measurementsPayload{batch: &columnar}, nil
+	case pubsub.ContentTypeJSON:
+		// a columnar batch is a json object, per-sample measurements a json array
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+			batch, err := pubsub.DecodeJSON[routing.SensorMeasurementBatch](data)
+			return measurementsPayload{batch: &batch}, err
+		}
+	}
+	measurements, err := pubsub.DecodeContentType[[]routing.SensorMeasurement](contentType, data)
+	return measurementsPayload{measurements: measurements}, err
+}
+
+func handlerMeasurements(ctx context.Context, db *storage.DB) func(p measurementsPayload) pubsub.AckType {
+	return func(p measurementsPayload) pubsub.AckType {
+		var err error
+		if p.batch != nil {
+			err = sensorlogic.HandleMeasurementBatch(ctx, db, *p.batch)
+		} else {
+			err = sensorlogic.HandleMeasurements(ctx, db, p.measurements)
+		}
 		if err != nil {
 			fmt.Printf("error writing sensor measurement instance: %v\n", err)
+			if errors.Is(err, sensorlogic.ErrInvalidMeasurementBatch) {
+				return pubsub.NackDiscard
+			}
 			return pubsub.NackRequeue
 		}
 		return pubsub.Ack
 	}
 }
 
-func handlerMeasurementsWithCache(ctx context.Context, cache *sensorlogic.SensorCache, db *storage.DB) func(m []routing.SensorMeasurement) pubsub.AckType {
-	return func(m []routing.SensorMeasurement) pubsub.AckType {
-		start := time.Now()
+// sensorStats holds the count and oldest timestamp of the measurements of a sensor in a
+// message. Using oldest timestamp gives worst-case E2E latency per batch.
+type sensorStats struct {
+	count           int
+	oldestTimestamp time.Time
+}
 
-		metricsMessagesReceived.Inc()
-		metricsBatchSize.Observe(float64(len(m)))
-
-		// Count measurements and track oldest timestamp per sensor (single pass)
-		// Using oldest timestamp gives worst-case E2E latency per batch
-		type sensorStats struct {
-			count           int
-			oldestTimestamp time.Time
-		}
-		sensorData := make(map[string]*sensorStats)
-		for _, measurement := range m {
-			stats, exists := sensorData[measurement.SerialNumber]
-			if !exists {
-				sensorData[measurement.SerialNumber] = &sensorStats{
-					count:           1,
-					oldestTimestamp: measurement.Timestamp,
-				}
-			} else {
-				stats.count++
-				if measurement.Timestamp.Before(stats.oldestTimestamp) {
-					stats.oldestTimestamp = measurement.Timestamp
-				}
+// payloadStats counts measurements and tracks oldest timestamp per sensor (single pass)
+func payloadStats(p measurementsPayload) map[string]*sensorStats {
+	sensorData := make(map[string]*sensorStats)
+
+	if p.batch != nil {
+		// samples are in order, the first one is the oldest
+		sensorData[p.batch.SerialNumber] = &sensorStats{
+			count:           len(p.batch.Values),
+			oldestTimestamp: p.batch.StartTime,
+		}
+		return sensorData
+	}
+
+	for _, measurement := range p.measurements {
+		stats, exists := sensorData[measurement.SerialNumber]
+		if !exists {
+			sensorData[measurement.SerialNumber] = &sensorStats{
+				count:           1,
+				oldestTimestamp: measurement.Timestamp,
+			}
+		} else {
+			stats.count++
+			if measurement.Timestamp.Before(stats.oldestTimestamp) {
+				stats.oldestTimestamp = measurement.Timestamp
 			}
 		}
+	}
+	return sensorData
+}
+
+func (p measurementsPayload) len() int {
+	if p.batch != nil {
+		return len(p.batch.Values)
+	}
+	return len(p.measurements)
+}
+
+func handlerMeasurementsWithCache(ctx context.Context, cache *sensorlogic.SensorCache, db *storage.DB) func(p measurementsPayload) pubsub.AckType {
+	return func(p measurementsPayload) pubsub.AckType {
+		start := time.Now()
+
+		metricsMessagesReceived.Inc()
+		metricsBatchSize.Observe(float64(p.len()))
 
-		err := sensorlogic.HandleMeasurementsWithCache(ctx, cache, db, m)
+		sensorData := payloadStats(p)
+
+		var err error
+		if p.batch != nil {
+			err = sensorlogic.HandleMeasurementBatchWithCache(ctx, cache, db, *p.batch)
+		} else {
+			err = sensorlogic.HandleMeasurementsWithCache(ctx, cache, db, p.measurements)
+		}
 
 		metricsProcessingDuration.Observe(time.Since(start).Seconds())
 
@@ -66,7 +162,10 @@ func handlerMeasurementsWithCache(ctx context.Context, cache *sensorlogic.Sensor
 			for serial, stats := range sensorData {
 				metricsMeasurementsProcessed.WithLabelValues("error", serial).Add(float64(stats.count))
 			}
-			return pubsub.NackRequeue
+			if errors.Is(err, sensorlogic.ErrInvalidMeasurementBatch) {
+				return pubsub.NackDiscard // would hold the stream back forever
+			}
+			return pubsub.NackRequeue // retried until the database takes it
 		}
 
 		for serial, stats := range sensorData {
@@ -75,3 +174,124 @@ func handlerMeasurementsWithCache(ctx context.Context, cache *sensorlogic.Sensor
 		return pubsub.Ack
 	}
 }
+
+// handlerMeasurementsBuffered hands the records of each message to the write-behind buffer,
+// which writes them along with those of other messages and commits the stream offsets after.
+// Measurements count as processed, and their E2E latency is taken, once they are flushed.
+// Those of sensors not registered yet are held apart until they are, the rest of the message
+// is written as usual. A message being handled when ctx is cancelled is still looked up and
+// held, only a flush blocked on the database gives up, leaving the records to the final flush.
+func handlerMeasurementsBuffered(ctx context.Context, cache *sensorlogic.SensorCache, db *storage.DB, buffer *sensorlogic.MeasurementBuffer) func(d pubsub.StreamDelivery[measurementsPayload]) pubsub.AckType {
+	handlerCtx := context.WithoutCancel(ctx)
+	return func(d pubsub.StreamDelivery[measurementsPayload]) pubsub.AckType {
+		start := time.Now()
+		p := d.Body
+
+		metricsMessagesReceived.Inc()
+		metricsBatchSize.Observe(float64(p.len()))
+
+		sensorData := payloadStats(p)
+
+		// spans the time the measurements wait in the buffer, it ends once they are written
+		_, span := tracing.Start(d.Context(), "write measurements", tracing.SpanKindInternal)
+
+		var split sensorlogic.MeasurementsSplit
+		var err error
+		if p.batch != nil {
+			split, err = sensorlogic.SplitMeasurementBatch(*p.batch, sensorlogic.CacheResolver(handlerCtx, cache))
+		} else {
+			split, err = sensorlogic.SplitMeasurements(p.measurements, sensorlogic.CacheResolver(handlerCtx, cache))
+		}
+		if err != nil {
+			span.SetError(err)
+			span.End()
+			fmt.Printf("error mapping sensor measurements: %v\n", err)
+			if errors.Is(err, sensorlogic.ErrInvalidMeasurementBatch) {
+				for serial, stats := range sensorData {
+					metricsMeasurementsProcessed.WithLabelValues("error", serial).Add(float64(stats.count))
+				}
+				return pubsub.NackDiscard // would hold the stream back forever
+			}
+			return pubsub.NackRequeue // the database could not be asked about a sensor
+		}
+
+		// measurements of unregistered sensors are held right away, before the offset of the
+		// message can be committed by a flush
+		if len(split.Pending) > 0 {
+			span.SetAttribute("measurements.pending", strconv.Itoa(len(split.Pending)))
+			err = sensorlogic.HoldPendingMeasurements(handlerCtx, db, split.Pending)
+			if err != nil {
+				span.SetError(err)
+				span.End()
+				fmt.Printf("error holding sensor measurements: %v\n", err)
+				if !storage.IsTransient(err) {
+					for serial, stats := range sensorData {
+						metricsMeasurementsProcessed.WithLabelValues("error", serial).Add(float64(stats.count))
+					}
+					return pubsub.NackDiscard // rejected for good, would hold the stream back forever
+				}
+				return pubsub.NackRequeue
+			}
+			pendingCount := make(map[string]int)
+			for _, pending := range split.Pending {
+				pendingCount[pending.SerialNumber]++
+			}
+			for serial, count := range pendingCount {
+				metricsMeasurementsProcessed.WithLabelValues("pending", serial).Add(float64(count))
+				if stats, exists := sensorData[serial]; exists {
+					stats.count -= count
+				}
+			}
+		}
+
+		span.SetAttribute("measurements.records", strconv.Itoa(len(split.Records)))
+		err = buffer.Add(ctx, sensorlogic.MeasurementBufferEntry{
+			Records: split.Records,
+			Stream:  d.Stream,
+			Commit:  d.Commit,
+			Flushed: func(at time.Time) {
+				span.EndAt(at)
+				// Record E2E latency once per sensor per batch (using oldest = worst case latency)
+				for serial, stats := range sensorData {
+					if stats.count == 0 {
+						continue // all held as pending
+					}
+					metricsE2ELatency.WithLabelValues(serial).Observe(at.Sub(stats.oldestTimestamp).Seconds())
+					metricsMeasurementsProcessed.WithLabelValues("success", serial).Add(float64(stats.count))
+				}
+			},
+		})
+
+		metricsProcessingDuration.Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			// only happens on shutdown, the records stay buffered for the final flush and the
+			// span ends with it
+			fmt.Printf("error flushing sensor measurements: %v\n", err)
+			return pubsub.NackDiscard
+		}
+		return pubsub.Ack
+	}
+}
+
+// handlerSensorRegistryEvent keeps the cache in step with the registry between full refreshes.
+// The buffered records of a deleted sensor are dropped along with it, its measurements went
+// with the sensor row and writing them would only be rejected.
+func handlerSensorRegistryEvent(cache *sensorlogic.SensorCache, buffer *sensorlogic.MeasurementBuffer) func(event routing.SensorRegistryEvent) pubsub.AckType {
+	return func(event routing.SensorRegistryEvent) pubsub.AckType {
+		err := cache.Apply(event)
+		if err != nil {
+			fmt.Printf("error applying registry event to sensor cache: %v\n", err)
+			return pubsub.NackDiscard
+		}
+		if event.Type == routing.RegistryEventDeleted {
+			dropped := buffer.DropSensor(event.SensorID)
+			if dropped > 0 {
+				fmt.Printf("dropped %d buffered measurements of deleted sensor %s\n", dropped, event.SerialNumber)
+				metricsMeasurementsDropped.Add(float64(dropped))
+			}
+		}
+		metricsCacheEvents.WithLabelValues(event.Type).Inc()
+		return pubsub.Ack
+	}
+}
@@ -2,42 +2,94 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 	"time"
 
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
 	"github.com/iferdel/sensor-data-streaming-server/internal/sensorlogic"
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/iferdel/sensor-data-streaming-server/internal/topology"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// shutdownTimeout bounds the graceful shutdown, within the 10s docker waits before killing
+const shutdownTimeout = 8 * time.Second
+
+type serviceConfig struct {
+	RabbitMQ             config.RabbitMQ `json:"rabbitmq"`
+	Stream               config.Stream   `json:"stream"`
+	Postgres             config.Postgres `json:"postgres"`
+	Tracing              tracing.Config  `json:"tracing"`
+	CacheRefreshInterval time.Duration   `json:"cache_refresh_interval" env:"SENSOR_CACHE_REFRESH_INTERVAL" flag:"cache-refresh-interval" help:"period of the full reload of the sensor cache"`
+	Partitions           int             `json:"partitions" env:"SENSOR_MEASUREMENTS_PARTITIONS" flag:"partitions" help:"partitions of the measurements super stream when declaring it"`
+	WriteStrategy        string          `json:"write_strategy" env:"MEASUREMENTS_WRITE_STRATEGY" flag:"write-strategy" default:"array" help:"how measurements are written to the database, see cmd/measurements-loadtest"`
+}
+
+func (c *serviceConfig) SetDefaults() {
+	c.CacheRefreshInterval = sensorlogic.DefaultSensorCacheRefreshInterval
+	c.Partitions = routing.SuperStreamSensorMeasurementsPartitions
+	c.Stream.MaxLengthGB = pubsub.DefaultStreamMaxLengthGB
+}
+
+func (c *serviceConfig) Validate() error {
+	if c.CacheRefreshInterval <= 0 {
+		return fmt.Errorf("cache_refresh_interval must be positive, got %v", c.CacheRefreshInterval)
+	}
+	if c.Partitions < 1 {
+		return fmt.Errorf("partitions must be at least 1, got %d", c.Partitions)
+	}
+	if !slices.Contains(storage.IdempotentWriteStrategies, c.WriteStrategy) {
+		return fmt.Errorf("write_strategy must be one of %v, got %q", storage.IdempotentWriteStrategies, c.WriteStrategy)
+	}
+	return nil
+}
+
 func main() {
+	cfg := config.MustLoad[serviceConfig]("sensor-measurements-ingester")
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tracer, err := tracing.Init("sensor-measurements-ingester", cfg.Tracing)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	db, err := storage.NewDBPool(storage.PostgresConnString)
+	db, err := storage.NewDBPool(cfg.Postgres.URL)
 	if err != nil {
 		// ideally this should be more flexible, similarly to what one sees in DDD approaches
 		return
 	}
 	defer db.Close()
 
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
 	sensorCache, err := sensorlogic.NewSensorCache(ctx, db)
 	if err != nil {
 		fmt.Printf("Failed to initialize sensor cache: %v\n", err)
 		return
 	}
 
-	go sensorCache.StartRefreshLoop(ctx)
+	go sensorCache.StartRefreshLoop(ctx, cfg.CacheRefreshInterval)
+	registerCacheMetrics(sensorCache)
 
 	env, err := stream.NewEnvironment(
-		stream.NewEnvironmentOptions().SetUri(routing.RabbitStreamConnString),
+		stream.NewEnvironmentOptions().SetUri(cfg.Stream.URL),
 	)
 	if err != nil {
 		fmt.Printf("Error creating stream environment: %v\n", err)
@@ -45,9 +97,99 @@ func main() {
 	}
 	defer env.Close()
 
-	singleActiveConsumerUpdate := func(streamName string, isActive bool) stream.OffsetSpecification {
-		fmt.Printf("[%s] - Consumer promoted for: %s. Active status: %t\n", time.Now().Format(time.TimeOnly), streamName, isActive)
-		offset, err := env.QueryOffset(routing.StreamConsumerName, routing.QueueSensorMeasurements)
+	superStream := topology.SensorMeasurementsSuperStream(cfg.Partitions, cfg.Stream.MaxLengthGB)
+	err = pubsub.DeclareSuperStream(env, superStream.Name, superStream.Partitions, superStream.MaxLengthGB)
+	if err != nil {
+		fmt.Printf("Error declaring super stream: %v\n", err)
+		return
+	}
+
+	partitionNames, err := env.QueryPartitions(superStream.Name)
+	if err != nil {
+		fmt.Printf("Error querying super stream partitions: %v\n", err)
+		return
+	}
+
+	conn, err := pubsub.Dial(cfg.RabbitMQ.URL)
+	if err != nil {
+		fmt.Printf("could not connect to RabbitMQ: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// exchanges and queues the service relies on, declared again after every reconnect
+	err = pubsub.DeclareTopology(conn, topology.Topology())
+	if err != nil {
+		fmt.Printf("could not declare topology: %v\n", err)
+		return
+	}
+
+	// measurements are hashed on their routing key, which carries the serial number, so the
+	// samples of a sensor always go to the same partition and are written in order
+	err = pubsub.DeclareHashRouting(
+		conn,
+		superStream.HashRouting.Exchange,
+		superStream.HashRouting.BindingKey,
+		superStream.HashRouting.HashExchange,
+		partitionNames,
+	)
+	if err != nil {
+		fmt.Printf("Error declaring measurements routing: %v\n", err)
+		return
+	}
+
+	// compare strategies with cmd/measurements-loadtest before changing the default
+	writer, err := db.MeasurementWriter(cfg.WriteStrategy)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// records of many messages are written at once, offsets are stored once they are
+	buffer := sensorlogic.NewMeasurementBuffer(writer, sensorlogic.MeasurementBufferConfig{
+		MaxRecords: sensorlogic.DefaultFlushRecords,
+		MaxAge:     sensorlogic.DefaultFlushAge,
+		OnFlush:    observeFlush,
+		OnDrop:     observeDrop,
+	})
+	go buffer.Run(ctx)
+
+	// every instance keeps its own cache, so each one gets its own queue of registry events
+	hostname, err := os.Hostname()
+	if err != nil {
+		fmt.Printf("could not get hostname: %v\n", err)
+		return
+	}
+	cacheQueue := routing.SensorCacheQueue(hostname)
+	err = pubsub.Subscribe(
+		ctx,
+		conn,
+		routing.ExchangeTopicIoT,
+		cacheQueue,
+		routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryEventCreated),
+		pubsub.QueueTranscient,
+		pubsub.QueueClassic,
+		handlerSensorRegistryEvent(sensorCache, buffer),
+		pubsub.WithBindingKeys(
+			routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryEventUpdated),
+			routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryEventDeleted),
+		),
+		pubsub.WithMiddleware(
+			pubsub.Metrics[amqp.Delivery](cacheQueue),
+			pubsub.Logging[amqp.Delivery](logger, cacheQueue),
+			pubsub.Recover[amqp.Delivery](cacheQueue),
+		),
+	)
+	if err != nil {
+		fmt.Printf("could not subscribe to registry events: %v\n", err)
+		return
+	}
+
+	// every instance subscribes to all the partitions, the broker keeps one of them active per
+	// partition and promotes another one when it goes away
+	singleActiveConsumerUpdate := func(partition string, isActive bool) stream.OffsetSpecification {
+		fmt.Printf("[%s] - Consumer promoted for: %s. Active status: %t\n", time.Now().Format(time.TimeOnly), partition, isActive)
+		offset, err := env.QueryOffset(routing.StreamConsumerName, partition)
 		if err != nil {
 			// If the offset is not found, we start from the beginning
 			return stream.OffsetSpecification{}.First()
@@ -55,27 +197,81 @@ func main() {
 		return stream.OffsetSpecification{}.Offset(offset + 1)
 	}
 
-	consumer, err := pubsub.SubscribeStreamJSON(
+	consumer, err := pubsub.SubscribeSuperStreamDeferred(
+		ctx,
 		env,
-		routing.QueueSensorMeasurements,
-		stream.NewConsumerOptions().
+		routing.SuperStreamSensorMeasurements,
+		stream.NewSuperStreamConsumerOptions().
 			SetOffset(stream.OffsetSpecification{}.First()).
 			SetConsumerName(routing.StreamConsumerName).
+			SetManualCommit(). // offsets are stored once measurements are in the database
 			SetSingleActiveConsumer(stream.NewSingleActiveConsumer(singleActiveConsumerUpdate)),
-		// handlerMeasurements(ctx, db),
-		handlerMeasurementsWithCache(ctx, sensorCache, db),
+		// handlerMeasurements(handlerCtx, db) and handlerMeasurementsWithCache(handlerCtx,
+		// sensorCache, db), with handlerCtx := context.WithoutCancel(ctx), write each message on
+		// its own, with SubscribeSuperStreamDecoder
+		pubsub.Chain(
+			handlerMeasurementsBuffered(ctx, sensorCache, db, buffer),
+			pubsub.Metrics[pubsub.StreamDelivery[measurementsPayload]](routing.SuperStreamSensorMeasurements),
+			pubsub.Logging[pubsub.StreamDelivery[measurementsPayload]](logger, routing.SuperStreamSensorMeasurements),
+			pubsub.Recover[pubsub.StreamDelivery[measurementsPayload]](routing.SuperStreamSensorMeasurements),
+			// a batch is marked once buffered, the buffer writes it even if its offset is read
+			// again; a replay after a restart still relies on ON CONFLICT DO NOTHING
+			pubsub.Dedup(
+				routing.SuperStreamSensorMeasurements,
+				pubsub.NewMemoryDedupStore(pubsub.DefaultDedupCapacity, pubsub.DefaultDedupTTL),
+				func(d pubsub.StreamDelivery[measurementsPayload]) string { return d.Body.MessageID() },
+			),
+		),
+		decodeMeasurements,
 	)
 	if err != nil {
-		fmt.Println("error un subscribe stream json")
+		fmt.Printf("error subscribing to super stream: %v\n", err)
+		return
 	}
-	defer consumer.Close()
 
 	// metrics endpoint for 'Instrumenting a Go application for Prometheus'
 	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":2112", nil)
+	metricsServer := &http.Server{Addr: ":2112", ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("metrics server failed: %v\n", err)
+		}
+	}()
 
 	// Graceful shutdown handling
 	fmt.Println("Waiting for messages. Press Ctrl+C to exit.")
 	<-ctx.Done()
+	fmt.Println("Shutting down gracefully...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// registry events being applied are acknowledged before the connection goes away
+	err = conn.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not drain consumers: %v\n", err)
+	}
+
+	// flush while the consumers are still there to store the offsets, whatever is read after
+	// is left uncommitted and read again on the next start
+	err = buffer.Flush(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not flush buffered measurements: %v\n", err)
+	}
+	err = consumer.Close()
+	if err != nil {
+		fmt.Printf("could not close super stream consumer: %v\n", err)
+	}
+
+	err = metricsServer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not shut down metrics server: %v\n", err)
+	}
+	err = tracer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not export remaining spans: %v\n", err)
+	}
+
 	fmt.Println("Shutdown complete.")
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/sensorlogic"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -20,7 +24,7 @@ var (
 			Name: "sensor_measurements_processed_total",
 			Help: "Total number of sensor measurements processed",
 		},
-		[]string{"status", "sensor_serial"}, // status: success/error, sensor_serial: sensor identifier
+		[]string{"status", "sensor_serial"}, // status: success/error/pending, sensor_serial: sensor identifier
 	)
 
 	// metricsBatchSize tracks the distribution of batch sizes
@@ -50,4 +54,96 @@ var (
 		},
 		[]string{"sensor_serial"},
 	)
+
+	// metricsFlushSize tracks how many measurements the write-behind buffer writes at once
+	metricsFlushSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sensor_measurements_flush_size",
+			Help:    "Number of measurements in each write of the buffer",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 20), // 1, 2, 4, 8, ... up to ~1M
+		},
+	)
+
+	// metricsFlushDuration tracks the time of each write attempt of the buffer by status
+	metricsFlushDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sensor_measurements_flush_duration_seconds",
+			Help:    "Time taken to write the buffered measurements to the database",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15), // 1ms to ~16s
+		},
+		[]string{"status"}, // status: success/error
+	)
+
+	// metricsMeasurementsDropped counts buffered measurements given up on because the database
+	// rejected them for good
+	metricsMeasurementsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sensor_measurements_dropped_total",
+			Help: "Total buffered measurements dropped after the database rejected them",
+		},
+	)
+
+	// metricsCacheEvents counts registry events applied to the sensor cache by type
+	metricsCacheEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sensor_cache_events_total",
+			Help: "Total registry events applied to the sensor cache",
+		},
+		[]string{"type"}, // type: created/updated/deleted
+	)
 )
+
+// registerCacheMetrics exposes the sensor cache counters, read at scrape time.
+func registerCacheMetrics(cache *sensorlogic.SensorCache) {
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "sensor_cache_hits_total",
+			Help: "Sensor lookups answered by the cache",
+		},
+		func() float64 { return float64(cache.Stats().Hits) },
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "sensor_cache_misses_total",
+			Help: "Sensor lookups that went to the database",
+		},
+		func() float64 { return float64(cache.Stats().Misses) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "sensor_cache_size",
+			Help: "Number of sensors in the cache",
+		},
+		func() float64 { return float64(cache.Stats().Size) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "sensor_cache_staleness_seconds",
+			Help: "Time since the cache last changed, by a registry event or a full refresh",
+		},
+		func() float64 {
+			stats := cache.Stats()
+			return time.Since(latest(stats.LastRefresh, stats.LastEvent)).Seconds()
+		},
+	)
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func observeFlush(records int, took time.Duration, err error) {
+	if err != nil {
+		metricsFlushDuration.WithLabelValues("error").Observe(took.Seconds())
+		return
+	}
+	metricsFlushSize.Observe(float64(records))
+	metricsFlushDuration.WithLabelValues("success").Observe(took.Seconds())
+}
+
+func observeDrop(records int, err error) {
+	metricsMeasurementsDropped.Add(float64(records))
+}
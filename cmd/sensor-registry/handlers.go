@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
 
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/sensorlogic"
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
 )
 
-func handlerSensorRegistry(ctx context.Context, db *storage.DB) func(dto routing.Sensor) pubsub.AckType {
-	return func(dto routing.Sensor) pubsub.AckType {
+func handlerSensorRegistry(conn *pubsub.Connection, db *storage.DB) func(ctx context.Context, dto routing.Sensor) pubsub.AckType {
+	return func(ctx context.Context, dto routing.Sensor) pubsub.AckType {
 		// placeholder
 		fmt.Println("==========================================")
 
@@ -20,12 +24,71 @@ func handlerSensorRegistry(ctx context.Context, db *storage.DB) func(dto routing
 			SampleFrequency: dto.SampleFrequency,
 		}
 
-		err := db.WriteSensor(ctx, record)
+		record, change, err := db.RegisterSensor(ctx, record)
 		if err != nil {
 			fmt.Printf("error writing sensor instance: %v\n", err)
 			return pubsub.NackRequeue
 		}
 
+		switch change {
+		case storage.SensorCreated:
+			publishRegistryEvent(ctx, conn, routing.RegistryEventCreated, record)
+		case storage.SensorUpdated:
+			publishRegistryEvent(ctx, conn, routing.RegistryEventUpdated, record)
+		}
+
+		// measurements the sensor sent before registering were held by the measurements ingester,
+		// it also sweeps them periodically so a failure here only delays them
+		err = sensorlogic.ReplayPendingMeasurements(ctx, db)
+		if err != nil {
+			fmt.Printf("error replaying measurements of sensor %s: %v\n", dto.SerialNumber, err)
+		}
+
+		return pubsub.Ack
+	}
+}
+
+func handlerSensorDeregistry(conn *pubsub.Connection, db *storage.DB) func(ctx context.Context, dto routing.Sensor) pubsub.AckType {
+	return func(ctx context.Context, dto routing.Sensor) pubsub.AckType {
+		record, found, err := db.DeregisterSensor(ctx, dto.SerialNumber)
+		if err != nil {
+			fmt.Printf("error deleting sensor instance: %v\n", err)
+			return pubsub.NackRequeue
+		}
+
+		if found {
+			publishRegistryEvent(ctx, conn, routing.RegistryEventDeleted, record)
+		}
 		return pubsub.Ack
 	}
 }
+
+// publishRegistryEvent tells the other services about a change the registry committed. The
+// change is not rolled back if the event cannot be published, the caches pick it up on
+// their next full refresh instead.
+func publishRegistryEvent(ctx context.Context, conn *pubsub.Connection, eventType string, record storage.SensorRecord) {
+	key, err := routing.SensorRegistryKey(record.SerialNumber, eventType)
+	if err != nil {
+		fmt.Printf("could not publish %s event of sensor %s: %v\n", eventType, record.SerialNumber, err)
+		return
+	}
+
+	err = conn.WithChannel(func(ch *amqp.Channel) error {
+		return pubsub.PublishGob(
+			ctx,
+			ch,                       // channel
+			routing.ExchangeTopicIoT, // exchange
+			key,                      // routing key
+			routing.SensorRegistryEvent{
+				Type:            eventType,
+				SensorID:        record.ID,
+				SerialNumber:    record.SerialNumber,
+				SampleFrequency: record.SampleFrequency,
+				OccurredAt:      time.Now(),
+			},
+		)
+	})
+	if err != nil {
+		fmt.Printf("could not publish %s event of sensor %s: %v\n", eventType, record.SerialNumber, err)
+	}
+}
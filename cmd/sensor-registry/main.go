@@ -2,31 +2,115 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/iferdel/sensor-data-streaming-server/internal/topology"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// shutdownTimeout bounds the graceful shutdown, within the 10s docker waits before killing
+const shutdownTimeout = 8 * time.Second
+
+// registryHandlerTimeout bounds a registry write, they are upserts so running one twice is fine
+const registryHandlerTimeout = 30 * time.Second
+
+// dedup stores, see dedupStore
+const (
+	dedupStoreMemory   = "memory"
+	dedupStorePostgres = "postgres"
+)
+
+type serviceConfig struct {
+	RabbitMQ   config.RabbitMQ `json:"rabbitmq"`
+	Postgres   config.Postgres `json:"postgres"`
+	Tracing    tracing.Config  `json:"tracing"`
+	DedupStore string          `json:"dedup_store" env:"DEDUP_STORE" flag:"dedup-store" default:"memory" help:"where handled message ids are kept, memory or postgres"`
+}
+
+func (c *serviceConfig) Validate() error {
+	switch c.DedupStore {
+	case dedupStoreMemory, dedupStorePostgres:
+		return nil
+	default:
+		return fmt.Errorf("dedup_store must be %s or %s, got %q", dedupStoreMemory, dedupStorePostgres, c.DedupStore)
+	}
+}
+
+// registryMiddleware is what both registry subscriptions are wrapped with.
+func registryMiddleware(logger *slog.Logger, queue string, dedup pubsub.DedupStore) pubsub.SubscribeOption {
+	return pubsub.WithMiddleware(
+		pubsub.Metrics[amqp.Delivery](queue),
+		pubsub.Logging[amqp.Delivery](logger, queue),
+		pubsub.Recover[amqp.Delivery](queue),
+		pubsub.Dedup(queue, dedup, pubsub.DeliveryMessageID),
+		pubsub.Timeout[amqp.Delivery](queue, registryHandlerTimeout),
+	)
+}
+
+// dedupStore remembers the handled messages of a queue in memory, or in the database with
+// the postgres store so that redeliveries after a restart are dropped as well.
+func dedupStore(kind string, db *storage.DB, queue string) pubsub.DedupStore {
+	if kind == dedupStorePostgres {
+		return db.DedupStore(queue, pubsub.DefaultDedupTTL)
+	}
+	return pubsub.NewMemoryDedupStore(pubsub.DefaultDedupCapacity, pubsub.DefaultDedupTTL)
+}
+
+// purgeProcessedMessages keeps processed_message down to the dedup window.
+func purgeProcessedMessages(ctx context.Context, db *storage.DB) {
+	ticker := time.NewTicker(pubsub.DefaultDedupTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := db.PurgeProcessedMessages(ctx, pubsub.DefaultDedupTTL)
+			if err != nil {
+				fmt.Printf("could not purge processed messages: %v\n", err)
+				continue
+			}
+			fmt.Printf("Purged %d processed messages\n", purged)
+		}
+	}
+}
+
 type apiConfig struct {
-	rabbitConn *amqp.Connection
+	rabbitConn *pubsub.Connection
 	db         *storage.DB
 }
 
-func NewApiConfig() (*apiConfig, error) {
-	conn, err := amqp.Dial(routing.RabbitConnString)
+func NewApiConfig(cfg serviceConfig) (*apiConfig, error) {
+	conn, err := pubsub.Dial(cfg.RabbitMQ.URL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
-	db, err := storage.NewDBPool(storage.PostgresConnString)
+	// exchanges and queues the service relies on, declared again after every reconnect
+	err = pubsub.DeclareTopology(conn, topology.Topology())
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare topology: %w", err)
+	}
+
+	db, err := storage.NewDBPool(cfg.Postgres.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
+	}
 
 	return &apiConfig{
 		rabbitConn: conn,
@@ -35,33 +119,83 @@ func NewApiConfig() (*apiConfig, error) {
 }
 
 func main() {
+	cfg := config.MustLoad[serviceConfig]("sensor-registry")
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	apiCfg, err := NewApiConfig()
+	pubsub.Producer = "sensor-registry"
+	tracer, err := tracing.Init("sensor-registry", cfg.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	apiCfg, err := NewApiConfig(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer apiCfg.rabbitConn.Close()
 	defer apiCfg.db.Close()
 
-	// consume sensor registration
-	err = pubsub.SubscribeGob(
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	if cfg.DedupStore == dedupStorePostgres {
+		go purgeProcessedMessages(ctx, apiCfg.db)
+	}
+
+	// consume sensor registration, handlers finish what they started while shutting down and
+	// publish their events under the span of the request
+	err = pubsub.SubscribeContext(
 		ctx,
 		apiCfg.rabbitConn,
 		routing.ExchangeTopicIoT,
 		routing.QueueSensorRegistry,
-		fmt.Sprintf(routing.KeySensorRegistryFormat, "*")+"."+"#", // subscribeGob creates and bind a queue to an exchange in case it is not yet there. Thats why here we have binding key (and not just queue name)
+		routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryRequestRegister), // subscribeGob creates and bind a queue to an exchange in case it is not yet there. Thats why here we have binding key (and not just queue name)
 		pubsub.QueueDurable,
 		pubsub.QueueClassic,
-		handlerSensorRegistry(ctx, apiCfg.db), // consumption
+		handlerSensorRegistry(apiCfg.rabbitConn, apiCfg.db), // consumption
+		pubsub.WithDeadLetter(pubsub.DeadLetterConfig{
+			Exchange: routing.ExchangeTopicDeadLetter,
+		}),
+		pubsub.WithRetryPolicy(pubsub.DefaultRetryPolicy),
+		registryMiddleware(logger, routing.QueueSensorRegistry, dedupStore(cfg.DedupStore, apiCfg.db, routing.QueueSensorRegistry)),
 	)
 	if err != nil {
 		fmt.Println("Could not subscribe to registry:", err)
 		return
 	}
 
+	// consume sensor deregistration
+	err = pubsub.SubscribeContext(
+		ctx,
+		apiCfg.rabbitConn,
+		routing.ExchangeTopicIoT,
+		routing.QueueSensorDeregistry,
+		routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryRequestDeregister),
+		pubsub.QueueDurable,
+		pubsub.QueueClassic,
+		handlerSensorDeregistry(apiCfg.rabbitConn, apiCfg.db),
+		pubsub.WithDeadLetter(pubsub.DeadLetterConfig{
+			Exchange: routing.ExchangeTopicDeadLetter,
+		}),
+		pubsub.WithRetryPolicy(pubsub.DefaultRetryPolicy),
+		registryMiddleware(logger, routing.QueueSensorDeregistry, dedupStore(cfg.DedupStore, apiCfg.db, routing.QueueSensorDeregistry)),
+	)
+	if err != nil {
+		fmt.Println("Could not subscribe to deregistry:", err)
+		return
+	}
+
+	// metrics endpoint for 'Instrumenting a Go application for Prometheus'
+	http.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{Addr: ":2112", ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("metrics server failed: %v\n", err)
+		}
+	}()
+
 	// publish trigger for sensor to start telemetry
 	// the broker can confirm the producer that the msg was received
 
@@ -69,4 +203,21 @@ func main() {
 	fmt.Println("Waiting for messages. Press Ctrl+C to exit.")
 	<-ctx.Done()
 	fmt.Println("Shutting down gracefully.")
+
+	// in-flight deliveries are handled and acknowledged before the connection goes away
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = apiCfg.rabbitConn.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not drain consumers: %v\n", err)
+	}
+	err = metricsServer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not shut down metrics server: %v\n", err)
+	}
+	err = tracer.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not export remaining spans: %v\n", err)
+	}
+	fmt.Println("Shutdown complete.")
 }
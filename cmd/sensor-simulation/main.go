@@ -7,26 +7,55 @@ package main
 // The server either returns the message when the flag is set to "true"
 // or silently drops the message when set to "false".
 // RabbitMQ let you define an alternate exchange to apply logic to unroutable messages.
+// The iot exchange has iot.unroutable as its alternate exchange, see topology.Topology.
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iferdel/sensor-data-streaming-server/internal/config"
 	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
 	"github.com/iferdel/sensor-data-streaming-server/internal/sensorlogic"
+	"github.com/iferdel/sensor-data-streaming-server/internal/topology"
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/validation"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+type serviceConfig struct {
+	RabbitMQ        config.RabbitMQ `json:"rabbitmq"`
+	MQTT            config.MQTT     `json:"mqtt"`
+	Tracing         tracing.Config  `json:"tracing"`
+	SerialNumber    string          `json:"serial_number" env:"SENSOR_SERIAL_NUMBER" flag:"serial-number" required:"true" help:"serial number of the simulated sensor"`
+	SampleFrequency float64         `json:"sample_frequency" env:"SENSOR_SAMPLE_FREQUENCY" flag:"sample-frequency" required:"true" help:"sample frequency in Hz"`
+	PayloadFormat   string          `json:"payload_format" env:"SENSOR_PAYLOAD_FORMAT" flag:"payload-format" default:"compact" help:"measurements payload, compact, protobuf or json"`
+}
+
+func (c *serviceConfig) Validate() error {
+	if !validation.HasValidCharacters(c.SerialNumber) {
+		return fmt.Errorf("non valid serial number: %s", c.SerialNumber)
+	}
+	if c.SampleFrequency <= 0 {
+		return fmt.Errorf("non valid sample frequency: %v", c.SampleFrequency)
+	}
+	switch c.PayloadFormat {
+	case payloadFormatCompact, payloadFormatProtobuf, payloadFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("non valid payload format: %s", c.PayloadFormat)
+	}
+}
+
 type Config struct {
-	rabbitConn *amqp.Connection
+	rabbitConn *pubsub.Connection
 	mqttClient mqtt.Client
 }
 
@@ -42,15 +71,21 @@ func MQTTCreateClientOptions(clientId, raw string) *mqtt.ClientOptions {
 	return opts
 }
 
-func NewConfig(clientID string) (*Config, error) {
+func NewConfig(cfg serviceConfig) (*Config, error) {
 	// amqp
-	conn, err := amqp.Dial(routing.RabbitConnString)
+	conn, err := pubsub.Dial(cfg.RabbitMQ.URL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
-	// mqtt
-	mqttOpts := MQTTCreateClientOptions(clientID, routing.RabbitMQTTConnString)
+	// exchanges and queues the service relies on, declared again after every reconnect
+	err = pubsub.DeclareTopology(conn, topology.Topology())
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare topology: %w", err)
+	}
+
+	// mqtt, the serial number is the client id, see docs/issue-mqtt-client-id.md
+	mqttOpts := MQTTCreateClientOptions(cfg.SerialNumber, cfg.MQTT.URL)
 	mqttClient := mqtt.NewClient(mqttOpts)
 	token := mqttClient.Connect()
 	token.Wait()
@@ -64,21 +99,22 @@ func NewConfig(clientID string) (*Config, error) {
 	}, nil
 }
 
+// shutdownTimeout bounds the graceful shutdown, within the 10s docker waits before killing
+const shutdownTimeout = 8 * time.Second
+
 func main() {
+	sensorCfg := config.MustLoad[serviceConfig]("sensor-simulation")
 
-	// environment variables
-	serialNumber := os.Getenv("SENSOR_SERIAL_NUMBER")
-	if serialNumber == "" {
-		log.Fatal("non valid serial number: it is empty")
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	sampleFrequencyStr := os.Getenv("SENSOR_SAMPLE_FREQUENCY")
-	sampleFrequency, err := strconv.ParseFloat(sampleFrequencyStr, 64)
+	pubsub.Producer = "sensor-simulation"
+	tracer, err := tracing.Init("sensor-simulation", sensorCfg.Tracing)
 	if err != nil {
-		log.Fatal("non valid sample frequency: it is empty")
+		log.Fatal(err)
 	}
 
-	cfg, err := NewConfig(serialNumber)
+	cfg, err := NewConfig(sensorCfg)
 	if err != nil {
 		log.Fatalf("Could not create rabbitMQ connection: %v", err)
 	}
@@ -86,40 +122,48 @@ func main() {
 	defer cfg.rabbitConn.Close()
 	defer cfg.mqttClient.Disconnect(200 * uint(time.Millisecond))
 
-	cfg.sensorOperation(serialNumber, sampleFrequency)
-}
-
-func (cfg *Config) sensorOperation(serialNumber string, sampleFrequency float64) {
+	cfg.sensorOperation(ctx, sensorCfg.SerialNumber, sensorCfg.SampleFrequency, sensorCfg.PayloadFormat)
 
-	sensorState := sensorlogic.NewSensorState(serialNumber, sampleFrequency)
-	// publish logic
-	publishCh, err := cfg.rabbitConn.Channel()
-	// this should be written to /var/log as a log that is in the sensor (and not published)
+	// a command being applied is acknowledged before the connection goes away, the deferred
+	// MQTT disconnect waits for the last measurements to be sent
+	fmt.Println("Shutting down gracefully...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = cfg.rabbitConn.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Printf("could not drain consumers: %v\n", err)
+	}
+	err = tracer.Shutdown(shutdownCtx)
 	if err != nil {
-		log.Fatalf("Could not create publish channel: %v", err)
+		fmt.Printf("could not export remaining spans: %v\n", err)
 	}
-	fmt.Println("Publisher channel created")
+}
+
+// sensorOperation boots the sensor and measures until ctx is done.
+func (cfg *Config) sensorOperation(ctx context.Context, serialNumber string, sampleFrequency float64, payloadFormat string) {
 
+	sensorState := sensorlogic.NewSensorState(serialNumber, sampleFrequency)
+	// publish logic goes through the pooled channels of the connection, which outlive a broker restart
 	// goroutine for sensor logs publish
 	go func() {
 		for {
 			select {
 			case infoMsg := <-sensorState.LogsInfo:
-				publishSensorLog(publishCh, routing.SensorLog{
+				publishSensorLog(cfg.rabbitConn, routing.SensorLog{
 					SerialNumber: serialNumber,
 					Timestamp:    time.Now(),
 					Level:        "INFO",
 					Message:      infoMsg,
 				})
 			case warningMsg := <-sensorState.LogsWarning:
-				publishSensorLog(publishCh, routing.SensorLog{
+				publishSensorLog(cfg.rabbitConn, routing.SensorLog{
 					SerialNumber: serialNumber,
 					Timestamp:    time.Now(),
 					Level:        "WARNING",
 					Message:      warningMsg,
 				})
 			case errMsg := <-sensorState.LogsError:
-				publishSensorLog(publishCh, routing.SensorLog{
+				publishSensorLog(cfg.rabbitConn, routing.SensorLog{
 					SerialNumber: serialNumber,
 					Timestamp:    time.Now(),
 					Level:        "ERROR",
@@ -141,30 +185,60 @@ func (cfg *Config) sensorOperation(serialNumber string, sampleFrequency float64)
 	sensorState.LogsInfo <- "Self-test result: PASSED"
 	time.Sleep(100 * time.Millisecond)
 
+	// the serial number is checked on start up, building the keys only fails on a programming error
+	registryKey, err := routing.SensorRegistryKey(serialNumber, routing.RegistryRequestRegister)
+	if err != nil {
+		sensorState.LogsError <- fmt.Sprintf("Could not build registry key: %v\n", err)
+		return
+	}
+	commandsQueue, err := routing.SensorCommandsQueue(serialNumber)
+	if err != nil {
+		sensorState.LogsError <- fmt.Sprintf("Could not build command queue name: %v\n", err)
+		return
+	}
+	commandsBinding, err := routing.Binding(serialNumber, routing.ChannelCommands, routing.AnyAction)
+	if err != nil {
+		sensorState.LogsError <- fmt.Sprintf("Could not build command binding key: %v\n", err)
+		return
+	}
+	measurementsKey, err := routing.SensorMeasurementsKey(serialNumber)
+	if err != nil {
+		sensorState.LogsError <- fmt.Sprintf("Could not build measurements key: %v\n", err)
+		return
+	}
+
 	// publish sensor for registration if not already
 	sensorState.LogsInfo <- "Sensor Auth..."
-	pubsub.PublishGob(
-		context.Background(),
-		publishCh,                // channel
-		routing.ExchangeTopicIoT, // exchange
-		fmt.Sprintf(routing.KeySensorRegistryFormat, serialNumber)+"."+"created", // routing key
-		routing.Sensor{
-			SerialNumber:    serialNumber,
-			SampleFrequency: sampleFrequency,
-		}, // based on Data Transfer Object
-	)
+	cfg.rabbitConn.WithChannel(func(publishCh *amqp.Channel) error {
+		return pubsub.PublishGob(
+			context.Background(),
+			publishCh,                // channel
+			routing.ExchangeTopicIoT, // exchange
+			registryKey,              // routing key
+			routing.Sensor{
+				SerialNumber:    serialNumber,
+				SampleFrequency: sampleFrequency,
+			}, // based on Data Transfer Object
+		)
+	})
 	// TODO: get back acknowledgment of publish sensor
 
 	// subscribe to sensor command queue
-	err = pubsub.SubscribeGob(
-		context.Background(),
+	err = pubsub.Subscribe(
+		ctx,
 		cfg.rabbitConn,
 		routing.ExchangeTopicIoT, // exchange
-		fmt.Sprintf(routing.QueueSensorCommandsFormat, serialNumber),       // queue name
-		fmt.Sprintf(routing.KeySensorCommandsFormat, serialNumber)+"."+"#", // binding key
-		pubsub.QueueDurable, // queue duration
-		pubsub.QueueClassic, // queue type
-		handlerCommand(sensorState),
+		commandsQueue,            // queue name
+		commandsBinding,          // binding key
+		pubsub.QueueDurable,      // queue duration
+		pubsub.QueueClassic,      // queue type
+		pubsub.Chain(
+			handlerCommand(sensorState),
+			pubsub.Recover[routing.SensorCommandMessage](commandsQueue),
+		),
+		pubsub.WithDeadLetter(pubsub.DeadLetterConfig{
+			Exchange: routing.ExchangeTopicDeadLetter,
+		}),
 	)
 	if err != nil {
 		sensorState.LogsError <- fmt.Sprintf("Could not subscribe to command queue: %v\n", err)
@@ -177,9 +251,25 @@ func (cfg *Config) sensorOperation(serialNumber string, sampleFrequency float64)
 	sensorState.LogsInfo <- "Booting completed, performing measurements..."
 
 	// ticker determines how often measurements are read from the original wave (sample rate)
-	// so it applies the anti-aliasing (at least two times the signal's maximum frequency)
-	ticker := time.NewTicker(time.Second / time.Duration(sensorState.SampleFrequency))
-	defer ticker.Stop() // stop Ticker on return so no more ticks will be sent and thus freeing resources
+	// so it applies the anti-aliasing (at least two times the signal's maximum frequency).
+	// Compact batches are sampled on publish and go without one, sampleTicks staying nil so
+	// the select never wakes up for it
+	var ticker *time.Ticker
+	var sampleTicks <-chan time.Time
+	startSampling := func(sampleFrequency float64) {
+		if payloadFormat == payloadFormatCompact {
+			return
+		}
+		ticker = time.NewTicker(time.Second / time.Duration(sampleFrequency))
+		sampleTicks = ticker.C
+	}
+	stopSampling := func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}
+	startSampling(sensorState.SampleFrequency)
+	defer stopSampling() // stop Ticker on return so no more ticks will be sent and thus freeing resources
 
 	// batchTimer is the ticker that will trigger the publish of the packet of data
 	batchTime := time.Second * 1
@@ -198,9 +288,74 @@ func (cfg *Config) sensorOperation(serialNumber string, sampleFrequency float64)
 	startTime := time.Now()
 	var measurements []routing.SensorMeasurement
 
+	// compact batches are sampled at their nominal instants when published, windowStart is
+	// where the next batch begins and currentFrequency the rate it is sampled at
+	windowStart := startTime
+	currentFrequency := sensorState.SampleFrequency
+
+	// every batch starts a trace, its traceparent travels in the batch envelope since MQTT 3.1.1
+	// has no properties to carry it
+	startPublishSpan := func() *tracing.Span {
+		_, span := tracing.Start(ctx, "publish measurements", tracing.SpanKindProducer)
+		span.SetAttribute("sensor.serial_number", serialNumber)
+		span.SetAttribute("sensor.payload_format", payloadFormat)
+		return span
+	}
+
+	publishMeasurements := func(span *tracing.Span, payloadBytes []byte) {
+		defer span.End()
+		pubToken := cfg.mqttClient.Publish(
+			measurementsKey,
+			1,
+			true,
+			payloadBytes,
+		)
+		pubToken.Wait()
+		if pubToken.Error() != nil {
+			span.SetError(pubToken.Error())
+			log.Printf("Publish error: %v", pubToken.Error())
+		}
+	}
+
+	publishWindow := func(now time.Time) {
+		var batch routing.SensorMeasurementBatch
+		batch, windowStart = sampleWindow(serialNumber, sineWaves, startTime, windowStart, now, currentFrequency)
+		if len(batch.Values) == 0 {
+			return // nothing to send...
+		}
+		span := startPublishSpan()
+		batch.TraceParent = span.TraceParent()
+		batch.MessageID = pubsub.NewMessageID()
+		payloadBytes, err := pubsub.ProtobufCodec{}.Marshal(routing.SensorMeasurementBatchToProto(batch, true))
+		if err != nil {
+			span.SetError(err)
+			span.End()
+			log.Printf("Failed to marshal measurements: %v", err)
+			return
+		}
+		publishMeasurements(span, payloadBytes)
+	}
+
 	for {
 		select {
-		case <-ticker.C:
+		case <-ctx.Done():
+			// what was sampled since the last batch is not lost
+			if payloadFormat == payloadFormatCompact {
+				publishWindow(time.Now())
+			} else if len(measurements) > 0 {
+				span := startPublishSpan()
+				payloadBytes, err := marshalMeasurements(payloadFormat, serialNumber, measurements, span.TraceParent())
+				if err != nil {
+					span.SetError(err)
+					span.End()
+					log.Printf("Failed to marshal measurements: %v", err)
+					return
+				}
+				publishMeasurements(span, payloadBytes)
+			}
+			return
+
+		case <-sampleTicks:
 			accX, timestamp := func() (float64, time.Duration) {
 				timestamp := time.Since(startTime)
 				elapsedSec := timestamp.Seconds()
@@ -218,52 +373,98 @@ func (cfg *Config) sensorOperation(serialNumber string, sampleFrequency float64)
 			})
 
 		case <-batchTimer.C:
+			if payloadFormat == payloadFormatCompact {
+				publishWindow(time.Now())
+				continue
+			}
 
 			if len(measurements) == 0 {
 				continue // nothing to send...
 			}
-			payloadBytes, err := json.Marshal(
-				measurements,
-			)
+			span := startPublishSpan()
+			payloadBytes, err := marshalMeasurements(payloadFormat, serialNumber, measurements, span.TraceParent())
 			if err != nil {
+				span.SetError(err)
+				span.End()
 				log.Printf("Failed to marshal measurements: %v", err)
 				return
 			}
-			pubToken := cfg.mqttClient.Publish(
-				fmt.Sprintf(routing.KeySensorMeasurements, serialNumber),
-				1,
-				true,
-				payloadBytes,
-			)
-			pubToken.Wait()
-			if pubToken.Error() != nil {
-				log.Printf("Publish error: %v", pubToken.Error())
-			}
+			publishMeasurements(span, payloadBytes)
 
 			measurements = measurements[:0]
 
 		case isSleep := <-sensorState.IsSleepChan:
 			if isSleep {
-				ticker.Stop()
+				stopSampling()
 				batchTimer.Stop()
+				if payloadFormat == payloadFormatCompact {
+					publishWindow(time.Now())
+				}
 			} else {
-				ticker = time.NewTicker(time.Second / time.Duration(sensorState.SampleFrequency))
+				windowStart = time.Now()
+				startSampling(sensorState.SampleFrequency)
 				batchTimer = time.NewTicker(batchTime)
 			}
 
 		case newFreq := <-sensorState.SampleFrequencyChangeChan:
-			ticker.Stop()
-			ticker = time.NewTicker(time.Second / time.Duration(newFreq))
+			if payloadFormat == payloadFormatCompact {
+				publishWindow(time.Now()) // what was sampled at the old rate
+			}
+			currentFrequency = newFreq
+			stopSampling()
+			startSampling(newFreq)
 		}
 	}
 }
 
-func publishSensorLog(publishCh *amqp.Channel, sensorLog routing.SensorLog) error {
-	return pubsub.PublishGob(
-		context.Background(),
-		publishCh,                // channel
-		routing.ExchangeTopicIoT, // exchange
-		fmt.Sprintf(routing.KeySensorLogsFormat, sensorLog.SerialNumber), // routing key
-		sensorLog, // sensor log
-	)
+const (
+	payloadFormatCompact  = "compact"  // columnar protobuf batch with gorilla compressed values
+	payloadFormatProtobuf = "protobuf" // protobuf batch with a timestamp per sample
+	payloadFormatJSON     = "json"     // json array of measurements, what the ingester has always understood
+)
+
+// marshalMeasurements encodes per-sample measurements, only protobuf batches have an envelope
+// to carry the traceparent and a message id in.
+func marshalMeasurements(payloadFormat, serialNumber string, measurements []routing.SensorMeasurement, traceParent string) ([]byte, error) {
+	if payloadFormat == payloadFormatProtobuf {
+		batch := routing.NewMeasurementBatch(serialNumber, measurements)
+		batch.TraceParent = traceParent
+		batch.MessageId = pubsub.NewMessageID()
+		return pubsub.ProtobufCodec{}.Marshal(batch)
+	}
+	return pubsub.JSONCodec{}.Marshal(measurements)
+}
+
+// sampleWindow samples the signal at every nominal instant of a fixed rate sensor between
+// windowStart and now, returning the batch and where the next window starts.
+func sampleWindow(serialNumber string, sineWaves []sensorlogic.SineWave, startTime, windowStart, now time.Time, sampleFrequency float64) (routing.SensorMeasurementBatch, time.Time) {
+	count := int(now.Sub(windowStart).Seconds() * sampleFrequency)
+	batch := routing.SensorMeasurementBatch{
+		SerialNumber:    serialNumber,
+		StartTime:       windowStart,
+		SampleFrequency: sampleFrequency,
+		Values:          make([]float64, count),
+	}
+	offset := windowStart.Sub(startTime).Seconds()
+	for i := range batch.Values {
+		batch.Values[i] = sensorlogic.SimulateSignal(sineWaves, offset+float64(i)/sampleFrequency)
+	}
+	next := windowStart.Add(time.Duration(float64(count) * float64(time.Second) / sampleFrequency))
+	return batch, next
+}
+
+func publishSensorLog(conn *pubsub.Connection, sensorLog routing.SensorLog) error {
+	key, err := routing.SensorLogsKey(sensorLog.SerialNumber)
+	if err != nil {
+		return err
+	}
+	return conn.WithChannel(func(publishCh *amqp.Channel) error {
+		return pubsub.PublishGob(
+			context.Background(),
+			publishCh,                // channel
+			routing.ExchangeTopicIoT, // exchange
+			key,                      // routing key
+			sensorLog,                // sensor log
+		)
+	})
 }
@@ -37,6 +37,52 @@ CREATE TABLE sensor (
 	);
   COMMENT ON COLUMN sensor.target_id IS 'one target may have more than 1 sensor, but one sensor is only associated with one target. The sensor id gets populated through new sensors entering the system, but the target_id do not autopopulate on sensors turned on, but afterwards though command-line tooling which would make the association from an user to which target is used for which sensor. This is like a step afterwards since after booting and register serial number, the sensor enters into a --wait-- mode until someone enters the target of the sensor and then this triggers the starting point for start the measurements';
 
+CREATE TABLE dead_letter (
+	id BIGSERIAL PRIMARY KEY,
+	received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	reason VARCHAR(20) NOT NULL,
+	source_queue TEXT NOT NULL,
+	routing_key TEXT NOT NULL,
+	serial_number TEXT,
+	content_type TEXT,
+	headers JSONB,
+	payload BYTEA NOT NULL
+	);
+  COMMENT ON TABLE dead_letter IS 'quarantine of messages rejected by the consumers (or past their delivery limit). The payload is kept as published so it can be decoded and replayed later on';
+  CREATE INDEX ON dead_letter (routing_key, received_at DESC);
+  CREATE INDEX ON dead_letter (serial_number, received_at DESC);
+
+CREATE TABLE unroutable_message (
+	id BIGSERIAL PRIMARY KEY,
+	received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	exchange TEXT NOT NULL,
+	routing_key TEXT NOT NULL,
+	serial_number TEXT,
+	content_type TEXT,
+	size_bytes INTEGER NOT NULL
+	);
+  COMMENT ON TABLE unroutable_message IS 'messages published to the iot exchange with a routing key no queue is bound for, collected by its alternate exchange. Only metadata is kept, the point is spotting mis-addressed sensors';
+  CREATE INDEX ON unroutable_message (routing_key, received_at DESC);
+
+CREATE TABLE pending_measurement (
+	serial_number TEXT NOT NULL,
+	time TIMESTAMPTZ NOT NULL,
+	measurement DOUBLE PRECISION NOT NULL,
+	received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (serial_number, time)
+	);
+  COMMENT ON TABLE pending_measurement IS 'measurements of sensors that were not registered yet when they arrived. They are moved to sensor_measurement once the sensor registers, or purged after a day';
+  CREATE INDEX ON pending_measurement (received_at);
+
+CREATE TABLE processed_message (
+	consumer TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (consumer, message_id)
+	);
+  COMMENT ON TABLE processed_message IS 'ids of the messages each consumer handled, so that a redelivery of one is acknowledged without handling it twice. Rows past the dedup window of the consumer are purged';
+  CREATE INDEX ON processed_message (processed_at);
+
 CREATE TABLE sensor_measurement ( 
 	time TIMESTAMPTZ NOT NULL,
 	sensor_id INTEGER NOT NULL,
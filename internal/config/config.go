@@ -0,0 +1,550 @@
+// Package config loads the configuration of the binaries. Every binary describes it as a
+// struct of its own, made of the sections of sections.go and fields of its own, and loads it
+// with Load or MustLoad. A field value comes from, the last one set winning:
+//   - its `default` tag, or the SetDefaults() method of the struct holding it, for defaults
+//     that are constants of other packages
+//   - a JSON file, given with --config or CONFIG_FILE, keyed by the `json` tags
+//   - the environment variable of its `env` tag, or the file <ENV>_FILE points to, which is
+//     how docker and kubernetes secrets are mounted
+//   - the command line flag of its `flag` tag
+//
+// Fields tagged `required:"true"` must end up set, fields tagged `secret:"true"` are redacted
+// when printed with --print-config, and structs with a Validate() error method get it called
+// once everything is loaded. Fields can be strings, bools, ints, floats and time.Duration.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrConfigPrinted is returned by Load once --print-config printed the configuration,
+	// binaries exit right after.
+	ErrConfigPrinted = errors.New("config printed")
+)
+
+const (
+	envConfigFile    = "CONFIG_FILE"
+	secretFileSuffix = "_FILE"
+	redacted         = "REDACTED"
+	flagConfigFile   = "config"
+	flagPrintConfig  = "print-config"
+)
+
+// Set is the configuration of a binary on its way to be loaded. Its flags are parsed along
+// with the ones of the binary, e.g. by cobra, before calling Load.
+type Set[T any] struct {
+	flags       *flag.FlagSet
+	flagValues  map[string]string // flag name -> value, of the flags set on the command line
+	configFile  string
+	printConfig bool
+	out         io.Writer
+}
+
+// NewSet declares the flags of T on a flag set of its own.
+func NewSet[T any](name string) *Set[T] {
+	s := &Set[T]{
+		flags:      flag.NewFlagSet(name, flag.ContinueOnError),
+		flagValues: map[string]string{},
+		out:        os.Stdout,
+	}
+	s.flags.StringVar(&s.configFile, flagConfigFile, "", "JSON config file (env "+envConfigFile+")")
+	s.flags.BoolVar(&s.printConfig, flagPrintConfig, false, "print the configuration, secrets redacted, and exit")
+
+	// the defaults are shown in the usage, Load reports an invalid one
+	var cfg T
+	root := reflect.ValueOf(&cfg).Elem()
+	setDefaults(root)
+	walk(root, "", func(f field) error {
+		name := f.tag.Get("flag")
+		if name == "" {
+			return nil
+		}
+		value := flagValue{values: s.flagValues, name: name, kind: f.kind(), def: f.String()}
+		if value.kind == "bool" {
+			s.flags.Var(boolFlagValue{value}, name, f.usage())
+		} else {
+			s.flags.Var(value, name, f.usage())
+		}
+		return nil
+	})
+	return s
+}
+
+// flagValue keeps the value of a flag aside, to be set on the config once loaded since flags
+// win over everything else.
+type flagValue struct {
+	values map[string]string
+	name   string
+	kind   string
+	def    string
+}
+
+// String is the default, for the flag package to show it in the usage.
+func (v flagValue) String() string {
+	return v.def
+}
+
+func (v flagValue) Set(value string) error {
+	v.values[v.name] = value
+	return nil
+}
+
+// Type names the value in the usage of cobra commands.
+func (v flagValue) Type() string {
+	return v.kind
+}
+
+// boolFlagValue is set without a value, e.g. --flag rather than --flag=true.
+type boolFlagValue struct {
+	flagValue
+}
+
+func (v boolFlagValue) IsBoolFlag() bool {
+	return true
+}
+
+func (s *Set[T]) FlagSet() *flag.FlagSet {
+	return s.flags
+}
+
+// Load builds the configuration out of the defaults, config file, environment and flags
+// parsed so far, and validates it.
+func (s *Set[T]) Load() (T, error) {
+	var cfg T
+	root := reflect.ValueOf(&cfg).Elem()
+
+	err := setDefaults(root)
+	if err != nil {
+		return cfg, err
+	}
+
+	configFile := s.configFile
+	if configFile == "" {
+		configFile = os.Getenv(envConfigFile)
+	}
+	if configFile != "" {
+		err = loadFile(root, configFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	err = walk(root, "", func(f field) error {
+		name := f.tag.Get("env")
+		if name == "" {
+			return nil
+		}
+		value, ok, err := lookupEnv(name)
+		if err != nil || !ok {
+			return err
+		}
+		return f.set(value, "env "+name)
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	err = walk(root, "", func(f field) error {
+		name := f.tag.Get("flag")
+		value, ok := s.flagValues[name]
+		if name == "" || !ok {
+			return nil
+		}
+		return f.set(value, "flag --"+name)
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	err = validate(root)
+	if err != nil {
+		return cfg, err
+	}
+
+	if s.printConfig {
+		err = Print(s.out, cfg)
+		if err != nil {
+			return cfg, err
+		}
+		return cfg, ErrConfigPrinted
+	}
+	return cfg, nil
+}
+
+// Load parses the command line arguments of a binary and loads its configuration.
+func Load[T any](name string, args []string) (T, error) {
+	s := NewSet[T](name)
+	err := s.flags.Parse(args)
+	if err != nil {
+		var cfg T
+		return cfg, err
+	}
+	return s.Load()
+}
+
+// MustLoad is Load of os.Args for a main, exiting once the configuration or usage is printed
+// and on an invalid configuration.
+func MustLoad[T any](name string) T {
+	cfg, err := Load[T](name, os.Args[1:])
+	switch {
+	case errors.Is(err, ErrConfigPrinted), errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// Print writes cfg as a JSON config file would hold it, with secrets redacted.
+func Print(w io.Writer, cfg any) error {
+	out, err := dump(reflect.ValueOf(cfg))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode config: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// lookupEnv reads an environment variable, or the file its _FILE variant points to.
+func lookupEnv(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	path, fromFile := os.LookupEnv(name + secretFileSuffix)
+	if !fromFile || path == "" {
+		return value, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("%w: both %s and %s%s are set", ErrInvalidConfig, name, name, secretFileSuffix)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%w: could not read %s%s: %v", ErrInvalidConfig, name, secretFileSuffix, err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func loadFile(root reflect.Value, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: could not open config file: %v", ErrInvalidConfig, err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber() // numbers are parsed by the field they end up in
+	var values map[string]any
+	err = decoder.Decode(&values)
+	if err != nil {
+		return fmt.Errorf("%w: could not decode config file %s: %v", ErrInvalidConfig, path, err)
+	}
+	return applyFile(root, values, "")
+}
+
+// applyFile sets the fields of v out of an object of the config file, rejecting keys no field
+// is for so that a typo does not go unnoticed.
+func applyFile(v reflect.Value, values map[string]any, prefix string) error {
+	known := map[string]bool{}
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		key := jsonName(sf)
+		known[key] = true
+		value, ok := values[key]
+		if !ok || value == nil {
+			continue
+		}
+
+		if isSection(sf.Type) {
+			object, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%w: %s%s in config file is not an object", ErrInvalidConfig, prefix, key)
+			}
+			err := applyFile(v.Field(i), object, prefix+key+".")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var s string
+		switch value := value.(type) {
+		case string:
+			s = value
+		case json.Number:
+			s = value.String()
+		case bool:
+			s = strconv.FormatBool(value)
+		default:
+			return fmt.Errorf("%w: %s%s in config file is not a string, number or bool", ErrInvalidConfig, prefix, key)
+		}
+		err := field{path: prefix + key, value: v.Field(i), tag: sf.Tag}.set(s, "config file")
+		if err != nil {
+			return err
+		}
+	}
+
+	for key := range values {
+		if !known[key] {
+			return fmt.Errorf("%w: unknown key %s%s in config file", ErrInvalidConfig, prefix, key)
+		}
+	}
+	return nil
+}
+
+type validator interface {
+	Validate() error
+}
+
+type defaulter interface {
+	SetDefaults()
+}
+
+// setDefaults sets the `default` tags, then calls SetDefaults on sections before the structs
+// holding them.
+func setDefaults(v reflect.Value) error {
+	err := walk(v, "", func(f field) error {
+		value, ok := f.tag.Lookup("default")
+		if !ok {
+			return nil
+		}
+		return f.set(value, "default")
+	})
+	if err != nil {
+		return err
+	}
+	callDefaults(v)
+	return nil
+}
+
+func callDefaults(v reflect.Value) {
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if sf.IsExported() && isSection(sf.Type) {
+			callDefaults(v.Field(i))
+		}
+	}
+	if d, ok := v.Addr().Interface().(defaulter); ok {
+		d.SetDefaults()
+	}
+}
+
+// validate checks required fields, then calls Validate on sections before the structs
+// holding them.
+func validate(v reflect.Value) error {
+	err := walk(v, "", func(f field) error {
+		if f.tag.Get("required") == "true" && f.value.IsZero() {
+			return fmt.Errorf("%w: %s is required%s", ErrInvalidConfig, f.path, f.sources())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return validateSections(v, "")
+}
+
+func validateSections(v reflect.Value, path string) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if sf.IsExported() && isSection(sf.Type) {
+			err := validateSections(v.Field(i), path+jsonName(sf)+".")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if val, ok := v.Addr().Interface().(validator); ok {
+		err := val.Validate()
+		if err != nil {
+			return fmt.Errorf("%w: %s%v", ErrInvalidConfig, path, err)
+		}
+	}
+	return nil
+}
+
+// dump turns a config into nested maps of what Print shows.
+func dump(v reflect.Value) (map[string]any, error) {
+	out := map[string]any{}
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		key := jsonName(sf)
+		value := v.Field(i)
+		switch {
+		case isSection(sf.Type):
+			section, err := dump(value)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = section
+		case sf.Tag.Get("secret") == "true":
+			out[key] = redact(value.String())
+		case sf.Type == durationType:
+			out[key] = time.Duration(value.Int()).String()
+		default:
+			out[key] = value.Interface()
+		}
+	}
+	return out, nil
+}
+
+// redact hides a secret, connection strings keep everything but their password so that
+// printing them is still useful.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	u, err := url.Parse(secret)
+	if err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return redacted
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// field is a configurable field, path being where it is in the config file, e.g. rabbitmq.url.
+type field struct {
+	path  string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// walk calls fn on every configurable field of v, sections included.
+func walk(v reflect.Value, prefix string, fn func(field) error) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		path := prefix + jsonName(sf)
+		var err error
+		if isSection(sf.Type) {
+			err = walk(v.Field(i), path+".", fn)
+		} else {
+			err = fn(field{path: path, value: v.Field(i), tag: sf.Tag})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f field) set(value, source string) error {
+	v := f.value
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%w: %s from %s: %v", ErrInvalidConfig, f.path, source, err)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(value)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(value, 10, 64)
+		v.SetInt(i)
+	case reflect.Float64:
+		var fl float64
+		fl, err = strconv.ParseFloat(value, 64)
+		v.SetFloat(fl)
+	default:
+		return fmt.Errorf("%w: %s is of unsupported type %s", ErrInvalidConfig, f.path, v.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s from %s: invalid value %q", ErrInvalidConfig, f.path, source, value)
+	}
+	return nil
+}
+
+// String formats the value of the field the way it is set, empty when it is not.
+func (f field) String() string {
+	switch {
+	case f.value.IsZero():
+		return ""
+	case f.value.Type() == durationType:
+		return time.Duration(f.value.Int()).String()
+	default:
+		return fmt.Sprint(f.value.Interface())
+	}
+}
+
+func (f field) kind() string {
+	if f.value.Type() == durationType {
+		return "duration"
+	}
+	return f.value.Kind().String()
+}
+
+// usage is the flag help of the field, telling its environment variable.
+func (f field) usage() string {
+	usage := f.tag.Get("help")
+	if env := f.tag.Get("env"); env != "" {
+		usage += " (env " + env + ")"
+	}
+	return usage
+}
+
+// sources tells where a missing field can be set from.
+func (f field) sources() string {
+	var sources []string
+	if env := f.tag.Get("env"); env != "" {
+		sources = append(sources, env, env+secretFileSuffix)
+	}
+	if flag := f.tag.Get("flag"); flag != "" {
+		sources = append(sources, "--"+flag)
+	}
+	if len(sources) == 0 {
+		return ""
+	}
+	return ", set it with " + strings.Join(sources, " or ")
+}
+
+func isSection(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct
+}
+
+func jsonName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" {
+		return strings.ToLower(sf.Name)
+	}
+	return name
+}
@@ -0,0 +1,33 @@
+package config
+
+import "fmt"
+
+// Sections shared by the binaries, each one embeds the ones it connects to. The environment
+// variables are the ones compose.yaml sets.
+
+type RabbitMQ struct {
+	URL string `json:"url" env:"RABBIT_AMQP_CONN_STRING" flag:"rabbitmq-url" secret:"true" required:"true" help:"RabbitMQ AMQP connection string"`
+}
+
+type MQTT struct {
+	URL string `json:"url" env:"RABBIT_MQTT_CONN_STRING" flag:"mqtt-url" secret:"true" required:"true" help:"RabbitMQ MQTT connection string"`
+}
+
+type Stream struct {
+	URL string `json:"url" env:"RABBIT_STREAM_CONN_STRING" flag:"stream-url" secret:"true" required:"true" help:"RabbitMQ stream connection string"`
+	// MaxLengthGB bounds each stream (or partition of a super stream) declared, older segments
+	// are truncated past it. Existing streams keep the length they were declared with. Its
+	// default is set by the binary declaring the streams.
+	MaxLengthGB int64 `json:"max_length_gb" env:"STREAM_MAX_LENGTH_GB" flag:"stream-max-length-gb" help:"max length of declared streams in GB"`
+}
+
+func (s *Stream) Validate() error {
+	if s.MaxLengthGB < 1 {
+		return fmt.Errorf("max_length_gb must be at least 1, got %d", s.MaxLengthGB)
+	}
+	return nil
+}
+
+type Postgres struct {
+	URL string `json:"url" env:"POSTGRES_CONN_STRING" flag:"postgres-url" secret:"true" required:"true" help:"Postgres connection string"`
+}
@@ -0,0 +1,175 @@
+// Package gorilla implements the XOR float compression described in Facebook's Gorilla paper
+// (section 4.1.2). Neighbouring samples of a slowly changing signal share sign, exponent and
+// the high mantissa bits, so XOR-ing each value against the previous one leaves a short run of
+// meaningful bits that can be stored on its own.
+package gorilla
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+var ErrShortBuffer = errors.New("gorilla: buffer ends before the expected number of values")
+
+// Encode compresses values into a bit stream. The number of values is not part of the
+// stream, the caller carries it next to the bytes.
+func Encode(values []float64) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	w := &bitWriter{}
+
+	prev := math.Float64bits(values[0])
+	w.writeBits(prev, 64)
+
+	// the first xor always takes the '11' path, these just have to describe an empty window
+	prevLeading, prevTrailing := -1, 0
+	for _, v := range values[1:] {
+		cur := math.Float64bits(v)
+		xor := cur ^ prev
+		prev = cur
+
+		if xor == 0 {
+			w.writeBit(0)
+			continue
+		}
+		w.writeBit(1)
+
+		leading := bits.LeadingZeros64(xor)
+		trailing := bits.TrailingZeros64(xor)
+		if leading > 31 {
+			leading = 31 // five bits to store it
+		}
+
+		if prevLeading != -1 && leading >= prevLeading && trailing >= prevTrailing {
+			// meaningful bits fit into the previous window
+			w.writeBit(0)
+			w.writeBits(xor>>prevTrailing, 64-prevLeading-prevTrailing)
+			continue
+		}
+
+		w.writeBit(1)
+		meaningful := 64 - leading - trailing
+		w.writeBits(uint64(leading), 5)
+		// six bits hold 0..63, a 64 bit window is stored as 0
+		w.writeBits(uint64(meaningful&63), 6)
+		w.writeBits(xor>>trailing, meaningful)
+		prevLeading, prevTrailing = leading, trailing
+	}
+	return w.bytes()
+}
+
+// Decode expands count values out of a stream produced by Encode.
+func Decode(data []byte, count int) ([]float64, error) {
+	if count == 0 {
+		return []float64{}, nil
+	}
+	// every value takes at least a bit, count comes off the wire and must not size the
+	// allocation beyond what data can hold
+	if count < 0 || count > len(data)*8 {
+		return nil, ErrShortBuffer
+	}
+	r := &bitReader{data: data}
+	values := make([]float64, 0, count)
+
+	prev, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	values = append(values, math.Float64frombits(prev))
+
+	var leading, trailing int
+	for len(values) < count {
+		bit, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if bit == 0 {
+			values = append(values, math.Float64frombits(prev))
+			continue
+		}
+
+		bit, err = r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if bit == 1 {
+			l, err := r.readBits(5)
+			if err != nil {
+				return nil, err
+			}
+			m, err := r.readBits(6)
+			if err != nil {
+				return nil, err
+			}
+			meaningful := int(m)
+			if meaningful == 0 {
+				meaningful = 64
+			}
+			leading = int(l)
+			trailing = 64 - leading - meaningful
+		}
+
+		meaningfulBits, err := r.readBits(64 - leading - trailing)
+		if err != nil {
+			return nil, err
+		}
+		prev ^= meaningfulBits << trailing
+		values = append(values, math.Float64frombits(prev))
+	}
+	return values, nil
+}
+
+type bitWriter struct {
+	buf   []byte
+	nbits int // bits used in the last byte of buf
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.nbits == 0 || w.nbits == 8 {
+		w.buf = append(w.buf, 0)
+		w.nbits = 0
+	}
+	if bit != 0 {
+		w.buf[len(w.buf)-1] |= 1 << (7 - w.nbits)
+	}
+	w.nbits++
+}
+
+// writeBits writes the n low bits of v, most significant first.
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit((v >> i) & 1)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+type bitReader struct {
+	data []byte
+	pos  int // bit position
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, ErrShortBuffer
+	}
+	bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint64(bit), nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for range n {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
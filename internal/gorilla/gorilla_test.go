@@ -0,0 +1,61 @@
+package gorilla
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sine := make([]float64, 1000)
+	for i := range sine {
+		sine[i] = math.Sin(2 * math.Pi * 5 * float64(i) / 25000)
+	}
+
+	tests := map[string]struct {
+		input []float64
+	}{
+		"empty":            {input: []float64{}},
+		"single value":     {input: []float64{0.42}},
+		"repeated values":  {input: []float64{1, 1, 1, 1}},
+		"sign flips":       {input: []float64{1, -1, 1, -1}},
+		"special values":   {input: []float64{0, math.Copysign(0, -1), math.Inf(1), math.MaxFloat64, math.SmallestNonzeroFloat64}},
+		"sampled sinewave": {input: sine},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Decode(Encode(tc.input), len(tc.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tc.input) {
+				t.Fatalf("got %d values, want %d", len(got), len(tc.input))
+			}
+			for i := range got {
+				if math.Float64bits(got[i]) != math.Float64bits(tc.input[i]) {
+					t.Fatalf("value %d: got %v, want %v", i, got[i], tc.input[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeShortBuffer(t *testing.T) {
+	tests := map[string]struct {
+		count int
+	}{
+		"more values than encoded": {count: 10},
+		"more values than bits":    {count: 1 << 40},
+		"negative count":           {count: -1},
+	}
+
+	data := Encode([]float64{1, 2, 3})
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode(data, tc.count)
+			if err != ErrShortBuffer {
+				t.Fatalf("got %v, want %v", err, ErrShortBuffer)
+			}
+		})
+	}
+}
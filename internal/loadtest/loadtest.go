@@ -0,0 +1,120 @@
+// Package loadtest drives a storage.MeasurementWriter with synthetic measurement batches and
+// measures how it copes, it backs both the measurements-loadtest tool and the storage
+// benchmarks.
+package loadtest
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+)
+
+// SyntheticBatches builds batches of batchSize consecutive samples, taking the sensors in
+// turns. Each sensor keeps its own clock from start at the given sample frequency, so no two
+// records share a sensor and timestamp and none is dropped as a conflict.
+func SyntheticBatches(sensorIDs []int, start time.Time, batches, batchSize int, frequency float64) [][]storage.SensorMeasurementRecord {
+	period := time.Duration(float64(time.Second) / frequency)
+	next := make([]int, len(sensorIDs)) // sample index each sensor is at
+
+	out := make([][]storage.SensorMeasurementRecord, batches)
+	for b := range out {
+		sensor := b % len(sensorIDs)
+		batch := make([]storage.SensorMeasurementRecord, batchSize)
+		for i := range batch {
+			n := next[sensor] + i
+			batch[i] = storage.SensorMeasurementRecord{
+				Timestamp:   start.Add(time.Duration(n) * period),
+				SensorID:    sensorIDs[sensor],
+				Measurement: math.Sin(float64(n) / 10),
+			}
+		}
+		next[sensor] += batchSize
+		out[b] = batch
+	}
+	return out
+}
+
+type Result struct {
+	Strategy string
+	Batches  int
+	Rows     int
+	Errors   int
+	Elapsed  time.Duration
+	P50      time.Duration
+	P99      time.Duration
+}
+
+// RowsPerSecond counts only the rows of successful writes.
+func (r Result) RowsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Rows) / r.Elapsed.Seconds()
+}
+
+// Run writes every batch with concurrency writers at once and times each write.
+func Run(ctx context.Context, writer storage.MeasurementWriter, batches [][]storage.SensorMeasurementRecord, concurrency int) Result {
+	concurrency = max(concurrency, 1)
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, len(batches))
+		result    Result
+	)
+
+	work := make(chan []storage.SensorMeasurementRecord)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range work {
+				writeStart := time.Now()
+				err := writer.WriteMeasurements(ctx, batch)
+				took := time.Since(writeStart)
+
+				mu.Lock()
+				latencies = append(latencies, took)
+				result.Batches++
+				if err != nil {
+					result.Errors++
+				} else {
+					result.Rows += len(batch)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, batch := range batches {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- batch
+	}
+	close(work)
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	result.P50 = Percentile(latencies, 50)
+	result.P99 = Percentile(latencies, 99)
+	return result
+}
+
+// Percentile returns the nearest-rank p-th percentile of the latencies.
+func Percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	rank = min(max(rank, 1), len(sorted))
+	return sorted[rank-1]
+}
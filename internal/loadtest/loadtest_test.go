@@ -0,0 +1,112 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+)
+
+func TestPercentile(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		out := make([]time.Duration, len(n))
+		for i, v := range n {
+			out[i] = time.Duration(v) * time.Millisecond
+		}
+		return out
+	}
+
+	tests := map[string]struct {
+		latencies []time.Duration
+		p         float64
+		want      time.Duration
+	}{
+		"no latencies": {
+			latencies: nil,
+			p:         99,
+			want:      0,
+		},
+		"median of unsorted input": {
+			latencies: ms(5, 1, 4, 2, 3),
+			p:         50,
+			want:      3 * time.Millisecond,
+		},
+		"p99 of a hundred is the 99th": {
+			latencies: ms(func() []int {
+				n := make([]int, 100)
+				for i := range n {
+					n[i] = 100 - i
+				}
+				return n
+			}()...),
+			p:    99,
+			want: 99 * time.Millisecond,
+		},
+		"p99 of few samples is the slowest": {
+			latencies: ms(1, 2, 3),
+			p:         99,
+			want:      3 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := Percentile(tc.latencies, tc.p)
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSyntheticBatchesHaveNoDuplicates(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	batches := SyntheticBatches([]int{1, 2}, start, 5, 100, 1000)
+
+	if len(batches) != 5 {
+		t.Fatalf("got %d batches, want 5", len(batches))
+	}
+
+	type key struct {
+		sensorID int
+		ts       time.Time
+	}
+	seen := make(map[key]bool)
+	for _, batch := range batches {
+		if len(batch) != 100 {
+			t.Fatalf("got batch of %d, want 100", len(batch))
+		}
+		for _, record := range batch {
+			k := key{record.SensorID, record.Timestamp}
+			if seen[k] {
+				t.Fatalf("got duplicate record for sensor %d at %v", k.sensorID, k.ts)
+			}
+			seen[k] = true
+		}
+	}
+
+	// third batch is the second one of sensor 1
+	if got, want := batches[2][0].Timestamp, start.Add(100*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	calls := 0
+	writer := storage.MeasurementWriterFunc(func(ctx context.Context, measurements []storage.SensorMeasurementRecord) error {
+		calls++
+		if calls == 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+
+	batches := SyntheticBatches([]int{1}, time.Now(), 4, 10, 100)
+	result := Run(context.Background(), writer, batches, 1)
+
+	if result.Batches != 4 || result.Errors != 1 || result.Rows != 30 {
+		t.Fatalf("got %d batches, %d errors, %d rows, want 4, 1, 30", result.Batches, result.Errors, result.Rows)
+	}
+}
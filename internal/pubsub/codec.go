@@ -0,0 +1,151 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeGob      = "application/gob"
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec is a wire format. Publishers pick one and stamp its content type on every message,
+// consumers pick the decoder out of that content type, so each producer can migrate its
+// wire format on its own without a flag day.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	ContentType() string
+}
+
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	err := enc.Encode(v)
+	return buffer.Bytes(), err
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	buffer := bytes.NewBuffer(data)
+	decoder := gob.NewDecoder(buffer)
+	return decoder.Decode(v)
+}
+
+func (GobCodec) ContentType() string { return ContentTypeGob }
+
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+// ProtobufCodec works with generated messages, so T must be a pointer such as *pb.SensorLog.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	// Decode hands a pointer to a (nil) message pointer, allocate the message first
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && rv.Elem().Kind() == reflect.Pointer {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if m, ok := rv.Elem().Interface().(proto.Message); ok {
+			return proto.Unmarshal(data, m)
+		}
+	}
+	return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+}
+
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		ContentTypeGob:      GobCodec{},
+		ContentTypeJSON:     JSONCodec{},
+		ContentTypeProtobuf: ProtobufCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available to content type negotiation.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecFor returns the codec registered for the content type. Messages without content type
+// (e.g. coming from MQTT 3.1.1 clients) are assumed to be JSON, as they always were.
+func CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSONCodec{}, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", contentType)
+	}
+	return codec, nil
+}
+
+// SniffContentType guesses the content type of a payload that came without one. JSON
+// documents start with '{' or '[', which as a protobuf tag would be a group wire type that
+// proto3 never emits, so anything else is taken as protobuf.
+func SniffContentType(data []byte) string {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return ContentTypeJSON
+	}
+	return ContentTypeProtobuf
+}
+
+// Decode decodes data into a new T with the given codec.
+func Decode[T any](codec Codec, data []byte) (T, error) {
+	var target T
+	err := codec.Unmarshal(data, &target)
+	return target, err
+}
+
+// DecodeContentType decodes data into a new T with the codec registered for the content type.
+func DecodeContentType[T any](contentType string, data []byte) (T, error) {
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		var target T
+		return target, err
+	}
+	return Decode[T](codec, data)
+}
+
+// DecodeJSON is the decoder SubscribeJSON and SubscribeStreamJSON apply to every payload.
+func DecodeJSON[T any](data []byte) (T, error) {
+	return Decode[T](JSONCodec{}, data)
+}
+
+// DecodeGob is the decoder SubscribeGob applies to every payload.
+func DecodeGob[T any](data []byte) (T, error) {
+	return Decode[T](GobCodec{}, data)
+}
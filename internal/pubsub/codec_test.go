@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	type sensor struct {
+		SerialNumber    string
+		SampleFrequency float64
+	}
+	want := sensor{SerialNumber: "AAD-1123", SampleFrequency: 25000}
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			data, err := codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("unexpected error marshalling: %v", err)
+			}
+			got, err := DecodeContentType[sensor](codec.ContentType(), data)
+			if err != nil {
+				t.Fatalf("unexpected error decoding: %v", err)
+			}
+			if want != got {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run(ContentTypeProtobuf, func(t *testing.T) {
+		want := timestamppb.New(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		data, err := ProtobufCodec{}.Marshal(want)
+		if err != nil {
+			t.Fatalf("unexpected error marshalling: %v", err)
+		}
+		got, err := DecodeContentType[*timestamppb.Timestamp](ContentTypeProtobuf, data)
+		if err != nil {
+			t.Fatalf("unexpected error decoding: %v", err)
+		}
+		if !want.AsTime().Equal(got.AsTime()) {
+			t.Fatalf("got %v, want %v", got.AsTime(), want.AsTime())
+		}
+	})
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		"no content type falls back to json": {
+			input: "",
+			want:  ContentTypeJSON,
+		},
+		"gob": {
+			input: ContentTypeGob,
+			want:  ContentTypeGob,
+		},
+		"unknown content type": {
+			input:   "text/csv",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := CodecFor(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got codec %v", got.ContentType())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.want != got.ContentType() {
+				t.Fatalf("got %v, want %v", got.ContentType(), tc.want)
+			}
+		})
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	proto, err := ProtobufCodec{}.Marshal(timestamppb.New(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)))
+	if err != nil {
+		t.Fatalf("unexpected error marshalling: %v", err)
+	}
+	tests := map[string]struct {
+		input []byte
+		want  string
+	}{
+		"json array": {
+			input: []byte(`[{"SerialNumber":"AAD-1123"}]`),
+			want:  ContentTypeJSON,
+		},
+		"json object with leading whitespace": {
+			input: []byte("\n  {\"SerialNumber\":\"AAD-1123\"}"),
+			want:  ContentTypeJSON,
+		},
+		"protobuf": {
+			input: proto,
+			want:  ContentTypeProtobuf,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := SniffContentType(tc.input)
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
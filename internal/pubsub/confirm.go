@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrUnroutable means the exchange had no queue bound for the routing key, the broker
+	// returned the message instead of dropping it. Exchanges with an alternate exchange never
+	// return messages, those end up in the alternate one instead.
+	ErrUnroutable = errors.New("message could not be routed to any queue")
+	// ErrNacked means the broker took the message but could not take responsibility for it.
+	ErrNacked = errors.New("message was nacked by the broker")
+	// ErrConfirmTimeout means the broker did not confirm the message in time, it may or may not
+	// have been delivered.
+	ErrConfirmTimeout = errors.New("timed out waiting for the broker to confirm the message")
+)
+
+const DefaultConfirmTimeout = 5 * time.Second
+
+// ConfirmPublisher publishes mandatory messages on a channel in confirm mode and waits for
+// the broker verdict on each of them, so callers know whether a message reached a queue.
+// Publishes are serialized, and returns are matched to the message by its id: the broker
+// sends basic.return before the basic.ack of the same message.
+type ConfirmPublisher struct {
+	mu      sync.Mutex
+	conn    *Connection
+	ch      *amqp.Channel
+	returns *returnWatcher
+	timeout time.Duration
+}
+
+func NewConfirmPublisher(conn *Connection, timeout time.Duration) (*ConfirmPublisher, error) {
+	p := &ConfirmPublisher{
+		conn:    conn,
+		timeout: timeout,
+	}
+	err := p.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// openChannel is also used to replace the channel after the broker closed it, e.g. when a
+// message was published to an exchange that does not exist.
+func (p *ConfirmPublisher) openChannel() error {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create confirm channel: %v", err)
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("could not put channel in confirm mode: %v", err)
+	}
+	p.ch = ch
+	p.returns = watchReturns(ch.NotifyReturn(make(chan amqp.Return)))
+	return nil
+}
+
+// Publish sends msg as mandatory and blocks until it is confirmed, returned, nacked, or the
+// timeout or ctx expire.
+func (p *ConfirmPublisher) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch.IsClosed() {
+		err := p.openChannel()
+		if err != nil {
+			return err
+		}
+	}
+
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID() // returns are matched by it
+	}
+
+	confirmation, err := p.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		key,
+		true, // mandatory
+		false,
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-confirmation.Done():
+	case <-timer.C:
+		return ErrConfirmTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ret, returned := p.returns.take(msg.MessageId)
+	if returned {
+		return fmt.Errorf("%w: %s (exchange %s, routing key %s)", ErrUnroutable, ret.ReplyText, ret.Exchange, ret.RoutingKey)
+	}
+
+	if !confirmation.Acked() {
+		return ErrNacked
+	}
+	return nil
+}
+
+func (p *ConfirmPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ch.Close()
+}
+
+// returnWatcher reads the returns of a channel as soon as the broker sends them, so the
+// connection never waits on a publisher to read one, and keeps them until asked for.
+type returnWatcher struct {
+	requests chan returnRequest
+	done     chan struct{}
+}
+
+type returnRequest struct {
+	messageID string
+	reply     chan *amqp.Return
+}
+
+// watchReturns must be handed an unbuffered channel: the connection then only goes on to
+// the basic.ack of a message once its return was received, so take, which the same goroutine
+// serves afterwards, always sees it.
+func watchReturns(returns <-chan amqp.Return) *returnWatcher {
+	w := &returnWatcher{
+		requests: make(chan returnRequest),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		pending := map[string]amqp.Return{}
+		for {
+			select {
+			case ret, ok := <-returns:
+				if !ok {
+					return // channel closed
+				}
+				pending[ret.MessageId] = ret
+			case req := <-w.requests:
+				ret, ok := pending[req.messageID]
+				// publishes are serialized, any other return is left over from a publish
+				// that timed out
+				clear(pending)
+				if ok {
+					req.reply <- &ret
+				} else {
+					req.reply <- nil
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// take tells whether the broker returned the message, once its confirmation arrived.
+func (w *returnWatcher) take(messageID string) (amqp.Return, bool) {
+	req := returnRequest{messageID: messageID, reply: make(chan *amqp.Return, 1)}
+	select {
+	case w.requests <- req:
+	case <-w.done:
+		return amqp.Return{}, false
+	}
+	ret := <-req.reply
+	if ret == nil {
+		return amqp.Return{}, false
+	}
+	return *ret, true
+}
+
+// publishAndConfirm publishes msg on ch, which must be in confirm mode, and waits until the
+// broker took responsibility for it. Unlike ConfirmPublisher, publishes are not mandatory and
+// may run concurrently on ch.
+func publishAndConfirm(ctx context.Context, ch *amqp.Channel, exchange, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultConfirmTimeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrConfirmTimeout
+	case err != nil:
+		return err
+	case !acked:
+		return ErrNacked
+	}
+	return nil
+}
+
+// PublishConfirmed is Publish for a ConfirmPublisher.
+func PublishConfirmed[T any](ctx context.Context, p *ConfirmPublisher, exchange, key string, codec Codec, val T) error {
+	msg, err := newPublishing(codec, val)
+	if err != nil {
+		return err
+	}
+	tracing.InjectHeaders(ctx, msg.Headers)
+	return p.Publish(ctx, exchange, key, msg)
+}
@@ -0,0 +1,32 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestReturnWatcher(t *testing.T) {
+	returns := make(chan amqp.Return)
+	w := watchReturns(returns)
+
+	// a return left over from a publish that timed out, then the one of the next publish
+	returns <- amqp.Return{MessageId: "stale", RoutingKey: "sensor.AAD-1123.commands.sleep"}
+	returns <- amqp.Return{MessageId: "current", RoutingKey: "sensor.AAD-1124.commands.sleep"}
+
+	ret, ok := w.take("current")
+	if !ok || ret.RoutingKey != "sensor.AAD-1124.commands.sleep" {
+		t.Fatalf("got %v %v, want the return of the current message", ret, ok)
+	}
+	_, ok = w.take("stale")
+	if ok {
+		t.Fatalf("got a stale return, want it dropped")
+	}
+
+	close(returns)
+	<-w.done
+	_, ok = w.take("current")
+	if ok {
+		t.Fatalf("got a return from a closed channel, want none")
+	}
+}
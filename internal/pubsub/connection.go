@@ -0,0 +1,253 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+
+	// publishChannelPoolSize bounds how many idle publish channels are kept open, more can be
+	// in use at once but those are closed when handed back.
+	publishChannelPoolSize = 8
+)
+
+var ErrConnectionClosed = errors.New("connection closed")
+
+// Connection is an AMQP connection that outlives the broker connection underneath. When the
+// broker goes away it dials again with exponential backoff and re-runs every setup (topology
+// declarations and subscriptions) on the new connection, in the order they were registered.
+// It also keeps a pool of channels for publishers, so they do not open one per message.
+type Connection struct {
+	url string
+
+	mu           sync.RWMutex
+	conn         *amqp.Connection
+	setups       []func(*amqp.Connection) error
+	closed       bool
+	shuttingDown bool
+
+	pool chan *amqp.Channel
+
+	// consumers are the consumer goroutines still running, stopConsumers tells them to stop
+	consumers     sync.WaitGroup
+	stopped       context.Context
+	stopConsumers context.CancelFunc
+}
+
+func Dial(url string) (*Connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Connection{
+		url:  url,
+		conn: conn,
+		pool: make(chan *amqp.Channel, publishChannelPoolSize),
+	}
+	c.stopped, c.stopConsumers = context.WithCancel(context.Background())
+	go c.watch(conn)
+	return c, nil
+}
+
+// watch waits for the broker connection to drop and reconnects, a nil error means it was
+// closed on purpose.
+func (c *Connection) watch(conn *amqp.Connection) {
+	amqpErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok || amqpErr == nil {
+		return
+	}
+	fmt.Printf("AMQP connection lost: %v\n", amqpErr)
+
+	backoff := reconnectMinBackoff
+	for {
+		time.Sleep(backoff)
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		newConn, err := c.reconnect()
+		c.mu.Unlock()
+
+		if err == nil {
+			fmt.Println("AMQP connection re-established")
+			go c.watch(newConn)
+			return
+		}
+		fmt.Printf("could not reconnect to RabbitMQ, retrying in %v: %v\n", nextBackoff(backoff), err)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// reconnect dials and runs the setups on the new connection, it must be called with mu held.
+func (c *Connection) reconnect() (*amqp.Connection, error) {
+	newConn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, err
+	}
+	for _, setup := range c.setups {
+		err = setup(newConn)
+		if err != nil {
+			newConn.Close()
+			return nil, fmt.Errorf("could not re-run setup: %v", err)
+		}
+	}
+
+	c.conn = newConn
+	c.drainPool()
+	return newConn, nil
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	return min(backoff*2, reconnectMaxBackoff)
+}
+
+// Setup runs fn on the current connection and again on every new one after a reconnect.
+// It is how topology and subscriptions survive a broker restart.
+func (c *Connection) Setup(fn func(*amqp.Connection) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrConnectionClosed
+	}
+
+	err := fn(c.conn)
+	if err != nil {
+		return err
+	}
+	c.setups = append(c.setups, fn)
+	return nil
+}
+
+// Channel opens a channel on the current connection, the caller owns and closes it.
+func (c *Connection) Channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, ErrConnectionClosed
+	}
+	return c.conn.Channel()
+}
+
+// WithChannel lends fn a pooled channel. Channels closed by fn, or by the broker because of
+// something fn did, are not handed out again.
+func (c *Connection) WithChannel(fn func(*amqp.Channel) error) error {
+	ch, err := c.acquire()
+	if err != nil {
+		return fmt.Errorf("could not open channel: %v", err)
+	}
+
+	err = fn(ch)
+
+	if ch.IsClosed() {
+		return err
+	}
+	select {
+	case c.pool <- ch:
+	default:
+		ch.Close()
+	}
+	return err
+}
+
+func (c *Connection) acquire() (*amqp.Channel, error) {
+	for {
+		select {
+		case ch := <-c.pool:
+			if ch.IsClosed() {
+				continue // left over from a connection that is gone
+			}
+			return ch, nil
+		default:
+			return c.Channel()
+		}
+	}
+}
+
+func (c *Connection) drainPool() {
+	for {
+		select {
+		case ch := <-c.pool:
+			ch.Close()
+		default:
+			return
+		}
+	}
+}
+
+// IsClosed reports whether the broker connection is down at the moment, which is the case
+// while reconnecting too.
+func (c *Connection) IsClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed || c.conn.IsClosed()
+}
+
+// consuming registers a consumer goroutine, it must be called with mu held, i.e. from a setup.
+// The returned context is done once ctx is or Shutdown was called, release is called once the
+// consumer acknowledged its last delivery. ok is false when shutting down, and nothing should
+// be consumed then.
+func (c *Connection) consuming(ctx context.Context) (consumeCtx context.Context, release func(), ok bool) {
+	if c.shuttingDown {
+		return nil, nil, false
+	}
+	c.consumers.Add(1)
+	consumeCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.stopped, cancel)
+	return consumeCtx, func() {
+		stop()
+		cancel()
+		c.consumers.Done()
+	}, true
+}
+
+// Shutdown stops the consumers from taking new deliveries, waits for those being handled to
+// be acknowledged and closes the connection. Publishing keeps working until then, for handlers
+// that publish. Deliveries not acknowledged when ctx is done are requeued by the broker once
+// the connection is closed.
+func (c *Connection) Shutdown(ctx context.Context) error {
+	return errors.Join(c.drainConsumers(ctx), c.Close())
+}
+
+// drainConsumers stops the consumers and waits for them until ctx is done.
+func (c *Connection) drainConsumers(ctx context.Context) error {
+	c.mu.Lock()
+	c.shuttingDown = true // no consumer comes back on a reconnect from now on
+	c.mu.Unlock()
+	c.stopConsumers()
+
+	drained := make(chan struct{})
+	go func() {
+		c.consumers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("consumers still handling deliveries: %w", ctx.Err())
+	}
+}
+
+// Close stops reconnecting and closes the broker connection.
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.drainPool()
+	return c.conn.Close()
+}
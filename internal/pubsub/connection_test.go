@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	tests := map[string]struct {
+		input time.Duration
+		want  time.Duration
+	}{
+		"doubles": {
+			input: reconnectMinBackoff,
+			want:  2 * reconnectMinBackoff,
+		},
+		"capped": {
+			input: 20 * time.Second,
+			want:  reconnectMaxBackoff,
+		},
+		"stays at the cap": {
+			input: reconnectMaxBackoff,
+			want:  reconnectMaxBackoff,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := nextBackoff(tc.input)
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDrainConsumers(t *testing.T) {
+	c := &Connection{}
+	c.stopped, c.stopConsumers = context.WithCancel(context.Background())
+
+	consumeCtx, release, ok := c.consuming(context.Background())
+	if !ok {
+		t.Fatalf("got consumer refused, want it registered")
+	}
+
+	// the consumer finishes its in-flight delivery once told to stop
+	handled := false
+	go func() {
+		<-consumeCtx.Done()
+		time.Sleep(10 * time.Millisecond)
+		handled = true
+		release()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := c.drainConsumers(ctx)
+	if err != nil || !handled {
+		t.Fatalf("got error %v and handled %v, want nil and true", err, handled)
+	}
+
+	_, _, ok = c.consuming(context.Background())
+	if ok {
+		t.Fatalf("got consumer registered while shutting down, want it refused")
+	}
+}
+
+func TestDrainConsumersDeadline(t *testing.T) {
+	c := &Connection{}
+	c.stopped, c.stopConsumers = context.WithCancel(context.Background())
+
+	_, release, _ := c.consuming(context.Background()) // never released in time
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := c.drainConsumers(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
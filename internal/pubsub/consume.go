@@ -1,13 +1,13 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 	amqp "github.com/rabbitmq/amqp091-go"
 	amqpEncodeStreamMessage "github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
 	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/ha"
@@ -41,49 +41,225 @@ const (
 	NackRequeue
 )
 
-func DeclareAndBindStream(env *stream.Environment, streamName string) error {
-	err := env.DeclareStream(streamName, stream.NewStreamOptions().SetMaxLengthBytes(stream.ByteCapacity{}.GB(2)))
+// MaxRedeliveries bounds how many times a message rejected with NackRequeue is put back
+// on its queue. Once reached, the message is discarded instead so a poison message cannot
+// spin forever between the broker and the consumer.
+const MaxRedeliveries = 5
+
+// headerRedeliveryCount counts the requeues of a message on a classic queue, which has no
+// x-delivery-count of its own, see requeueCounted.
+const headerRedeliveryCount = "x-redelivery-count"
+
+// DefaultStreamMaxLengthGB bounds the streams declared by consumers that do not say otherwise.
+const DefaultStreamMaxLengthGB = 2
+
+func DeclareAndBindStream(env *stream.Environment, streamName string, maxLengthGB int64) error {
+	err := env.DeclareStream(streamName, stream.NewStreamOptions().SetMaxLengthBytes(stream.ByteCapacity{}.GB(maxLengthGB)))
 	return err
 }
 
 func SubscribeStreamJSON[T any](
+	ctx context.Context,
+	env *stream.Environment,
+	streamName string,
+	streamOptions *stream.ConsumerOptions,
+	handler func(T) AckType,
+	opts ...StreamOption,
+) (*ha.ReliableConsumer, error) {
+	return subscribeStream[T](
+		ctx,
+		env,
+		streamName,
+		streamOptions,
+		handler,
+		func(message *amqpEncodeStreamMessage.Message) (T, error) {
+			return DecodeJSON[T](message.GetData())
+		},
+		opts...,
+	)
+}
+
+// SubscribeStream picks the decoder out of each message content type property. Messages
+// without one (e.g. published by MQTT 3.1.1 sensors) get their content type sniffed instead.
+func SubscribeStream[T any](
+	ctx context.Context,
+	env *stream.Environment,
+	streamName string,
+	streamOptions *stream.ConsumerOptions,
+	handler func(T) AckType,
+	opts ...StreamOption,
+) (*ha.ReliableConsumer, error) {
+	return SubscribeStreamDecoder(ctx, env, streamName, streamOptions, handler, DecodeContentType[T], opts...)
+}
+
+// SubscribeStreamDecoder is SubscribeStream for consumers whose wire type is not the type
+// the handler works with, decode receives the negotiated content type along with the payload.
+func SubscribeStreamDecoder[T any](
+	ctx context.Context,
 	env *stream.Environment,
 	streamName string,
 	streamOptions *stream.ConsumerOptions,
 	handler func(T) AckType,
+	decode func(contentType string, data []byte) (T, error),
+	opts ...StreamOption,
 ) (*ha.ReliableConsumer, error) {
+	return subscribeStream[T](
+		ctx,
+		env,
+		streamName,
+		streamOptions,
+		handler,
+		contentTypeUnmarshaller(decode),
+		opts...,
+	)
+}
 
-	err := DeclareAndBindStream(env, streamName)
+// contentTypeUnmarshaller hands decode the content type property of the message, or the
+// sniffed one when it has none.
+func contentTypeUnmarshaller[T any](decode func(contentType string, data []byte) (T, error)) func(*amqpEncodeStreamMessage.Message) (T, error) {
+	return func(message *amqpEncodeStreamMessage.Message) (T, error) {
+		data := message.GetData()
+		var contentType string
+		if message.Properties != nil {
+			contentType = message.Properties.ContentType
+		}
+		if contentType == "" {
+			contentType = SniffContentType(data)
+		}
+		return decode(contentType, data)
+	}
+}
+
+// subscribeStream hands messages to the handler in order and stores the consumer offset as
+// it goes, the handler AckType decides what happens to each message:
+//   - Ack and NackDiscard move past the message
+//   - NackRequeue keeps retrying it with backoff, holding back the ones after it, so a failing
+//     write never lets the stored offset skip ahead of what was really handled
+//
+// Once ctx is done, retries stop and no further message is handled, what was not is read
+// again after a restart. Offsets are stored manually, the stream options must not set auto
+// commit.
+func subscribeStream[T any](
+	ctx context.Context,
+	env *stream.Environment,
+	streamName string,
+	streamOptions *stream.ConsumerOptions,
+	handler func(T) AckType,
+	unmarshaller func(*amqpEncodeStreamMessage.Message) (T, error),
+	opts ...StreamOption,
+) (*ha.ReliableConsumer, error) {
+	options := newStreamOptions(opts...)
+
+	err := DeclareAndBindStream(env, streamName, options.maxLengthGB)
 	if err != nil && !errors.Is(err, stream.StreamAlreadyExists) {
 		fmt.Printf("Error declaring stream: %v\n", err)
 		return nil, err
 	}
 
+	committer := newOffsetCommitter(options.commitEvery, options.commitInterval)
+	go committer.run(ctx)
+
 	consumer, err := ha.NewReliableConsumer(
 		env,
 		streamName,
 		streamOptions,
-		func(consumerContext stream.ConsumerContext, message *amqpEncodeStreamMessage.Message) {
-			var target T
-			err := json.Unmarshal(message.GetData(), &target)
-			if err != nil {
-				fmt.Printf("could not unmarshal message: %v\n", err)
-			}
-			handler(target)
-		},
+		streamMessagesHandler(ctx, bodyHandler(handler), unmarshaller, func(string) *offsetCommitter { return committer }),
 	)
 	return consumer, err
 }
 
+// streamMessagesHandler runs the decode, retry and offset store steps described on
+// subscribeStream for every message, committerFor returns the committer of the stream the
+// message was read from. A nil committerFor leaves storing offsets to the handler.
+func streamMessagesHandler[T any](
+	ctx context.Context,
+	handler func(StreamDelivery[T]) AckType,
+	unmarshaller func(*amqpEncodeStreamMessage.Message) (T, error),
+	committerFor func(streamName string) *offsetCommitter,
+) stream.MessagesHandler {
+	return func(consumerContext stream.ConsumerContext, message *amqpEncodeStreamMessage.Message) {
+		if ctx.Err() != nil {
+			return // shutting down, the message is read again after a restart
+		}
+		offset := consumerContext.Consumer.GetOffset()
+		handled := func() {
+			if committerFor != nil {
+				committerFor(consumerContext.Consumer.GetStreamName()).handled(consumerContext.Consumer.StoreCustomOffset, offset)
+			}
+		}
+
+		target, err := unmarshaller(message)
+		if err != nil {
+			// a payload that cannot be decoded now will not be decodable on a retry either
+			fmt.Printf("could not unmarshal message at offset %d: %v\n", offset, err)
+			handled()
+			return
+		}
+
+		streamName := consumerContext.Consumer.GetStreamName()
+		spanCtx, span := tracing.Start(
+			tracing.Extract(context.Background(), streamTraceParent(message, target)),
+			"consume "+streamName,
+			tracing.SpanKindConsumer,
+		)
+		span.SetAttribute("messaging.rabbitmq.stream.offset", strconv.FormatInt(offset, 10))
+		defer span.End()
+
+		delivery := StreamDelivery[T]{
+			Body:   target,
+			Stream: streamName,
+			Offset: offset,
+			ctx:    spanCtx,
+			store:  consumerContext.Consumer.StoreCustomOffset,
+		}
+
+		backoff := streamRetryMinBackoff
+		for handler(delivery) == NackRequeue {
+			fmt.Printf("handler failed on offset %d, retrying in %v\n", offset, backoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				fmt.Printf("stopped retrying offset %d, it is read again after a restart\n", offset)
+				return
+			}
+			backoff = min(backoff*2, streamRetryMaxBackoff)
+		}
+		handled()
+	}
+}
+
+// streamTraceParent takes the traceparent out of the application properties of the message,
+// or out of the decoded payload for publishers that cannot set properties (e.g. MQTT 3.1.1
+// sensors, whose batches carry it in their envelope).
+func streamTraceParent[T any](message *amqpEncodeStreamMessage.Message, target T) string {
+	if traceParent, ok := message.ApplicationProperties[tracing.TraceParentHeader].(string); ok {
+		return traceParent
+	}
+	if carrier, ok := any(target).(interface{ TraceParent() string }); ok {
+		return carrier.TraceParent()
+	}
+	return ""
+}
+
+// bodyHandler adapts a handler that only cares about the message body.
+func bodyHandler[T any](handler func(T) AckType) func(StreamDelivery[T]) AckType {
+	return func(delivery StreamDelivery[T]) AckType {
+		return handler(delivery.Body)
+	}
+}
+
 func SubscribeJSON[T any](
 	ctx context.Context,
-	conn *amqp.Connection,
+	conn *Connection,
 	exchange,
 	queueName,
 	key string,
 	queueDurability QueueDurability,
 	queueType QueueType,
 	handler func(T) AckType,
+	opts ...SubscribeOption,
 ) error {
 	return subscribe[T](
 		ctx,
@@ -93,24 +269,84 @@ func SubscribeJSON[T any](
 		key,
 		queueDurability,
 		queueType,
-		handler,
-		func(data []byte) (T, error) {
-			var target T
-			err := json.Unmarshal(data, &target)
-			return target, err
+		ignoreContext(handler),
+		func(msg amqp.Delivery) (T, error) {
+			return decodeMessage[T](JSONCodec{}, msg.Headers, msg.Body)
 		},
+		opts...,
 	)
 }
 
 func SubscribeGob[T any](
 	ctx context.Context,
-	conn *amqp.Connection,
+	conn *Connection,
 	exchange,
 	queueName,
 	key string,
 	queueDurability QueueDurability,
 	queueType QueueType,
 	handler func(T) AckType,
+	opts ...SubscribeOption,
+) error {
+	return subscribe[T](
+		ctx,
+		conn,
+		exchange,
+		queueName,
+		key,
+		queueDurability,
+		queueType,
+		ignoreContext(handler),
+		func(msg amqp.Delivery) (T, error) {
+			return decodeMessage[T](GobCodec{}, msg.Headers, msg.Body)
+		},
+		opts...,
+	)
+
+}
+
+// Subscribe picks the decoder out of each delivery content type, so producers can switch
+// codecs without their consumers being redeployed first.
+func Subscribe[T any](
+	ctx context.Context,
+	conn *Connection,
+	exchange,
+	queueName,
+	key string,
+	queueDurability QueueDurability,
+	queueType QueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) error {
+	return subscribe[T](
+		ctx,
+		conn,
+		exchange,
+		queueName,
+		key,
+		queueDurability,
+		queueType,
+		ignoreContext(handler),
+		func(msg amqp.Delivery) (T, error) {
+			return DecodeMessage[T](msg.ContentType, msg.Headers, msg.Body)
+		},
+		opts...,
+	)
+}
+
+// SubscribeContext is Subscribe for handlers that take the context of the message, which
+// carries the span it is consumed under for the work and messages that follow from it. It is
+// not cancelled with the subscription, so messages in flight are finished while draining.
+func SubscribeContext[T any](
+	ctx context.Context,
+	conn *Connection,
+	exchange,
+	queueName,
+	key string,
+	queueDurability QueueDurability,
+	queueType QueueType,
+	handler func(context.Context, T) AckType,
+	opts ...SubscribeOption,
 ) error {
 	return subscribe[T](
 		ctx,
@@ -121,18 +357,81 @@ func SubscribeGob[T any](
 		queueDurability,
 		queueType,
 		handler,
-		func(data []byte) (T, error) {
-			buffer := bytes.NewBuffer(data)
-			decoder := gob.NewDecoder(buffer)
-			var target T
-			err := decoder.Decode(&target)
-			return target, err
+		func(msg amqp.Delivery) (T, error) {
+			return DecodeMessage[T](msg.ContentType, msg.Headers, msg.Body)
 		},
+		opts...,
 	)
+}
 
+// ignoreContext adapts a handler that does not care about the context of the message.
+func ignoreContext[T any](handler func(T) AckType) func(context.Context, T) AckType {
+	return func(_ context.Context, msg T) AckType {
+		return handler(msg)
+	}
+}
+
+// SubscribeDelivery hands the raw delivery to the handler, for consumers that care about
+// headers and routing keys rather than a decoded payload (e.g. dead-letter quarantine).
+func SubscribeDelivery(
+	ctx context.Context,
+	conn *Connection,
+	exchange,
+	queueName,
+	key string,
+	queueDurability QueueDurability,
+	queueType QueueType,
+	handler func(amqp.Delivery) AckType,
+	opts ...SubscribeOption,
+) error {
+	return subscribe[amqp.Delivery](
+		ctx,
+		conn,
+		exchange,
+		queueName,
+		key,
+		queueDurability,
+		queueType,
+		ignoreContext(handler),
+		func(msg amqp.Delivery) (amqp.Delivery, error) {
+			return msg, nil
+		},
+		opts...,
+	)
 }
 
 func subscribe[T any](
+	ctx context.Context,
+	conn *Connection,
+	exchange,
+	queueName,
+	key string,
+	queueDurability QueueDurability,
+	queueType QueueType,
+	handler func(context.Context, T) AckType,
+	unmarshaller func(amqp.Delivery) (T, error),
+	opts ...SubscribeOption,
+) error {
+	options := newSubscribeOptions(opts...)
+
+	// runs again on every reconnect, the previous consumer goroutine ends with its connection
+	return conn.Setup(func(amqpConn *amqp.Connection) error {
+		if ctx.Err() != nil {
+			return nil // subscription no longer wanted
+		}
+		consumeCtx, release, ok := conn.consuming(ctx)
+		if !ok {
+			return nil // shutting down
+		}
+		err := consume(consumeCtx, amqpConn, exchange, queueName, key, queueDurability, queueType, handler, unmarshaller, options, release)
+		if err != nil {
+			release()
+		}
+		return err
+	})
+}
+
+func consume[T any](
 	ctx context.Context,
 	conn *amqp.Connection,
 	exchange,
@@ -140,8 +439,10 @@ func subscribe[T any](
 	key string,
 	queueDurability QueueDurability,
 	queueType QueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
+	handler func(context.Context, T) AckType,
+	unmarshaller func(amqp.Delivery) (T, error),
+	options subscribeOptions,
+	release func(), // called once the consumer goroutine is done
 ) error {
 	ch, queue, err := DeclareAndBindAMQP(
 		conn,
@@ -150,12 +451,27 @@ func subscribe[T any](
 		key,
 		queueDurability,
 		queueType,
+		options.deadLetter,
 	)
 	if err != nil {
 		return fmt.Errorf("could not declare and bind queue: %v", err)
 	}
 
-	err = ch.Qos(10, 0, false) // luckily enough stream queues does not support global QoS prefetch
+	for _, bindingKey := range options.bindingKeys {
+		err = ch.QueueBind(queue.Name, bindingKey, exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind queue with %s: %v", bindingKey, err)
+		}
+	}
+
+	if options.retryPolicy != nil {
+		err = options.retryPolicy.declare(ch, queue.Name, queueDurability)
+		if err != nil {
+			return fmt.Errorf("could not declare retry queues: %v", err)
+		}
+	}
+
+	err = ch.Qos(options.prefetch, 0, false) // luckily enough stream queues does not support global QoS prefetch
 	if err != nil {
 		return fmt.Errorf("could not set QoS: %v", err)
 	}
@@ -173,32 +489,189 @@ func subscribe[T any](
 		return fmt.Errorf("could not consume messages: %v", err)
 	}
 
-	go func() {
-		defer ch.Close()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg, ok := <-msgs:
-				if !ok {
-					return
-				}
-				target, err := unmarshaller(msg.Body)
-				if err != nil {
-					fmt.Printf("could not unmarshal message: %v\n", err)
-					// TODO: check if we should nack here
-					continue
-				}
-				handler(target)
-				msg.Ack(false)
+	// requeues of classic queues and retries are published back on a channel of their own,
+	// the original delivery is only acknowledged once the broker confirmed the copy
+	confirmCh, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create confirm channel: %v", err)
+	}
+	err = confirmCh.Confirm(false)
+	if err != nil {
+		confirmCh.Close()
+		return fmt.Errorf("could not put channel in confirm mode: %v", err)
+	}
+
+	// the chain is built for every message, around a handler bound to the context of its span
+	handle := func(spanCtx context.Context, msg amqp.Delivery) AckType {
+		return Chain(func(msg amqp.Delivery) AckType {
+			target, err := unmarshaller(msg)
+			if err != nil {
+				// a payload that cannot be decoded now will not be decodable on redelivery either
+				fmt.Printf("could not unmarshal message: %v\n", err)
+				return NackDiscard
 			}
+			return handler(spanCtx, target)
+		}, options.middlewares...)(msg)
+	}
+
+	process := func(msg amqp.Delivery) {
+		spanCtx, span := tracing.Start(
+			tracing.ExtractHeaders(context.WithoutCancel(ctx), msg.Headers),
+			"consume "+queue.Name,
+			tracing.SpanKindConsumer,
+		)
+		span.SetAttribute("messaging.rabbitmq.routing_key", msg.RoutingKey)
+
+		ackType := handle(spanCtx, msg)
+		if ackType == NackRequeue && options.retryPolicy != nil {
+			// still sent to the retry queues while draining on shutdown
+			ackType = options.retryPolicy.retry(context.WithoutCancel(ctx), confirmCh, queue.Name, msg)
+		}
+		if ackType == NackRequeue && options.unlimitedRequeue {
+			// republished rather than requeued, quorum queues drop messages past their
+			// delivery limit otherwise
+			waitBeforeRequeue(ctx, deliveryCount(msg))
+			ackType = requeueCounted(context.WithoutCancel(ctx), confirmCh, queue.Name, msg)
 		}
+		ackType = guardRequeue(ackType, deliveryCount(msg))
+		if ackType == NackRequeue && queueType != QueueQuorum {
+			ackType = requeueCounted(context.WithoutCancel(ctx), confirmCh, queue.Name, msg)
+		}
+
+		span.SetAttribute("outcome", ackType.String())
+		if ackType != Ack {
+			span.SetError(fmt.Errorf("message settled with %s", ackType))
+		}
+		span.End()
+		acknowledge(msg, ackType)
+	}
+
+	go func() {
+		defer release()
+		defer ch.Close() // after the workers acknowledged what they were handed
+		defer confirmCh.Close()
+		dispatch(ctx, msgs, options.concurrency, options.prefetch, options.orderingKey, process)
 	}()
 
 	return nil
 
 }
 
+// acknowledge settles the delivery with the broker according to the handler's verdict.
+func acknowledge(msg amqp.Delivery, ackType AckType) {
+	var err error
+	switch ackType {
+	case Ack:
+		err = msg.Ack(false)
+	case NackRequeue:
+		err = msg.Nack(false, true)
+	default:
+		err = msg.Nack(false, false)
+	}
+	if err != nil {
+		fmt.Printf("could not acknowledge message: %v\n", err)
+	}
+}
+
+// guardRequeue turns a NackRequeue into a NackDiscard once the message has already been
+// delivered MaxRedeliveries times.
+func guardRequeue(ackType AckType, deliveries int) AckType {
+	if ackType == NackRequeue && deliveries >= MaxRedeliveries {
+		fmt.Printf("message redelivered %d times, discarding it\n", deliveries)
+		return NackDiscard
+	}
+	return ackType
+}
+
+// deliveryCount returns how many times the message was delivered before this attempt.
+// Quorum queues keep track of it in the x-delivery-count header, classic queues in the
+// x-redelivery-count header requeueCounted sets. Otherwise the broker only flags
+// redeliveries, so at best we know it was delivered at least once before.
+func deliveryCount(msg amqp.Delivery) int {
+	count, ok := intHeader(msg.Headers, "x-delivery-count")
+	if !ok {
+		count, ok = intHeader(msg.Headers, headerRedeliveryCount)
+	}
+	switch {
+	case ok:
+		return count
+	case msg.Redelivered:
+		return 1
+	}
+	return 0
+}
+
+func intHeader(headers amqp.Table, key string) (int, bool) {
+	switch v := headers[key].(type) {
+	case int64:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int:
+		return v, true
+	}
+	return 0, false
+}
+
+const (
+	requeueMinBackoff = 100 * time.Millisecond
+	requeueMaxBackoff = 30 * time.Second
+)
+
+// waitBeforeRequeue backs off exponentially with the number of requeues so far, a message
+// requeued without limit does not spin while e.g. the database is down. It returns early
+// once ctx is done, to requeue right away while shutting down.
+func waitBeforeRequeue(ctx context.Context, requeues int) {
+	backoff := requeueMinBackoff
+	for range min(requeues, 10) {
+		backoff = min(backoff*2, requeueMaxBackoff)
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// requeueCounted puts the message back at the tail of its classic queue with its requeue
+// count in a header, which the broker does not keep for classic queues, so guardRequeue
+// still stops a poison message there. The original delivery is acknowledged once the copy
+// is confirmed, and requeued by the broker otherwise.
+func requeueCounted(ctx context.Context, ch *amqp.Channel, queueName string, msg amqp.Delivery) AckType {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerRedeliveryCount] = int32(deliveryCount(msg) + 1)
+
+	err := publishAndConfirm(ctx, ch, "", queueName, deliveryPublishing(msg, headers))
+	if err != nil {
+		fmt.Printf("could not requeue message on %s: %v\n", queueName, err)
+		return NackRequeue
+	}
+	return Ack
+}
+
+// QueueExists checks for a queue without declaring it. The broker closes the channel of a
+// passive declare on a missing queue, the pool leaves such a channel out.
+func QueueExists(conn *Connection, queueName string) (bool, error) {
+	exists := true
+	err := conn.WithChannel(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclarePassive(queueName, false, false, false, false, nil)
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			exists = false
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
 func DeclareAndBindAMQP(
 	conn *amqp.Connection,
 	exchange,
@@ -206,6 +679,7 @@ func DeclareAndBindAMQP(
 	key string,
 	queueDurability QueueDurability,
 	queueType QueueType,
+	deadLetter *DeadLetterConfig, // optional, nil drops rejected messages
 ) (*amqp.Channel, amqp.Queue, error) {
 
 	ch, err := conn.Channel()
@@ -213,15 +687,14 @@ func DeclareAndBindAMQP(
 		return nil, amqp.Queue{}, fmt.Errorf("error while opening channel in declare and bind: %v", err)
 	}
 
+	spec := NewQueue(queueName, queueDurability, queueType, deadLetter)
 	queue, err := ch.QueueDeclare(
-		queueName,                       // name
-		queueDurability == QueueDurable, // durable
-		queueDurability != QueueDurable, // delete when unused
+		spec.Name,                       // name
+		spec.Durable,                    // durable
+		spec.AutoDelete,                 // delete when unused
 		queueDurability != QueueDurable, // exclusive
 		false,                           // noWait
-		amqp.Table{
-			"x-queue-type": queueType.String(),
-		}, // args
+		spec.Arguments,                  // args
 	)
 
 	if err != nil {
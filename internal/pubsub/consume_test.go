@@ -1,6 +1,13 @@
 package pubsub
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	amqpEncodeStreamMessage "github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+)
 
 func TestQueueTypeString(t *testing.T) {
 	tests := map[string]struct {
@@ -22,3 +29,119 @@ func TestQueueTypeString(t *testing.T) {
 		})
 	}
 }
+
+func TestDeliveryCount(t *testing.T) {
+	tests := map[string]struct {
+		input amqp.Delivery
+		want  int
+	}{
+		"first delivery": {
+			input: amqp.Delivery{},
+			want:  0,
+		},
+		"quorum queue redelivery": {
+			input: amqp.Delivery{Headers: amqp.Table{"x-delivery-count": int64(3)}, Redelivered: true},
+			want:  3,
+		},
+		"classic queue redelivery": {
+			input: amqp.Delivery{Redelivered: true},
+			want:  1,
+		},
+		"classic queue requeued with a count": {
+			input: amqp.Delivery{Headers: amqp.Table{headerRedeliveryCount: int32(4)}},
+			want:  4,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := deliveryCount(tc.input)
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGuardRequeue(t *testing.T) {
+	tests := map[string]struct {
+		ackType    AckType
+		deliveries int
+		want       AckType
+	}{
+		"ack is left untouched": {
+			ackType:    Ack,
+			deliveries: MaxRedeliveries,
+			want:       Ack,
+		},
+		"requeue below the limit": {
+			ackType:    NackRequeue,
+			deliveries: MaxRedeliveries - 1,
+			want:       NackRequeue,
+		},
+		"requeue at the limit is discarded": {
+			ackType:    NackRequeue,
+			deliveries: MaxRedeliveries,
+			want:       NackDiscard,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := guardRequeue(tc.ackType, tc.deliveries)
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+type tracedPayload struct{ traceParent string }
+
+func (p tracedPayload) TraceParent() string { return p.traceParent }
+
+func TestStreamTraceParent(t *testing.T) {
+	const fromProperties = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	const fromPayload = "00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01"
+
+	tests := map[string]struct {
+		message *amqpEncodeStreamMessage.Message
+		payload tracedPayload
+		want    string
+	}{
+		"application properties first": {
+			message: &amqpEncodeStreamMessage.Message{ApplicationProperties: map[string]interface{}{"traceparent": fromProperties}},
+			payload: tracedPayload{fromPayload},
+			want:    fromProperties,
+		},
+		"payload envelope of mqtt publishers": {
+			message: &amqpEncodeStreamMessage.Message{},
+			payload: tracedPayload{fromPayload},
+			want:    fromPayload,
+		},
+		"not traced": {
+			message: &amqpEncodeStreamMessage.Message{},
+			want:    "",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := streamTraceParent(tc.message, tc.payload)
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWaitBeforeRequeueStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	waitBeforeRequeue(ctx, 20) // would wait requeueMaxBackoff otherwise
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got %v, want an immediate return once ctx is done", elapsed)
+	}
+}
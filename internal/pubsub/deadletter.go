@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetterConfig routes messages rejected without requeue to Exchange instead of
+// dropping them. Queue arguments must match the ones already declared in the broker
+// (see topology.Topology), otherwise the declaration is refused.
+type DeadLetterConfig struct {
+	Exchange      string
+	RoutingKey    string // optional, the original routing key is kept when empty
+	DeliveryLimit int    // quorum queues only, 0 keeps the broker default
+}
+
+func (dl DeadLetterConfig) queueArgs(queueType QueueType) amqp.Table {
+	args := amqp.Table{
+		"x-dead-letter-exchange": dl.Exchange,
+	}
+	if dl.RoutingKey != "" {
+		args["x-dead-letter-routing-key"] = dl.RoutingKey
+	}
+	if queueType == QueueQuorum && dl.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = dl.DeliveryLimit
+	}
+	return args
+}
+
+// DeadLetter describes why and from where a message was dead-lettered.
+type DeadLetter struct {
+	Reason     string // rejected, expired, maxlen or delivery_limit
+	Queue      string // queue the message was dead-lettered from
+	RoutingKey string // routing key the message was originally published with
+}
+
+// ParseDeadLetter reads the x-death family of headers the broker adds when dead-lettering.
+// x-death lists the most recent death first: that one tells why the message was quarantined,
+// while the oldest one still carries the routing key it was originally published with
+// (unless a retry policy already recorded it in x-original-routing-key).
+func ParseDeadLetter(msg amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		RoutingKey: msg.RoutingKey,
+	}
+
+	if deaths, ok := msg.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if last, ok := deaths[0].(amqp.Table); ok {
+			dl.Reason, _ = last["reason"].(string)
+			dl.Queue, _ = last["queue"].(string)
+		}
+		if first, ok := deaths[len(deaths)-1].(amqp.Table); ok {
+			if keys, ok := first["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+				if key, ok := keys[0].(string); ok {
+					dl.RoutingKey = key
+				}
+			}
+		}
+	}
+
+	if reason, ok := msg.Headers["x-last-death-reason"].(string); ok {
+		dl.Reason = reason
+	}
+	if queue, ok := msg.Headers["x-last-death-queue"].(string); ok {
+		dl.Queue = queue
+	}
+	if key, ok := msg.Headers[headerOriginalRoutingKey].(string); ok {
+		dl.RoutingKey = key
+	}
+
+	return dl
+}
+
+// DeadLetterMessageID is the message id of Dedup[amqp.Delivery] for the quarantine queue. A
+// message routed to several queues and rejected by more than one of them is quarantined once
+// per queue, so the queue ParseDeadLetter tells it was dead-lettered from is part of the id,
+// rather than e.g. the retry queue it first expired in.
+func DeadLetterMessageID(msg amqp.Delivery) string {
+	if msg.MessageId == "" {
+		return ""
+	}
+	queue := ParseDeadLetter(msg).Queue
+	if queue == "" {
+		return msg.MessageId
+	}
+	return msg.MessageId + "@" + queue
+}
@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseDeadLetter(t *testing.T) {
+	tests := map[string]struct {
+		input amqp.Delivery
+		want  DeadLetter
+	}{
+		"no death headers": {
+			input: amqp.Delivery{RoutingKey: "sensor.AAD-1123.logs"},
+			want:  DeadLetter{RoutingKey: "sensor.AAD-1123.logs"},
+		},
+		"rejected with a dead-letter routing key": {
+			input: amqp.Delivery{
+				RoutingKey: "deadletter",
+				Headers: amqp.Table{
+					"x-last-death-reason": "rejected",
+					"x-last-death-queue":  "sensor.all.logs",
+					"x-death": []interface{}{
+						amqp.Table{
+							"reason":       "rejected",
+							"queue":        "sensor.all.logs",
+							"routing-keys": []interface{}{"sensor.AAD-1123.logs"},
+						},
+					},
+				},
+			},
+			want: DeadLetter{
+				Reason:     "rejected",
+				Queue:      "sensor.all.logs",
+				RoutingKey: "sensor.AAD-1123.logs",
+			},
+		},
+		"rejected after going through retry tiers": {
+			input: amqp.Delivery{
+				RoutingKey: "sensor.all.logs",
+				Headers: amqp.Table{
+					"x-original-routing-key": "sensor.AAD-1123.logs",
+					"x-death": []interface{}{
+						amqp.Table{
+							"reason":       "rejected",
+							"queue":        "sensor.all.logs",
+							"routing-keys": []interface{}{"sensor.all.logs"},
+						},
+						amqp.Table{
+							"reason":       "expired",
+							"queue":        "sensor.all.logs.retry.1s",
+							"routing-keys": []interface{}{"sensor.all.logs.retry.1s"},
+						},
+					},
+				},
+			},
+			want: DeadLetter{
+				Reason:     "rejected",
+				Queue:      "sensor.all.logs",
+				RoutingKey: "sensor.AAD-1123.logs",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := ParseDeadLetter(tc.input)
+			if tc.want != got {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeadLetterMessageID(t *testing.T) {
+	tests := map[string]struct {
+		input amqp.Delivery
+		want  string
+	}{
+		"without id": {
+			input: amqp.Delivery{Headers: amqp.Table{"x-last-death-queue": "sensor.all.logs"}},
+			want:  "",
+		},
+		"without death headers": {
+			input: amqp.Delivery{MessageId: "0190c1f3"},
+			want:  "0190c1f3",
+		},
+		"keyed by the queue it was dead-lettered from": {
+			input: amqp.Delivery{
+				MessageId: "0190c1f3",
+				Headers: amqp.Table{
+					"x-first-death-queue": "sensor.all.registry.created",
+					"x-last-death-queue":  "sensor.all.registry.created",
+					"x-death": []interface{}{
+						amqp.Table{"reason": "rejected", "queue": "sensor.all.registry.created"},
+					},
+				},
+			},
+			want: "0190c1f3@sensor.all.registry.created",
+		},
+		"rejected after going through retry tiers": {
+			input: amqp.Delivery{
+				MessageId: "0190c1f3",
+				Headers: amqp.Table{
+					"x-first-death-queue": "sensor.all.logs.retry.1s",
+					"x-last-death-queue":  "sensor.all.logs",
+					"x-death": []interface{}{
+						amqp.Table{"reason": "rejected", "queue": "sensor.all.logs"},
+						amqp.Table{"reason": "expired", "queue": "sensor.all.logs.retry.10s"},
+						amqp.Table{"reason": "expired", "queue": "sensor.all.logs.retry.1s"},
+					},
+				},
+			},
+			want: "0190c1f3@sensor.all.logs",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := DeadLetterMessageID(tc.input)
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
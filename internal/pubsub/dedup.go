@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DefaultDedupCapacity = 100_000
+	DefaultDedupTTL      = 10 * time.Minute
+
+	dedupStoreTimeout = 5 * time.Second
+)
+
+// DedupStore remembers the ids of the messages a consumer handled.
+type DedupStore interface {
+	Seen(ctx context.Context, messageID string) (bool, error)
+	Mark(ctx context.Context, messageID string) error
+}
+
+// Dedup acknowledges a message whose id is already in the store without handling it again,
+// and stores the id of every message the handler acknowledges. Messages without id are
+// always handled. Redeliveries arriving while the first delivery is still being handled
+// are not caught, with an ordering key they go to the same worker and never are.
+//
+// When the store fails the message is handled anyway: a duplicate is better than a loss.
+func Dedup[T any](queue string, store DedupStore, messageID func(T) string) Middleware[T] {
+	return func(handler func(T) AckType) func(T) AckType {
+		return func(msg T) AckType {
+			id := messageID(msg)
+			if id == "" {
+				return handler(msg)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), dedupStoreTimeout)
+			seen, err := store.Seen(ctx, id)
+			cancel()
+			if err != nil {
+				fmt.Printf("could not look up message %s of %s: %v\n", id, queue, err)
+				metricsDedupStoreErrors.WithLabelValues(queue).Inc()
+			}
+			if seen {
+				metricsDuplicatesDropped.WithLabelValues(queue).Inc()
+				return Ack
+			}
+
+			ackType := handler(msg)
+			if ackType != Ack {
+				return ackType // a redelivery must be handled again
+			}
+
+			ctx, cancel = context.WithTimeout(context.Background(), dedupStoreTimeout)
+			defer cancel()
+			err = store.Mark(ctx, id)
+			if err != nil {
+				fmt.Printf("could not store message %s of %s: %v\n", id, queue, err)
+				metricsDedupStoreErrors.WithLabelValues(queue).Inc()
+			}
+			return ackType
+		}
+	}
+}
+
+// DeliveryMessageID is the message id of Dedup[amqp.Delivery], the one every publish stamps.
+func DeliveryMessageID(msg amqp.Delivery) string {
+	return msg.MessageId
+}
+
+// MemoryDedupStore keeps the ids of up to capacity messages for ttl, dropping the least
+// recently handled ones first. It is lost on restart and not shared between instances, which
+// covers redeliveries after a channel or connection is lost.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // front is the most recently marked
+	entries map[string]*list.Element
+}
+
+type dedupEntry struct {
+	messageID string
+	expiresAt time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryDedupStore) Seen(ctx context.Context, messageID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[messageID]
+	if !ok {
+		return false, nil
+	}
+	if s.now().After(element.Value.(dedupEntry).expiresAt) {
+		s.order.Remove(element)
+		delete(s.entries, messageID)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(ctx context.Context, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := dedupEntry{messageID: messageID, expiresAt: s.now().Add(s.ttl)}
+	if element, ok := s.entries[messageID]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return nil
+	}
+	s.entries[messageID] = s.order.PushFront(entry)
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(dedupEntry).messageID)
+	}
+	return nil
+}
+
+func (s *MemoryDedupStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+var (
+	// metricsDuplicatesDropped counts messages acknowledged without handling, by queue
+	metricsDuplicatesDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pubsub_duplicates_dropped_total",
+			Help: "Total messages dropped as duplicates of messages already handled",
+		},
+		[]string{"queue"},
+	)
+
+	// metricsDedupStoreErrors counts failed lookups and marks of the dedup store, by queue
+	metricsDedupStoreErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pubsub_dedup_store_errors_total",
+			Help: "Total dedup store lookups and marks that failed",
+		},
+		[]string{"queue"},
+	)
+)
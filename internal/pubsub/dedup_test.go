@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryDedupStore(2, time.Minute)
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	seen := func(id string) bool {
+		got, err := store.Seen(ctx, id)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return got
+	}
+
+	store.Mark(ctx, "a")
+	store.Mark(ctx, "b")
+	if !seen("a") || !seen("b") || seen("c") {
+		t.Fatalf("got a %v, b %v, c %v, want a and b seen", seen("a"), seen("b"), seen("c"))
+	}
+
+	// a was marked before b, so it is the one evicted
+	store.Mark(ctx, "c")
+	if seen("a") || !seen("c") || store.Len() != 2 {
+		t.Fatalf("got a %v, c %v and %d ids, want a evicted for c", seen("a"), seen("c"), store.Len())
+	}
+
+	now = now.Add(2 * time.Minute)
+	if seen("b") || store.Len() != 1 {
+		t.Fatalf("got b seen with %d ids, want it expired", store.Len())
+	}
+}
+
+type failingDedupStore struct{}
+
+func (failingDedupStore) Seen(context.Context, string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func (failingDedupStore) Mark(context.Context, string) error {
+	return errors.New("connection refused")
+}
+
+func TestDedup(t *testing.T) {
+	tests := map[string]struct {
+		store      DedupStore
+		deliveries []amqp.Delivery
+		outcomes   []AckType
+		wantCalls  int
+	}{
+		"redelivery is dropped": {
+			store:      NewMemoryDedupStore(DefaultDedupCapacity, DefaultDedupTTL),
+			deliveries: []amqp.Delivery{{MessageId: "a"}, {MessageId: "a", Redelivered: true}},
+			outcomes:   []AckType{Ack},
+			wantCalls:  1,
+		},
+		"nacked message is handled again": {
+			store:      NewMemoryDedupStore(DefaultDedupCapacity, DefaultDedupTTL),
+			deliveries: []amqp.Delivery{{MessageId: "a"}, {MessageId: "a", Redelivered: true}},
+			outcomes:   []AckType{NackRequeue, Ack},
+			wantCalls:  2,
+		},
+		"messages without id are always handled": {
+			store:      NewMemoryDedupStore(DefaultDedupCapacity, DefaultDedupTTL),
+			deliveries: []amqp.Delivery{{}, {}},
+			outcomes:   []AckType{Ack, Ack},
+			wantCalls:  2,
+		},
+		"failing store lets messages through": {
+			store:      failingDedupStore{},
+			deliveries: []amqp.Delivery{{MessageId: "a"}, {MessageId: "a", Redelivered: true}},
+			outcomes:   []AckType{Ack, Ack},
+			wantCalls:  2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			handler := Chain(func(amqp.Delivery) AckType {
+				ackType := tc.outcomes[calls]
+				calls++
+				return ackType
+			}, Dedup("sensor.all.logs", tc.store, DeliveryMessageID))
+
+			for _, delivery := range tc.deliveries {
+				handler(delivery)
+			}
+			if calls != tc.wantCalls {
+				t.Fatalf("got %d calls, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// headerMessageType and headerSchemaVersion mark a message body as an Envelope. Being
+	// headers, they survive retries, dead-lettering and replays along with the body.
+	headerMessageType   = "x-message-type"
+	headerSchemaVersion = "x-schema-version"
+)
+
+// Producer names the service in the envelopes it publishes, services set it once in main.
+var Producer = filepath.Base(os.Args[0])
+
+// Envelope wraps the payload of a message whose type has a registered schema. The payload
+// is encoded with the same codec as the envelope, so it stays readable without the
+// envelope-aware decoders if ever needed.
+type Envelope struct {
+	Type      string
+	Version   int
+	MessageID string
+	Producer  string
+	Timestamp time.Time
+	Payload   []byte
+}
+
+// Upcaster turns the payload of a schema version into the payload of the next one.
+type Upcaster func(codec Codec, payload []byte) ([]byte, error)
+
+// Upcast builds the Upcaster of a conversion between the types of two schema versions, the
+// old type being kept around (e.g. SensorV1) for as long as producers may still send it.
+func Upcast[From, To any](convert func(From) To) Upcaster {
+	return func(codec Codec, payload []byte) ([]byte, error) {
+		from, err := Decode[From](codec, payload)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Marshal(convert(from))
+	}
+}
+
+type schema struct {
+	messageType string
+	version     int
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[reflect.Type]schema{}
+	upcasters = map[string]map[int]Upcaster{} // message type -> from version -> upcaster
+)
+
+// RegisterSchema makes T travel in an Envelope of the given message type and current schema
+// version. Publishers wrap values of T and consumers of T upcast older versions to it.
+func RegisterSchema[T any](messageType string, version int) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemas[reflect.TypeFor[T]()] = schema{messageType: messageType, version: version}
+}
+
+// RegisterUpcaster makes consumers accept fromVersion of the message type, by upcasting it
+// to fromVersion+1 (and further on with the upcasters of the next versions).
+func RegisterUpcaster(messageType string, fromVersion int, upcaster Upcaster) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	if upcasters[messageType] == nil {
+		upcasters[messageType] = map[int]Upcaster{}
+	}
+	upcasters[messageType][fromVersion] = upcaster
+}
+
+func schemaFor[T any]() (schema, bool) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	s, ok := schemas[reflect.TypeFor[T]()]
+	return s, ok
+}
+
+// newPublishing encodes val as the body of a message with a new message id, in an Envelope
+// when T has a schema.
+func newPublishing[T any](codec Codec, val T) (amqp.Publishing, error) {
+	body, err := codec.Marshal(val)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("not able to encode value: %v", err)
+	}
+
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
+		Headers:     amqp.Table{},
+		MessageId:   NewMessageID(),
+		Body:        body,
+	}
+
+	s, ok := schemaFor[T]()
+	if !ok {
+		return msg, nil
+	}
+
+	envelope := Envelope{
+		Type:      s.messageType,
+		Version:   s.version,
+		MessageID: msg.MessageId,
+		Producer:  Producer,
+		Timestamp: time.Now().UTC(),
+		Payload:   body,
+	}
+	msg.Body, err = codec.Marshal(envelope)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("not able to encode envelope: %v", err)
+	}
+	msg.Headers[headerMessageType] = envelope.Type
+	msg.Headers[headerSchemaVersion] = int32(envelope.Version)
+	msg.Type = envelope.Type
+	msg.AppId = envelope.Producer
+	msg.Timestamp = envelope.Timestamp
+	return msg, nil
+}
+
+// DecodeMessage decodes a message body into a new T with the codec of its content type. A
+// body in an Envelope is opened and its payload upcast to the schema version of T, a bare
+// body (from a producer that predates envelopes) is decoded as it is.
+func DecodeMessage[T any](contentType string, headers amqp.Table, data []byte) (T, error) {
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		var target T
+		return target, err
+	}
+	return decodeMessage[T](codec, headers, data)
+}
+
+func decodeMessage[T any](codec Codec, headers amqp.Table, data []byte) (T, error) {
+	if _, ok := headers[headerSchemaVersion]; !ok {
+		return Decode[T](codec, data)
+	}
+
+	var target T
+	envelope, err := Decode[Envelope](codec, data)
+	if err != nil {
+		return target, fmt.Errorf("could not decode envelope: %v", err)
+	}
+	payload, err := upcast[T](codec, envelope)
+	if err != nil {
+		return target, err
+	}
+	return Decode[T](codec, payload)
+}
+
+// upcast brings the envelope payload to the schema version of T. Payloads of a newer version
+// are decoded as they are, which works as long as fields are only added: deploy consumers
+// before producers all the same.
+func upcast[T any](codec Codec, envelope Envelope) ([]byte, error) {
+	s, ok := schemaFor[T]()
+	if !ok {
+		// e.g. a DTO of just the fields a consumer cares about
+		return envelope.Payload, nil
+	}
+	if envelope.Type != s.messageType {
+		return nil, fmt.Errorf("got message type %q, want %q", envelope.Type, s.messageType)
+	}
+
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	payload := envelope.Payload
+	for version := envelope.Version; version < s.version; version++ {
+		upcaster, ok := upcasters[s.messageType][version]
+		if !ok {
+			return nil, fmt.Errorf("no upcaster from version %d of %q", version, s.messageType)
+		}
+		var err error
+		payload, err = upcaster(codec, payload)
+		if err != nil {
+			return nil, fmt.Errorf("could not upcast version %d of %q: %v", version, s.messageType, err)
+		}
+	}
+	return payload, nil
+}
+
+// NewMessageID returns a random id for a message, for consumers to recognize its redeliveries.
+func NewMessageID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
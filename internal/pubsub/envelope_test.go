@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// three versions of the same message, as they would look during a rolling upgrade
+type sensorV1 struct {
+	SerialNumber string
+}
+
+type sensorV2 struct {
+	SerialNumber    string
+	SampleFrequency float64
+}
+
+type sensorV3 struct {
+	SerialNumber    string
+	SampleFrequency float64
+	FirmwareVersion string
+}
+
+type logV1 struct {
+	SerialNumber string
+}
+
+func init() {
+	RegisterSchema[sensorV1]("test.sensor", 1)
+	RegisterSchema[sensorV2]("test.sensor", 2)
+	RegisterSchema[sensorV3]("test.sensor", 3)
+	RegisterSchema[logV1]("test.log", 1)
+	RegisterUpcaster("test.sensor", 1, Upcast(func(old sensorV1) sensorV2 {
+		return sensorV2{SerialNumber: old.SerialNumber, SampleFrequency: 1}
+	}))
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := map[string]struct {
+		publish func(codec Codec) (amqp.Publishing, error)
+		want    sensorV2
+		wantErr bool
+	}{
+		"same version": {
+			publish: func(codec Codec) (amqp.Publishing, error) {
+				return newPublishing(codec, sensorV2{SerialNumber: "AAD-1123", SampleFrequency: 100})
+			},
+			want: sensorV2{SerialNumber: "AAD-1123", SampleFrequency: 100},
+		},
+		"older version is upcast": {
+			publish: func(codec Codec) (amqp.Publishing, error) {
+				return newPublishing(codec, sensorV1{SerialNumber: "AAD-1123"})
+			},
+			want: sensorV2{SerialNumber: "AAD-1123", SampleFrequency: 1},
+		},
+		"newer version keeps the known fields": {
+			publish: func(codec Codec) (amqp.Publishing, error) {
+				return newPublishing(codec, sensorV3{SerialNumber: "AAD-1123", SampleFrequency: 100, FirmwareVersion: "1.2.0"})
+			},
+			want: sensorV2{SerialNumber: "AAD-1123", SampleFrequency: 100},
+		},
+		"bare body of a producer without envelopes": {
+			publish: func(codec Codec) (amqp.Publishing, error) {
+				body, err := codec.Marshal(sensorV2{SerialNumber: "AAD-1123", SampleFrequency: 100})
+				return amqp.Publishing{Body: body}, err
+			},
+			want: sensorV2{SerialNumber: "AAD-1123", SampleFrequency: 100},
+		},
+		"other message type": {
+			publish: func(codec Codec) (amqp.Publishing, error) {
+				return newPublishing(codec, logV1{SerialNumber: "AAD-1123"})
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+			t.Run(name+"/"+codec.ContentType(), func(t *testing.T) {
+				msg, err := tc.publish(codec)
+				if err != nil {
+					t.Fatalf("unexpected error publishing: %v", err)
+				}
+				got, err := DecodeMessage[sensorV2](codec.ContentType(), msg.Headers, msg.Body)
+				if tc.wantErr {
+					if err == nil {
+						t.Fatalf("got %v, want an error", got)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error decoding: %v", err)
+				}
+				if tc.want != got {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeMessageWithoutUpcaster(t *testing.T) {
+	msg, err := newPublishing(GobCodec{}, sensorV2{SerialNumber: "AAD-1123"})
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+
+	// there is no upcaster from version 2 to 3
+	_, err = DecodeMessage[sensorV3](ContentTypeGob, msg.Headers, msg.Body)
+	if err == nil {
+		t.Fatalf("got nil, want an error")
+	}
+}
+
+func TestNewPublishingStampsEnvelope(t *testing.T) {
+	msg, err := newPublishing(GobCodec{}, sensorV2{SerialNumber: "AAD-1123"})
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+
+	envelope, err := Decode[Envelope](GobCodec{}, msg.Body)
+	if err != nil {
+		t.Fatalf("unexpected error decoding envelope: %v", err)
+	}
+	if envelope.Type != "test.sensor" || envelope.Version != 2 || envelope.Producer != Producer {
+		t.Fatalf("got %+v, want version 2 of test.sensor by %s", envelope, Producer)
+	}
+	if envelope.MessageID == "" || envelope.MessageID != msg.MessageId || envelope.Timestamp.IsZero() {
+		t.Fatalf("got %+v, want a message id and timestamp matching %q", envelope, msg.MessageId)
+	}
+
+	// types without schema go bare, still with an id
+	msg, err = newPublishing(GobCodec{}, struct{ SerialNumber string }{"AAD-1123"})
+	if err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+	if _, ok := msg.Headers[headerSchemaVersion]; ok || msg.MessageId == "" {
+		t.Fatalf("got %+v, want a bare message with a message id", msg)
+	}
+}
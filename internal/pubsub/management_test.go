@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestManagementApply(t *testing.T) {
+	type request struct {
+		method, path string
+		body         map[string]any
+	}
+	var got []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "guest" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() == "/api/definitions" {
+			w.Write([]byte(`{"exchanges": [{"name": "iot", "vhost": "/", "type": "topic", "durable": true}]}`))
+			return
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		got = append(got, request{r.Method, r.URL.EscapedPath(), body})
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	m, err := NewManagement("http://guest:secret@" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	ctx := context.Background()
+
+	live, err := m.Definitions(ctx)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	drifts := Diff(testTopology(), live)
+	for _, drift := range drifts {
+		err := m.Apply(ctx, drift)
+		if err != nil {
+			t.Fatalf("got %v applying %v, want nil", err, drift)
+		}
+	}
+
+	paths := make([]string, len(got))
+	for i, r := range got {
+		paths[i] = r.method + " " + r.path
+	}
+	wantPaths := []string{
+		"PUT /api/queues/%2F/sensor.all.logs",
+		"POST /api/bindings/%2F/e/iot/q/sensor.all.logs",
+		"PUT /api/policies/%2F/logs",
+	}
+	if !slices.Equal(wantPaths, paths) {
+		t.Fatalf("got %q, want %q", paths, wantPaths)
+	}
+	if got[1].body["routing_key"] != "sensor.*.logs.#" {
+		t.Fatalf("got binding %v, want routing key sensor.*.logs.#", got[1].body)
+	}
+	if got[2].body["apply-to"] != "queues" {
+		t.Fatalf("got policy %v, want it applied to queues", got[2].body)
+	}
+
+	err = m.Apply(ctx, Drift{Object: "exchange", Name: "iot.legacy", Change: DriftUnexpected})
+	if !errors.Is(err, ErrNotApplicable) {
+		t.Fatalf("got %v, want %v", err, ErrNotApplicable)
+	}
+}
+
+func TestManagementError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"not_authorised"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	m, err := NewManagement(server.URL)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	_, err = m.Definitions(context.Background())
+	if err == nil {
+		t.Fatalf("got nil, want an error")
+	}
+}
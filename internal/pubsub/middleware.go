@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Middleware wraps a handler with behaviour every consumer wants, whatever its payload.
+// Middleware[amqp.Delivery] given to WithMiddleware wraps the raw delivery instead, decoding
+// included, for middleware that needs headers or routing keys.
+type Middleware[T any] func(handler func(T) AckType) func(T) AckType
+
+// Chain wraps handler with the middlewares, the first one being the outermost, e.g.
+//
+//	pubsub.Chain(handlerLogs(), pubsub.Metrics[routing.SensorLog](queue), pubsub.Recover[routing.SensorLog](queue))
+//
+// counts the messages whose handler panicked among the discarded ones.
+func Chain[T any](handler func(T) AckType, middlewares ...Middleware[T]) func(T) AckType {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+func (ackType AckType) String() string {
+	switch ackType {
+	case Ack:
+		return "ack"
+	case NackDiscard:
+		return "nack_discard"
+	case NackRequeue:
+		return "nack_requeue"
+	}
+	return fmt.Sprintf("AckType(%d)", int(ackType))
+}
+
+// Recover turns a panicking handler into a NackDiscard, so a message that makes the handler
+// panic is dead-lettered instead of taking the whole service down with it.
+func Recover[T any](queue string) Middleware[T] {
+	return func(handler func(T) AckType) func(T) AckType {
+		return func(msg T) (ackType AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Printf("handler of %s panicked: %v\n%s", queue, r, debug.Stack())
+					metricsHandlerPanics.WithLabelValues(queue).Inc()
+					ackType = NackDiscard
+				}
+			}()
+			return handler(msg)
+		}
+	}
+}
+
+// Logging logs the outcome and duration of every message, acks at debug level and nacks at
+// warn level. Raw deliveries are logged along with their routing key and message id.
+func Logging[T any](logger *slog.Logger, queue string) Middleware[T] {
+	return func(handler func(T) AckType) func(T) AckType {
+		return func(msg T) AckType {
+			start := time.Now()
+			ackType := handler(msg)
+
+			level := slog.LevelDebug
+			if ackType != Ack {
+				level = slog.LevelWarn
+			}
+			attrs := []any{
+				slog.String("queue", queue),
+				slog.String("outcome", ackType.String()),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if delivery, ok := any(msg).(amqp.Delivery); ok {
+				attrs = append(attrs,
+					slog.String("routing_key", delivery.RoutingKey),
+					slog.String("message_id", delivery.MessageId),
+					slog.Int("delivery_count", deliveryCount(delivery)),
+				)
+			}
+			logger.Log(context.Background(), level, "message handled", attrs...)
+			return ackType
+		}
+	}
+}
+
+// Metrics counts and times the messages of a queue by outcome.
+func Metrics[T any](queue string) Middleware[T] {
+	return func(handler func(T) AckType) func(T) AckType {
+		return func(msg T) AckType {
+			start := time.Now()
+			ackType := handler(msg)
+			outcome := ackType.String()
+			metricsHandled.WithLabelValues(queue, outcome).Inc()
+			metricsHandlerDuration.WithLabelValues(queue, outcome).Observe(time.Since(start).Seconds())
+			return ackType
+		}
+	}
+}
+
+// Timeout gives up on a handler still running after timeout and requeues its message. The
+// handler is not stopped, it runs to the end and its verdict is dropped, so only handlers
+// that can safely see the same message twice should be given one. A panic of the handler is
+// raised again to the caller, for Recover to see.
+func Timeout[T any](queue string, timeout time.Duration) Middleware[T] {
+	type result struct {
+		ackType  AckType
+		panicked bool
+		value    any
+	}
+	return func(handler func(T) AckType) func(T) AckType {
+		return func(msg T) AckType {
+			done := make(chan result, 1) // the handler may finish long after nobody waits for it
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						done <- result{panicked: true, value: r}
+					}
+				}()
+				done <- result{ackType: handler(msg)}
+			}()
+
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case r := <-done:
+				if r.panicked {
+					panic(r.value)
+				}
+				return r.ackType
+			case <-timer.C:
+				fmt.Printf("handler of %s timed out after %v, requeuing message\n", queue, timeout)
+				metricsHandlerTimeouts.WithLabelValues(queue).Inc()
+				return NackRequeue
+			}
+		}
+	}
+}
+
+var (
+	// metricsHandled counts handled messages by queue and outcome
+	metricsHandled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pubsub_messages_handled_total",
+			Help: "Total messages handled by consumers",
+		},
+		[]string{"queue", "outcome"}, // outcome: ack/nack_discard/nack_requeue
+	)
+
+	// metricsHandlerDuration tracks the time handlers take by queue and outcome
+	metricsHandlerDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pubsub_handler_duration_seconds",
+			Help:    "Time taken by consumers to handle a message",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15), // 1ms to ~16s
+		},
+		[]string{"queue", "outcome"},
+	)
+
+	// metricsHandlerPanics counts handlers recovered from a panic by queue
+	metricsHandlerPanics = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pubsub_handler_panics_total",
+			Help: "Total handler panics recovered",
+		},
+		[]string{"queue"},
+	)
+
+	// metricsHandlerTimeouts counts handlers given up on by queue
+	metricsHandlerTimeouts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pubsub_handler_timeouts_total",
+			Help: "Total handlers that ran past their timeout",
+		},
+		[]string{"queue"},
+	)
+)
@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware[int] {
+		return func(handler func(int) AckType) func(int) AckType {
+			return func(msg int) AckType {
+				calls = append(calls, name)
+				return handler(msg)
+			}
+		}
+	}
+
+	handler := Chain(func(int) AckType {
+		calls = append(calls, "handler")
+		return Ack
+	}, trace("outer"), trace("inner"))
+	handler(1)
+
+	want := []string{"outer", "inner", "handler"}
+	if len(calls) != len(want) {
+		t.Fatalf("got %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("got %v, want %v", calls, want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		handler     func(int) AckType
+		middlewares []Middleware[int]
+		want        AckType
+	}{
+		"recover discards a panicking handler": {
+			handler:     func(int) AckType { panic("nil sensor") },
+			middlewares: []Middleware[int]{Recover[int]("test")},
+			want:        NackDiscard,
+		},
+		"recover leaves other verdicts as they are": {
+			handler:     func(int) AckType { return NackRequeue },
+			middlewares: []Middleware[int]{Recover[int]("test")},
+			want:        NackRequeue,
+		},
+		"timeout requeues a slow handler": {
+			handler:     func(int) AckType { time.Sleep(time.Second); return Ack },
+			middlewares: []Middleware[int]{Timeout[int]("test", 10*time.Millisecond)},
+			want:        NackRequeue,
+		},
+		"timeout passes a panic on to recover": {
+			handler:     func(int) AckType { panic("nil sensor") },
+			middlewares: []Middleware[int]{Recover[int]("test"), Timeout[int]("test", time.Second)},
+			want:        NackDiscard,
+		},
+		"metrics keep the verdict": {
+			handler:     func(int) AckType { return NackDiscard },
+			middlewares: []Middleware[int]{Metrics[int]("test")},
+			want:        NackDiscard,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := Chain(tc.handler, tc.middlewares...)(1)
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOffsetCommitEvery    = 50
+	DefaultOffsetCommitInterval = 5 * time.Second
+
+	streamRetryMinBackoff = 500 * time.Millisecond
+	streamRetryMaxBackoff = 30 * time.Second
+)
+
+// offsetCommitter stores the offset of the last handled message of a stream consumer, in
+// batches since every store is a round trip to the broker. Whatever was handled after the
+// last store is read again after a restart or a promotion, so handlers must cope with
+// seeing a message twice.
+type offsetCommitter struct {
+	mu         sync.Mutex
+	every      int
+	interval   time.Duration
+	pending    int
+	lastCommit time.Time
+
+	// of the last handled message, for run to store once the stream goes quiet
+	offset int64
+	store  func(offset int64) error
+}
+
+func newOffsetCommitter(every int, interval time.Duration) *offsetCommitter {
+	return &offsetCommitter{
+		every:      every,
+		interval:   interval,
+		lastCommit: time.Now(),
+	}
+}
+
+// handled records that the message at offset is done with, and stores it when due. A failed
+// store is tried again with the next message.
+func (c *offsetCommitter) handled(store func(offset int64) error, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending++
+	c.offset = offset
+	c.store = store
+	if c.pending < c.every && time.Since(c.lastCommit) < c.interval {
+		return
+	}
+	c.commit()
+}
+
+// run stores the offset of the last handled message every interval while some are pending,
+// since handled only stores when the next message comes, and a last time once ctx is done.
+func (c *offsetCommitter) run(ctx context.Context) {
+	ticker := time.NewTicker(max(c.interval, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-ctx.Done():
+			c.flush()
+			return
+		}
+	}
+}
+
+func (c *offsetCommitter) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending > 0 {
+		c.commit()
+	}
+}
+
+// commit must be called with mu held.
+func (c *offsetCommitter) commit() {
+	err := c.store(c.offset)
+	if err != nil {
+		fmt.Printf("could not store stream offset %d: %v\n", c.offset, err)
+		return
+	}
+	c.pending = 0
+	c.lastCommit = time.Now()
+}
+
+// StreamDelivery is a decoded stream message handed to handlers that store offsets themselves.
+type StreamDelivery[T any] struct {
+	Body   T
+	Stream string // the partition, for super streams
+	Offset int64
+
+	ctx   context.Context // carries the consume span of the message
+	store func(offset int64) error
+}
+
+// Context carries the span the message is handled under, for handlers to start theirs from.
+func (d StreamDelivery[T]) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// Commit stores the offset of the delivery for its stream, marking it and everything before
+// it in the stream as handled.
+func (d StreamDelivery[T]) Commit() error {
+	return d.store(d.Offset)
+}
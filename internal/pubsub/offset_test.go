@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOffsetCommitter(t *testing.T) {
+	tests := map[string]struct {
+		every    int
+		interval time.Duration
+		storeErr error
+		handled  int
+		want     []int64
+	}{
+		"stores every n messages": {
+			every:    3,
+			interval: time.Hour,
+			handled:  7,
+			want:     []int64{2, 5},
+		},
+		"stores every message once the interval went by": {
+			every:    100,
+			interval: 0,
+			handled:  3,
+			want:     []int64{0, 1, 2},
+		},
+		"retries a failed store with the next message": {
+			every:    2,
+			interval: time.Hour,
+			storeErr: errors.New("broker unavailable"),
+			handled:  4,
+			want:     []int64{1, 2, 3},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			committer := newOffsetCommitter(tc.every, tc.interval)
+			var stored []int64
+			store := func(offset int64) error {
+				stored = append(stored, offset)
+				return tc.storeErr
+			}
+			for offset := range tc.handled {
+				committer.handled(store, int64(offset))
+			}
+			if len(stored) != len(tc.want) {
+				t.Fatalf("got %v, want %v", stored, tc.want)
+			}
+			for i := range stored {
+				if stored[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", stored, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOffsetCommitterFlush(t *testing.T) {
+	committer := newOffsetCommitter(100, time.Hour)
+	var stored []int64
+	store := func(offset int64) error {
+		stored = append(stored, offset)
+		return nil
+	}
+
+	committer.flush()
+	for offset := range 3 {
+		committer.handled(store, int64(offset))
+	}
+	committer.flush()
+	committer.flush()
+
+	if len(stored) != 1 || stored[0] != 2 {
+		t.Fatalf("got %v, want [2]", stored)
+	}
+}
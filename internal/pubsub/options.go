@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SubscribeOption tunes how SubscribeJSON, SubscribeGob and SubscribeDelivery declare
+// their queue and consume from it.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	deadLetter  *DeadLetterConfig
+	retryPolicy *RetryPolicy
+	bindingKeys []string
+	middlewares []Middleware[amqp.Delivery]
+	prefetch    int
+	concurrency int
+	orderingKey func(amqp.Delivery) string
+
+	unlimitedRequeue bool
+}
+
+func newSubscribeOptions(opts ...SubscribeOption) subscribeOptions {
+	options := subscribeOptions{
+		prefetch:    DefaultPrefetch,
+		concurrency: 1,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithDeadLetter declares the queue with a dead-letter exchange so NackDiscard (and, for
+// quorum queues, messages past the delivery limit) end up there instead of being dropped.
+func WithDeadLetter(deadLetter DeadLetterConfig) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deadLetter = &deadLetter
+	}
+}
+
+// WithRetryPolicy routes messages answered with NackRequeue through delayed retry queues
+// instead of requeuing them right away.
+func WithRetryPolicy(retryPolicy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retryPolicy = &retryPolicy
+	}
+}
+
+// WithoutRequeueLimit keeps requeuing messages answered with NackRequeue, with backoff,
+// instead of discarding them after MaxRedeliveries. It is meant for last-resort queues such
+// as the dead-letter quarantine, whose messages have nowhere else to go.
+func WithoutRequeueLimit() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.unlimitedRequeue = true
+	}
+}
+
+// WithBindingKeys binds the queue with more keys than the one it is subscribed with, for
+// consumers of a few routing keys that no single pattern matches without catching others.
+func WithBindingKeys(keys ...string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.bindingKeys = append(o.bindingKeys, keys...)
+	}
+}
+
+// WithMiddleware wraps the handling of every raw delivery, decoding included, the first
+// middleware being the outermost. Middleware of the decoded message goes through Chain.
+func WithMiddleware(middlewares ...Middleware[amqp.Delivery]) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithPrefetch sets how many deliveries the broker sends ahead of their acknowledgement. It
+// should be at least the concurrency, or workers sit idle.
+func WithPrefetch(prefetch int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = max(prefetch, 1)
+	}
+}
+
+// WithConcurrency handles that many deliveries at once instead of one after the other, which
+// gives up on the queue order unless WithOrderingKey is set too.
+func WithConcurrency(workers int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = max(workers, 1)
+	}
+}
+
+// WithOrderingKey keeps deliveries of the same key, e.g. the serial number out of the routing
+// key, in order on a single worker when consuming with WithConcurrency.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// StreamOption tunes how SubscribeStreamJSON, SubscribeStream and SubscribeStreamDecoder
+// consume from a stream.
+type StreamOption func(*streamOptions)
+
+type streamOptions struct {
+	commitEvery    int
+	commitInterval time.Duration
+	maxLengthGB    int64
+}
+
+func newStreamOptions(opts ...StreamOption) streamOptions {
+	options := streamOptions{
+		commitEvery:    DefaultOffsetCommitEvery,
+		commitInterval: DefaultOffsetCommitInterval,
+		maxLengthGB:    DefaultStreamMaxLengthGB,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithOffsetCommit stores the consumer offset once every messages were handled or interval
+// went by since the last store, whichever comes first.
+func WithOffsetCommit(every int, interval time.Duration) StreamOption {
+	return func(o *streamOptions) {
+		o.commitEvery = every
+		o.commitInterval = interval
+	}
+}
+
+// WithStreamMaxLength declares the stream, when it does not exist yet, bounded to gb.
+func WithStreamMaxLength(gb int64) StreamOption {
+	return func(o *streamOptions) {
+		o.maxLengthGB = gb
+	}
+}
@@ -1,27 +1,20 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"fmt"
+	"strings"
 
+	"github.com/iferdel/sensor-data-streaming-server/internal/tracing"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // publishers do not create queues since they work directly with exhances withot knowing even about queues
-func PublishGob[T any](ctx context.Context, ch *amqp.Channel, exchange, key string, val T) error {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(val)
+func Publish[T any](ctx context.Context, ch *amqp.Channel, exchange, key string, codec Codec, val T) error {
+	publishMsg, err := newPublishing(codec, val)
 	if err != nil {
-		return fmt.Errorf("not able to encode value: %v", err)
-	}
-
-	publishMsg := amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        buffer.Bytes(),
+		return err
 	}
+	tracing.InjectHeaders(ctx, publishMsg.Headers)
 
 	return ch.PublishWithContext(
 		ctx,
@@ -32,3 +25,52 @@ func PublishGob[T any](ctx context.Context, ch *amqp.Channel, exchange, key stri
 		publishMsg,
 	)
 }
+
+func PublishGob[T any](ctx context.Context, ch *amqp.Channel, exchange, key string, val T) error {
+	return Publish(ctx, ch, exchange, key, GobCodec{}, val)
+}
+
+// NewRepublishing is an already encoded message to publish again, e.g. when replaying a dead
+// letter through a ConfirmPublisher. The headers added by the broker on dead-lettering, the
+// retry attempt and the requeue counts are dropped so that, if the message is rejected once
+// more, it is requeued up to MaxRedeliveries times, goes through every retry tier again and
+// is quarantined as a fresh dead letter. It gets a new message id, a replay is meant to be
+// handled again.
+func NewRepublishing(contentType string, headers amqp.Table, body []byte) amqp.Publishing {
+	cleanHeaders := amqp.Table{}
+	for k, v := range headers {
+		switch {
+		case k == "x-death", k == headerRetryAttempt, k == headerRedeliveryCount, k == "x-delivery-count":
+			continue
+		case strings.HasPrefix(k, "x-first-death-"), strings.HasPrefix(k, "x-last-death-"):
+			continue
+		}
+		cleanHeaders[k] = normalizeField(v)
+	}
+
+	return amqp.Publishing{
+		ContentType: contentType,
+		Headers:     cleanHeaders,
+		MessageId:   NewMessageID(),
+		Body:        body,
+	}
+}
+
+// normalizeField turns nested maps (e.g. headers that went through a JSON round trip)
+// back into amqp.Table, the only map type the client accepts as a header value.
+func normalizeField(v interface{}) interface{} {
+	switch fv := v.(type) {
+	case map[string]interface{}:
+		table := amqp.Table{}
+		for k, nested := range fv {
+			table[k] = normalizeField(nested)
+		}
+		return table
+	case []interface{}:
+		for i, nested := range fv {
+			fv[i] = normalizeField(nested)
+		}
+		return fv
+	}
+	return v
+}
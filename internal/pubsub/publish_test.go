@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestNewRepublishing(t *testing.T) {
+	tests := map[string]struct {
+		headers amqp.Table
+	}{
+		"as delivered": {
+			headers: amqp.Table{
+				"x-delivery-count":    int64(MaxRedeliveries),
+				headerRedeliveryCount: int32(MaxRedeliveries),
+				headerRetryAttempt:    int32(3),
+				"x-death":             []any{amqp.Table{"queue": "sensor.all.logs", "count": int64(1)}},
+				"x-first-death-queue": "sensor.all.logs",
+				"x-last-death-reason": "rejected",
+				"traceparent":         "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				headerMessageType:     "sensor.log",
+			},
+		},
+		"stored as json": {
+			headers: amqp.Table{
+				"x-delivery-count":    float64(MaxRedeliveries),
+				headerRedeliveryCount: float64(MaxRedeliveries),
+				"x-death":             []any{map[string]any{"queue": "sensor.all.logs", "count": float64(1)}},
+				"x-first-death-queue": "sensor.all.logs",
+				"traceparent":         "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				headerMessageType:     "sensor.log",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			msg := amqp.Delivery{MessageId: "original", Headers: tc.headers}
+			got := NewRepublishing("application/json", msg.Headers, []byte(`{}`))
+
+			want := amqp.Table{
+				"traceparent":     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				headerMessageType: "sensor.log",
+			}
+			if len(got.Headers) != len(want) {
+				t.Fatalf("got %v, want %v", got.Headers, want)
+			}
+			for k, v := range want {
+				if got.Headers[k] != v {
+					t.Fatalf("got %v, want %v", got.Headers, want)
+				}
+			}
+			// a replay starts over rather than being dropped on its first failure
+			if deliveries := deliveryCount(amqp.Delivery{Headers: got.Headers}); deliveries != 0 {
+				t.Fatalf("got %d deliveries, want 0", deliveries)
+			}
+			if got.MessageId == "" || got.MessageId == msg.MessageId {
+				t.Fatalf("got message id %q, want a new one", got.MessageId)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	headerRetryAttempt       = "x-retry-attempt"
+	headerOriginalRoutingKey = "x-original-routing-key"
+)
+
+// RetryPolicy delays redelivery of messages the handler answered with NackRequeue, instead of
+// putting them straight back on the queue while e.g. Postgres is still down.
+// Each delay is a tier: a queue whose messages expire after that delay back into the original
+// queue. Once every tier was tried the message is discarded, hence dead-lettered if configured.
+type RetryPolicy struct {
+	Delays []time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Delays: []time.Duration{1 * time.Second, 10 * time.Second, 60 * time.Second},
+}
+
+// Queues are the retry queues of a queue, one per tier. Retry queues have no consumers,
+// expired messages are dead-lettered through the default exchange, which routes by queue name.
+func (rp RetryPolicy) Queues(queueName string, queueDurability QueueDurability) []Queue {
+	queues := make([]Queue, 0, len(rp.Delays))
+	for _, delay := range rp.Delays {
+		queues = append(queues, Queue{
+			Name:    retryQueueName(queueName, delay),
+			Durable: queueDurability == QueueDurable,
+			Arguments: amqp.Table{
+				"x-queue-type":              QueueClassic.String(),
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		})
+	}
+	return queues
+}
+
+func (rp RetryPolicy) declare(ch *amqp.Channel, queueName string, queueDurability QueueDurability) error {
+	for _, queue := range rp.Queues(queueName, queueDurability) {
+		_, err := ch.QueueDeclare(
+			queue.Name,       // name
+			queue.Durable,    // durable
+			queue.AutoDelete, // delete when unused
+			false,            // exclusive
+			false,            // noWait
+			queue.Arguments,  // args
+		)
+		if err != nil {
+			return fmt.Errorf("could not declare retry queue %s: %v", queue.Name, err)
+		}
+	}
+	return nil
+}
+
+// retry parks the message in the next retry tier and tells how the original delivery must
+// be settled: Ack once the broker confirmed it parked, NackDiscard when tiers are exhausted,
+// and NackRequeue if it could not be parked at all. ch must be in confirm mode.
+func (rp RetryPolicy) retry(ctx context.Context, ch *amqp.Channel, queueName string, msg amqp.Delivery) AckType {
+	attempt := retryAttempt(msg)
+	if attempt >= len(rp.Delays) {
+		fmt.Printf("message failed after %d retries, discarding it\n", attempt)
+		return NackDiscard
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerRetryAttempt] = int32(attempt + 1)
+	if _, ok := headers[headerOriginalRoutingKey]; !ok {
+		headers[headerOriginalRoutingKey] = msg.RoutingKey
+	}
+
+	err := publishAndConfirm(
+		ctx,
+		ch,
+		"", // default exchange, routes straight to the retry queue
+		retryQueueName(queueName, rp.Delays[attempt]),
+		deliveryPublishing(msg, headers),
+	)
+	if err != nil {
+		fmt.Printf("could not publish message to retry queue: %v\n", err)
+		return NackRequeue
+	}
+	return Ack
+}
+
+// deliveryPublishing copies a delivery to publish it again, with headers instead of its own.
+func deliveryPublishing(msg amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  msg.DeliveryMode,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		Timestamp:     msg.Timestamp,
+		Type:          msg.Type,
+		AppId:         msg.AppId,
+		Body:          msg.Body,
+	}
+}
+
+// retryAttempt tells how many retry tiers the message already went through.
+func retryAttempt(msg amqp.Delivery) int {
+	switch attempt := msg.Headers[headerRetryAttempt].(type) {
+	case int32:
+		return int(attempt)
+	case int64:
+		return int(attempt)
+	case int:
+		return attempt
+	}
+	return 0
+}
+
+// retryQueueName follows the queue naming, e.g. sensor.all.logs.retry.10s
+func retryQueueName(queueName string, delay time.Duration) string {
+	var tier string
+	switch {
+	case delay%time.Minute == 0:
+		tier = fmt.Sprintf("%dm", delay/time.Minute)
+	case delay%time.Second == 0:
+		tier = fmt.Sprintf("%ds", delay/time.Second)
+	default:
+		tier = fmt.Sprintf("%dms", delay.Milliseconds())
+	}
+	return queueName + ".retry." + tier
+}
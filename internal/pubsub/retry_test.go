@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryQueueName(t *testing.T) {
+	tests := map[string]struct {
+		delay time.Duration
+		want  string
+	}{
+		"seconds": {
+			delay: 10 * time.Second,
+			want:  "sensor.all.logs.retry.10s",
+		},
+		"minutes": {
+			delay: 60 * time.Second,
+			want:  "sensor.all.logs.retry.1m",
+		},
+		"milliseconds": {
+			delay: 1500 * time.Millisecond,
+			want:  "sensor.all.logs.retry.1500ms",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := retryQueueName("sensor.all.logs", tc.delay)
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryAttempt(t *testing.T) {
+	tests := map[string]struct {
+		input amqp.Delivery
+		want  int
+	}{
+		"never retried": {
+			input: amqp.Delivery{},
+			want:  0,
+		},
+		"second tier": {
+			input: amqp.Delivery{Headers: amqp.Table{headerRetryAttempt: int32(2)}},
+			want:  2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := retryAttempt(tc.input)
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
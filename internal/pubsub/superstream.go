@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+)
+
+const (
+	// ExchangeTypeConsistentHash needs the rabbitmq_consistent_hash_exchange plugin.
+	ExchangeTypeConsistentHash = "x-consistent-hash"
+
+	superStreamReconnectAttempts = 10
+)
+
+// DeclareSuperStream declares a super stream of the given number of partitions, named
+// <superStream>-0 to <superStream>-<partitions-1>, each one bounded to maxLengthGB. Declaring
+// an existing one is a no-op, its partition count and length are not changed.
+func DeclareSuperStream(env *stream.Environment, superStream string, partitions int, maxLengthGB int64) error {
+	return env.DeclareSuperStream(
+		superStream,
+		stream.NewPartitionsOptions(partitions).SetMaxLengthBytes(stream.ByteCapacity{}.GB(maxLengthGB)),
+	)
+}
+
+// DeclareHashRouting routes the messages published to exchange with a routing key matching
+// key onto the partitions, through a consistent hash exchange. The hash is taken over the
+// routing key, so every message of a given key always lands in the same partition and keeps
+// its order there.
+//
+// AMQP 0.9.1 and MQTT publishers cannot use the super stream own exchange since it routes on
+// the partition binding keys, which publishers would need to know about.
+func DeclareHashRouting(conn *Connection, exchange, key, hashExchange string, partitions []string) error {
+	return conn.Setup(func(amqpConn *amqp.Connection) error {
+		ch, err := amqpConn.Channel()
+		if err != nil {
+			return fmt.Errorf("could not create channel: %v", err)
+		}
+		defer ch.Close()
+
+		err = ch.ExchangeDeclare(hashExchange, ExchangeTypeConsistentHash, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %v", hashExchange, err)
+		}
+
+		for _, partition := range partitions {
+			// the binding key of a consistent hash exchange is the weight of the partition
+			err = ch.QueueBind(partition, "1", hashExchange, false, nil)
+			if err != nil {
+				return fmt.Errorf("could not bind partition %s: %v", partition, err)
+			}
+		}
+
+		err = ch.ExchangeBind(hashExchange, key, exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind %s to %s: %v", hashExchange, exchange, err)
+		}
+		return nil
+	})
+}
+
+// SubscribeSuperStreamDecoder is SubscribeStreamDecoder for a super stream, it consumes every
+// partition and gives each of them its own offset committer. Run with a single active
+// consumer, instances sharing the consumer name split the partitions between them, so adding
+// instances spreads the load while every partition is still read in order by one of them.
+//
+// A partition whose consumer is dropped by the broker (connection lost, leader moved) is
+// connected again from its last stored offset.
+func SubscribeSuperStreamDecoder[T any](
+	ctx context.Context,
+	env *stream.Environment,
+	superStream string,
+	superStreamOptions *stream.SuperStreamConsumerOptions,
+	handler func(T) AckType,
+	decode func(contentType string, data []byte) (T, error),
+	opts ...StreamOption,
+) (*stream.SuperStreamConsumer, error) {
+	options := newStreamOptions(opts...)
+
+	partitions, err := env.QueryPartitions(superStream)
+	if err != nil {
+		return nil, fmt.Errorf("could not query partitions of %s: %v", superStream, err)
+	}
+
+	var mu sync.Mutex
+	committers := make(map[string]*offsetCommitter, len(partitions))
+	committerFor := func(partition string) *offsetCommitter {
+		mu.Lock()
+		defer mu.Unlock()
+		committer, ok := committers[partition]
+		if !ok {
+			committer = newOffsetCommitter(options.commitEvery, options.commitInterval)
+			go committer.run(ctx)
+			committers[partition] = committer
+		}
+		return committer
+	}
+
+	return subscribeSuperStream(
+		env,
+		superStream,
+		superStreamOptions,
+		streamMessagesHandler(ctx, bodyHandler(handler), contentTypeUnmarshaller(decode), committerFor),
+		len(partitions),
+	)
+}
+
+// SubscribeSuperStreamDeferred is SubscribeSuperStreamDecoder for handlers that are done with
+// a message some time after returning, e.g. because they buffer it before writing. Offsets
+// are never stored on their behalf, the handler calls Commit on a delivery once whatever it
+// did with it is durable, which also stands for every earlier delivery of the same partition.
+//
+// Ack and NackDiscard both move on to the next message, the difference is up to the handler:
+// a message it discards without committing is read again after a restart.
+func SubscribeSuperStreamDeferred[T any](
+	ctx context.Context,
+	env *stream.Environment,
+	superStream string,
+	superStreamOptions *stream.SuperStreamConsumerOptions,
+	handler func(StreamDelivery[T]) AckType,
+	decode func(contentType string, data []byte) (T, error),
+) (*stream.SuperStreamConsumer, error) {
+	partitions, err := env.QueryPartitions(superStream)
+	if err != nil {
+		return nil, fmt.Errorf("could not query partitions of %s: %v", superStream, err)
+	}
+
+	return subscribeSuperStream(
+		env,
+		superStream,
+		superStreamOptions,
+		streamMessagesHandler(ctx, handler, contentTypeUnmarshaller(decode), nil),
+		len(partitions),
+	)
+}
+
+func subscribeSuperStream(
+	env *stream.Environment,
+	superStream string,
+	superStreamOptions *stream.SuperStreamConsumerOptions,
+	messagesHandler stream.MessagesHandler,
+	partitions int,
+) (*stream.SuperStreamConsumer, error) {
+	consumer, err := env.NewSuperStreamConsumer(superStream, messagesHandler, superStreamOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client holds its lock while notifying, the buffer must fit every partition closing at once
+	closed := consumer.NotifyPartitionClose(partitions)
+	go func() {
+		for partitionClose := range closed {
+			reason := partitionClose.Event.Reason
+			if reason != stream.SocketClosed && reason != stream.MetaDataUpdate {
+				continue // closed on purpose
+			}
+			fmt.Printf("partition %s closed (%s), reconnecting\n", partitionClose.Partition, reason)
+			reconnectPartition(env, superStreamOptions.ConsumerName, partitionClose)
+		}
+	}()
+
+	return consumer, nil
+}
+
+func reconnectPartition(env *stream.Environment, consumerName string, partitionClose stream.CPartitionClose) {
+	backoff := streamRetryMinBackoff
+	for attempt := 1; attempt <= superStreamReconnectAttempts; attempt++ {
+		time.Sleep(backoff)
+
+		offset := stream.OffsetSpecification{}.First()
+		stored, err := env.QueryOffset(consumerName, partitionClose.Partition)
+		if err == nil {
+			offset = stream.OffsetSpecification{}.Offset(stored + 1)
+		}
+
+		err = partitionClose.Context.ConnectPartition(partitionClose.Partition, offset)
+		if err == nil {
+			fmt.Printf("partition %s reconnected\n", partitionClose.Partition)
+			return
+		}
+		fmt.Printf("could not reconnect partition %s (attempt %d): %v\n", partitionClose.Partition, attempt, err)
+		backoff = min(backoff*2, streamRetryMaxBackoff)
+	}
+	fmt.Printf("giving up on partition %s\n", partitionClose.Partition)
+}
@@ -0,0 +1,552 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultVhost is the vhost of a Topology that does not say otherwise.
+const DefaultVhost = "/"
+
+// The broker objects of a Topology follow the layout of a RabbitMQ definitions export, so the
+// export of a live broker reads straight into them.
+
+type Exchange struct {
+	Name       string         `json:"name"`
+	Vhost      string         `json:"vhost"`
+	Type       string         `json:"type"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Internal   bool           `json:"internal"`
+	Arguments  map[string]any `json:"arguments"`
+}
+
+type Queue struct {
+	Name       string         `json:"name"`
+	Vhost      string         `json:"vhost"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Arguments  map[string]any `json:"arguments"`
+}
+
+// Binding destination types
+const (
+	DestinationQueue    = "queue"
+	DestinationExchange = "exchange"
+)
+
+type Binding struct {
+	Source          string         `json:"source"`
+	Vhost           string         `json:"vhost"`
+	Destination     string         `json:"destination"`
+	DestinationType string         `json:"destination_type"`
+	RoutingKey      string         `json:"routing_key"`
+	Arguments       map[string]any `json:"arguments"`
+}
+
+// Policy applies Definition to the queues or exchanges whose name matches Pattern. Policies
+// can only be set through the management API, see Management, or loaded with the definitions.
+type Policy struct {
+	Name       string         `json:"name"`
+	Vhost      string         `json:"vhost"`
+	Pattern    string         `json:"pattern"`
+	ApplyTo    string         `json:"apply-to"`
+	Priority   int            `json:"priority"`
+	Definition map[string]any `json:"definition"`
+}
+
+// Definitions are the exchanges, queues, bindings and policies of a broker.
+type Definitions struct {
+	Exchanges []Exchange `json:"exchanges"`
+	Queues    []Queue    `json:"queues"`
+	Bindings  []Binding  `json:"bindings"`
+	Policies  []Policy   `json:"policies"`
+}
+
+// ParseDefinitions reads a definitions export, e.g. of rabbitmqctl export_definitions or GET
+// /api/definitions. Users, permissions and the like are left out.
+func ParseDefinitions(r io.Reader) (Definitions, error) {
+	var defs Definitions
+	err := json.NewDecoder(r).Decode(&defs)
+	if err != nil {
+		return Definitions{}, fmt.Errorf("could not decode definitions: %v", err)
+	}
+	return defs, nil
+}
+
+// WriteDefinitions writes base, a definitions file as the broker loads it on boot, with its
+// exchanges, queues, bindings and policies replaced by defs. Users, vhosts, permissions and
+// the like are kept as they are, in the order base has them.
+func WriteDefinitions(w io.Writer, base io.Reader, defs Definitions) error {
+	// the broker does not take null arguments
+	exchanges := slices.Clone(defs.Exchanges)
+	for i := range exchanges {
+		exchanges[i].Arguments = emptyIfNil(exchanges[i].Arguments)
+	}
+	queues := slices.Clone(defs.Queues)
+	for i := range queues {
+		queues[i].Arguments = emptyIfNil(queues[i].Arguments)
+	}
+	bindings := slices.Clone(defs.Bindings)
+	for i := range bindings {
+		bindings[i].Arguments = emptyIfNil(bindings[i].Arguments)
+	}
+	policies := slices.Clone(defs.Policies)
+	for i := range policies {
+		policies[i].Definition = emptyIfNil(policies[i].Definition)
+	}
+	replaced := map[string]any{
+		"policies":  policies,
+		"exchanges": exchanges,
+		"queues":    queues,
+		"bindings":  bindings,
+	}
+
+	dec := json.NewDecoder(base)
+	token, err := dec.Token()
+	if err != nil || token != json.Delim('{') {
+		return fmt.Errorf("could not decode definitions: not a json object")
+	}
+	var keys []string
+	values := map[string]json.RawMessage{}
+	for dec.More() {
+		token, err = dec.Token()
+		if err != nil {
+			return fmt.Errorf("could not decode definitions: %v", err)
+		}
+		key := token.(string)
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return fmt.Errorf("could not decode definitions: %v", err)
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+	for _, key := range []string{"policies", "exchanges", "queues", "bindings"} {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	var compact bytes.Buffer
+	compact.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			compact.WriteByte(',')
+		}
+		value, ok := replaced[key]
+		if !ok {
+			value = values[key]
+		}
+		data, err := json.Marshal(map[string]any{key: value})
+		if err != nil {
+			return fmt.Errorf("could not encode definitions: %v", err)
+		}
+		compact.Write(data[1 : len(data)-1])
+	}
+	compact.WriteByte('}')
+
+	var out bytes.Buffer
+	err = json.Indent(&out, compact.Bytes(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode definitions: %v", err)
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(w)
+	return err
+}
+
+// SuperStream is a super stream of Partitions streams, declared over the stream protocol by
+// its consumer since the broker sets it up as a whole. With HashRouting, messages published
+// to an AMQP exchange are spread over the partitions, see DeclareHashRouting.
+type SuperStream struct {
+	Name        string
+	Partitions  int
+	MaxLengthGB int64
+	HashRouting *HashRouting
+}
+
+type HashRouting struct {
+	Exchange     string // where messages are published
+	BindingKey   string // of the messages to spread over the partitions
+	HashExchange string
+}
+
+// PartitionNames are the streams of the super stream, as the broker names them.
+func (s SuperStream) PartitionNames() []string {
+	names := make([]string, s.Partitions)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s-%d", s.Name, i)
+	}
+	return names
+}
+
+// Topology is what a broker must hold for the services to work. Services declare it when
+// connecting, see DeclareTopology, and Diff tells how a live broker drifted from it.
+type Topology struct {
+	Vhost        string // DefaultVhost when empty
+	Exchanges    []Exchange
+	Queues       []Queue
+	Bindings     []Binding
+	Policies     []Policy
+	SuperStreams []SuperStream
+	// Obsolete lists bindings older versions declared and this one must not have, e.g. after
+	// a routing key changed, since declaring a binding never removes the old one. They are
+	// removed by DeclareTopology and reported apart by Diff.
+	Obsolete []Binding
+	// Ignore lists name patterns, as of path.Match, of the queues services declare at
+	// runtime (e.g. one per sensor), which Diff leaves out along with their bindings.
+	Ignore []string
+}
+
+func (t Topology) vhost() string {
+	if t.Vhost == "" {
+		return DefaultVhost
+	}
+	return t.Vhost
+}
+
+// Definitions lays out the topology as the broker exports it, super streams included.
+func (t Topology) Definitions() Definitions {
+	vhost := t.vhost()
+	defs := Definitions{
+		Exchanges: slices.Clone(t.Exchanges),
+		Queues:    slices.Clone(t.Queues),
+		Bindings:  slices.Clone(t.Bindings),
+		Policies:  slices.Clone(t.Policies),
+	}
+
+	for _, s := range t.SuperStreams {
+		defs.Exchanges = append(defs.Exchanges, Exchange{
+			Name:      s.Name,
+			Type:      amqp.ExchangeDirect,
+			Durable:   true,
+			Arguments: map[string]any{"x-super-stream": true},
+		})
+		for i, partition := range s.PartitionNames() {
+			defs.Queues = append(defs.Queues, Queue{
+				Name:    partition,
+				Durable: true,
+				Arguments: map[string]any{
+					"x-queue-type":       QueueStream.String(),
+					"x-max-length-bytes": s.MaxLengthGB * 1_000_000_000, // GB as the stream client counts them
+				},
+			})
+			defs.Bindings = append(defs.Bindings, Binding{
+				Source:          s.Name,
+				Destination:     partition,
+				DestinationType: DestinationQueue,
+				RoutingKey:      strconv.Itoa(i),
+				Arguments:       map[string]any{"x-stream-partition-order": i},
+			})
+		}
+
+		if s.HashRouting == nil {
+			continue
+		}
+		defs.Exchanges = append(defs.Exchanges, Exchange{
+			Name:    s.HashRouting.HashExchange,
+			Type:    ExchangeTypeConsistentHash,
+			Durable: true,
+		})
+		defs.Bindings = append(defs.Bindings, Binding{
+			Source:          s.HashRouting.Exchange,
+			Destination:     s.HashRouting.HashExchange,
+			DestinationType: DestinationExchange,
+			RoutingKey:      s.HashRouting.BindingKey,
+		})
+		for _, partition := range s.PartitionNames() {
+			defs.Bindings = append(defs.Bindings, Binding{
+				Source:          s.HashRouting.HashExchange,
+				Destination:     partition,
+				DestinationType: DestinationQueue,
+				RoutingKey:      "1", // weight of the partition
+			})
+		}
+	}
+
+	for i := range defs.Exchanges {
+		defs.Exchanges[i].Vhost = vhost
+	}
+	for i := range defs.Queues {
+		defs.Queues[i].Vhost = vhost
+	}
+	for i := range defs.Bindings {
+		defs.Bindings[i].Vhost = vhost
+	}
+	for i := range defs.Policies {
+		defs.Policies[i].Vhost = vhost
+	}
+	return defs
+}
+
+// NewQueue describes a queue the way Subscribe declares it, which is how a Topology should
+// list the queues of subscriptions.
+func NewQueue(name string, queueDurability QueueDurability, queueType QueueType, deadLetter *DeadLetterConfig) Queue {
+	args := amqp.Table{
+		"x-queue-type": queueType.String(),
+	}
+	if deadLetter != nil {
+		maps.Copy(args, deadLetter.queueArgs(queueType))
+	}
+	return Queue{
+		Name:       name,
+		Durable:    queueDurability == QueueDurable,
+		AutoDelete: queueDurability != QueueDurable,
+		Arguments:  args,
+	}
+}
+
+func NewBinding(exchange, queue, key string) Binding {
+	return Binding{
+		Source:          exchange,
+		Destination:     queue,
+		DestinationType: DestinationQueue,
+		RoutingKey:      key,
+	}
+}
+
+// DeclareTopology declares the exchanges, queues and bindings of the topology, now and after
+// every reconnect, and removes the obsolete bindings. Declaring what already exists is a no-op,
+// as long as it was declared with the same arguments, and so is removing what does not.
+// Super streams are left to their consumer, and policies to Management or the definitions the
+// broker loads on boot, see WriteDefinitions.
+func DeclareTopology(conn *Connection, t Topology) error {
+	return conn.Setup(func(amqpConn *amqp.Connection) error {
+		ch, err := amqpConn.Channel()
+		if err != nil {
+			return fmt.Errorf("could not create channel: %v", err)
+		}
+		defer ch.Close()
+
+		for _, e := range t.Exchanges {
+			err = ch.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, e.Arguments)
+			if err != nil {
+				return fmt.Errorf("could not declare exchange %s: %v", e.Name, err)
+			}
+		}
+		for _, q := range t.Queues {
+			_, err = ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, false, false, q.Arguments)
+			if err != nil {
+				return fmt.Errorf("could not declare queue %s: %v", q.Name, err)
+			}
+		}
+		for _, b := range t.Bindings {
+			if b.DestinationType == DestinationExchange {
+				err = ch.ExchangeBind(b.Destination, b.RoutingKey, b.Source, false, b.Arguments)
+			} else {
+				err = ch.QueueBind(b.Destination, b.RoutingKey, b.Source, false, b.Arguments)
+			}
+			if err != nil {
+				return fmt.Errorf("could not bind %s: %v", b, err)
+			}
+		}
+		for _, b := range t.Obsolete {
+			if b.DestinationType == DestinationExchange {
+				err = ch.ExchangeUnbind(b.Destination, b.RoutingKey, b.Source, false, b.Arguments)
+			} else {
+				err = ch.QueueUnbind(b.Destination, b.RoutingKey, b.Source, b.Arguments)
+			}
+			if err != nil {
+				return fmt.Errorf("could not unbind %s: %v", b, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (b Binding) String() string {
+	return fmt.Sprintf("%s -> %s %s [%s]", b.Source, b.DestinationType, b.Destination, b.RoutingKey)
+}
+
+// Drift changes
+const (
+	DriftMissing    = "missing"    // in the topology, not in the broker
+	DriftUnexpected = "unexpected" // in the broker, not in the topology
+	DriftDiffers    = "differs"    // in both, declared differently
+	DriftObsolete   = "obsolete"   // in the broker, left by an older version of the topology
+)
+
+// Drift is a difference between a topology and the definitions of a broker.
+type Drift struct {
+	Object string // exchange, queue, binding or policy
+	Name   string
+	Change string
+	Detail string // what differs
+
+	want any // the object as the topology has it, to apply
+}
+
+func (d Drift) String() string {
+	s := fmt.Sprintf("%s %s %s", d.Object, d.Name, d.Change)
+	if d.Detail != "" {
+		s += ": " + d.Detail
+	}
+	return s
+}
+
+// Diff compares a topology with the definitions of a broker, e.g. from an export. Built-in
+// exchanges, other vhosts and the queues the topology ignores are left out.
+func Diff(t Topology, live Definitions) []Drift {
+	want := t.Definitions()
+	vhost := t.vhost()
+	ignored := func(queue string) bool {
+		return slices.ContainsFunc(t.Ignore, func(pattern string) bool {
+			match, _ := path.Match(pattern, queue)
+			return match
+		})
+	}
+
+	var drifts []Drift
+	drifts = append(drifts, diffObjects("exchange", want.Exchanges, live.Exchanges,
+		func(e Exchange) (string, bool) {
+			builtin := e.Name == "" || strings.HasPrefix(e.Name, "amq.")
+			return e.Name, e.Vhost == vhost && !builtin
+		},
+		func(want, got Exchange) string {
+			return differences(
+				driftField{"type", want.Type, got.Type},
+				driftField{"durable", want.Durable, got.Durable},
+				driftField{"auto_delete", want.AutoDelete, got.AutoDelete},
+				driftField{"internal", want.Internal, got.Internal},
+				driftField{"arguments", want.Arguments, got.Arguments},
+			)
+		},
+	)...)
+	drifts = append(drifts, diffObjects("queue", want.Queues, live.Queues,
+		func(q Queue) (string, bool) {
+			return q.Name, q.Vhost == vhost && !ignored(q.Name)
+		},
+		func(want, got Queue) string {
+			return differences(
+				driftField{"durable", want.Durable, got.Durable},
+				driftField{"auto_delete", want.AutoDelete, got.AutoDelete},
+				driftField{"arguments", want.Arguments, got.Arguments},
+			)
+		},
+	)...)
+	drifts = append(drifts, diffObjects("binding", want.Bindings, live.Bindings,
+		func(b Binding) (string, bool) {
+			return b.String(), b.Vhost == vhost && !(b.DestinationType == DestinationQueue && ignored(b.Destination))
+		},
+		func(want, got Binding) string {
+			return differences(driftField{"arguments", want.Arguments, got.Arguments})
+		},
+	)...)
+	for i, d := range drifts {
+		if d.Object != "binding" || d.Change != DriftUnexpected {
+			continue
+		}
+		for _, b := range t.Obsolete {
+			b.Vhost = vhost
+			if b.DestinationType == "" {
+				b.DestinationType = DestinationQueue
+			}
+			if b.String() == d.Name {
+				drifts[i] = Drift{Object: "binding", Name: d.Name, Change: DriftObsolete, want: b}
+			}
+		}
+	}
+	drifts = append(drifts, diffObjects("policy", want.Policies, live.Policies,
+		func(p Policy) (string, bool) {
+			return p.Name, p.Vhost == vhost
+		},
+		func(want, got Policy) string {
+			return differences(
+				driftField{"pattern", want.Pattern, got.Pattern},
+				driftField{"apply-to", want.ApplyTo, got.ApplyTo},
+				driftField{"priority", want.Priority, got.Priority},
+				driftField{"definition", want.Definition, got.Definition},
+			)
+		},
+	)...)
+	return drifts
+}
+
+// diffObjects matches wanted and live objects by key, live objects that are not kept are
+// left out of the comparison.
+func diffObjects[T any](object string, want, live []T, key func(T) (string, bool), compare func(want, got T) string) []Drift {
+	liveByKey := map[string]T{}
+	var liveKeys []string
+	for _, o := range live {
+		k, keep := key(o)
+		if keep {
+			liveByKey[k] = o
+			liveKeys = append(liveKeys, k)
+		}
+	}
+
+	var drifts []Drift
+	wanted := map[string]bool{}
+	for _, o := range want {
+		k, _ := key(o)
+		wanted[k] = true
+		got, ok := liveByKey[k]
+		if !ok {
+			drifts = append(drifts, Drift{Object: object, Name: k, Change: DriftMissing, want: o})
+			continue
+		}
+		detail := compare(o, got)
+		if detail != "" {
+			drifts = append(drifts, Drift{Object: object, Name: k, Change: DriftDiffers, Detail: detail, want: o})
+		}
+	}
+
+	slices.Sort(liveKeys)
+	for _, k := range liveKeys {
+		if !wanted[k] {
+			drifts = append(drifts, Drift{Object: object, Name: k, Change: DriftUnexpected})
+		}
+	}
+	return drifts
+}
+
+type driftField struct {
+	name      string
+	want, got any
+}
+
+// differences describes the fields that differ. Values are compared as JSON, since the
+// numbers of an export come back as floats and empty arguments as either null or {}.
+func differences(fields ...driftField) string {
+	var diffs []string
+	for _, f := range fields {
+		want, got := normalize(f.want), normalize(f.got)
+		if !reflect.DeepEqual(want, got) {
+			diffs = append(diffs, fmt.Sprintf("%s is %s, want %s", f.name, jsonString(got), jsonString(want)))
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
+
+func normalize(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var normalized any
+	json.Unmarshal(data, &normalized)
+	if m, ok := normalized.(map[string]any); ok && len(m) == 0 {
+		return nil
+	}
+	return normalized
+}
+
+func jsonString(v any) string {
+	if v == nil {
+		return "{}"
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testTopology() Topology {
+	return Topology{
+		Exchanges: []Exchange{
+			{Name: "iot", Type: "topic", Durable: true},
+		},
+		Queues: []Queue{
+			NewQueue("sensor.all.logs", QueueDurable, QueueQuorum, &DeadLetterConfig{Exchange: "iot.deadletter", DeliveryLimit: 5}),
+		},
+		Bindings: []Binding{
+			NewBinding("iot", "sensor.all.logs", "sensor.*.logs.#"),
+		},
+		Policies: []Policy{
+			{Name: "logs", Pattern: "^sensor\\.all\\.logs$", ApplyTo: "queues", Definition: map[string]any{"max-length": 1000}},
+		},
+		Obsolete: []Binding{
+			NewBinding("iot", "sensor.all.logs", "sensor.*.#"),
+		},
+		Ignore: []string{"sensor.*.commands"},
+	}
+}
+
+func driftNames(drifts []Drift) []string {
+	names := make([]string, len(drifts))
+	for i, d := range drifts {
+		names[i] = d.String()
+	}
+	return names
+}
+
+func TestDiff(t *testing.T) {
+	tests := map[string]struct {
+		export string
+		want   []string
+	}{
+		"in sync": {
+			// numbers of an export decode as floats, empty arguments come either way
+			export: `{
+				"exchanges": [
+					{"name": "iot", "vhost": "/", "type": "topic", "durable": true, "arguments": {}},
+					{"name": "amq.topic", "vhost": "/", "type": "topic", "durable": true}
+				],
+				"queues": [
+					{"name": "sensor.all.logs", "vhost": "/", "durable": true, "arguments": {"x-queue-type": "quorum", "x-dead-letter-exchange": "iot.deadletter", "x-delivery-limit": 5}},
+					{"name": "sensor.AAD-1123.commands", "vhost": "/", "durable": true, "arguments": {"x-queue-type": "classic"}}
+				],
+				"bindings": [
+					{"source": "iot", "vhost": "/", "destination": "sensor.all.logs", "destination_type": "queue", "routing_key": "sensor.*.logs.#", "arguments": {}},
+					{"source": "iot", "vhost": "/", "destination": "sensor.AAD-1123.commands", "destination_type": "queue", "routing_key": "sensor.AAD-1123.commands.#"}
+				],
+				"policies": [
+					{"name": "logs", "vhost": "/", "pattern": "^sensor\\.all\\.logs$", "apply-to": "queues", "priority": 0, "definition": {"max-length": 1000}}
+				]
+			}`,
+			want: []string{},
+		},
+		"empty broker": {
+			export: `{}`,
+			want: []string{
+				"exchange iot missing",
+				"queue sensor.all.logs missing",
+				"binding iot -> queue sensor.all.logs [sensor.*.logs.#] missing",
+				"policy logs missing",
+			},
+		},
+		"declared differently": {
+			export: `{
+				"exchanges": [{"name": "iot", "vhost": "/", "type": "direct", "durable": true}],
+				"queues": [{"name": "sensor.all.logs", "vhost": "/", "durable": true, "arguments": {"x-queue-type": "quorum"}}],
+				"bindings": [{"source": "iot", "vhost": "/", "destination": "sensor.all.logs", "destination_type": "queue", "routing_key": "sensor.*.logs.#"}],
+				"policies": [{"name": "logs", "vhost": "/", "pattern": "^sensor\\.all\\.logs$", "apply-to": "queues", "definition": {"max-length": 10}}]
+			}`,
+			want: []string{
+				`exchange iot differs: type is "direct", want "topic"`,
+				`queue sensor.all.logs differs: arguments is {"x-queue-type":"quorum"}, want {"x-dead-letter-exchange":"iot.deadletter","x-delivery-limit":5,"x-queue-type":"quorum"}`,
+				`policy logs differs: definition is {"max-length":10}, want {"max-length":1000}`,
+			},
+		},
+		"unexpected objects": {
+			export: `{
+				"exchanges": [
+					{"name": "iot", "vhost": "/", "type": "topic", "durable": true},
+					{"name": "iot.legacy", "vhost": "/", "type": "fanout", "durable": true},
+					{"name": "other", "vhost": "staging", "type": "fanout", "durable": true}
+				],
+				"queues": [
+					{"name": "sensor.all.logs", "vhost": "/", "durable": true, "arguments": {"x-queue-type": "quorum", "x-dead-letter-exchange": "iot.deadletter", "x-delivery-limit": 5}},
+					{"name": "sensor.all.legacy", "vhost": "/", "durable": true}
+				],
+				"bindings": [
+					{"source": "iot", "vhost": "/", "destination": "sensor.all.logs", "destination_type": "queue", "routing_key": "sensor.*.logs.#"}
+				],
+				"policies": [
+					{"name": "logs", "vhost": "/", "pattern": "^sensor\\.all\\.logs$", "apply-to": "queues", "definition": {"max-length": 1000}}
+				]
+			}`,
+			want: []string{
+				"exchange iot.legacy unexpected",
+				"queue sensor.all.legacy unexpected",
+			},
+		},
+		"obsolete binding": {
+			export: `{
+				"exchanges": [{"name": "iot", "vhost": "/", "type": "topic", "durable": true}],
+				"queues": [{"name": "sensor.all.logs", "vhost": "/", "durable": true, "arguments": {"x-queue-type": "quorum", "x-dead-letter-exchange": "iot.deadletter", "x-delivery-limit": 5}}],
+				"bindings": [
+					{"source": "iot", "vhost": "/", "destination": "sensor.all.logs", "destination_type": "queue", "routing_key": "sensor.*.logs.#"},
+					{"source": "iot", "vhost": "/", "destination": "sensor.all.logs", "destination_type": "queue", "routing_key": "sensor.*.#"}
+				],
+				"policies": [{"name": "logs", "vhost": "/", "pattern": "^sensor\\.all\\.logs$", "apply-to": "queues", "definition": {"max-length": 1000}}]
+			}`,
+			want: []string{
+				"binding iot -> queue sensor.all.logs [sensor.*.#] obsolete",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			live, err := ParseDefinitions(strings.NewReader(tc.export))
+			if err != nil {
+				t.Fatalf("got %v, want nil", err)
+			}
+			got := driftNames(Diff(testTopology(), live))
+			if !slices.Equal(tc.want, got) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTopologyDefinitionsSuperStream(t *testing.T) {
+	topology := Topology{
+		SuperStreams: []SuperStream{{
+			Name:        "measurements",
+			Partitions:  2,
+			MaxLengthGB: 1,
+			HashRouting: &HashRouting{Exchange: "iot", BindingKey: "sensor.*.measurements.#", HashExchange: "iot.measurements.hash"},
+		}},
+	}
+
+	// the layout of a super stream declared over the stream protocol, see DeclareSuperStream
+	live, err := ParseDefinitions(strings.NewReader(`{
+		"exchanges": [
+			{"name": "measurements", "vhost": "/", "type": "direct", "durable": true, "arguments": {"x-super-stream": true}},
+			{"name": "iot.measurements.hash", "vhost": "/", "type": "x-consistent-hash", "durable": true, "arguments": {}}
+		],
+		"queues": [
+			{"name": "measurements-0", "vhost": "/", "durable": true, "arguments": {"x-max-length-bytes": 1000000000, "x-queue-type": "stream"}},
+			{"name": "measurements-1", "vhost": "/", "durable": true, "arguments": {"x-max-length-bytes": 1000000000, "x-queue-type": "stream"}}
+		],
+		"bindings": [
+			{"source": "iot", "vhost": "/", "destination": "iot.measurements.hash", "destination_type": "exchange", "routing_key": "sensor.*.measurements.#", "arguments": {}},
+			{"source": "iot.measurements.hash", "vhost": "/", "destination": "measurements-0", "destination_type": "queue", "routing_key": "1", "arguments": {}},
+			{"source": "iot.measurements.hash", "vhost": "/", "destination": "measurements-1", "destination_type": "queue", "routing_key": "1", "arguments": {}},
+			{"source": "measurements", "vhost": "/", "destination": "measurements-0", "destination_type": "queue", "routing_key": "0", "arguments": {"x-stream-partition-order": 0}},
+			{"source": "measurements", "vhost": "/", "destination": "measurements-1", "destination_type": "queue", "routing_key": "1", "arguments": {"x-stream-partition-order": 1}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	drifts := Diff(topology, live)
+	if len(drifts) != 0 {
+		t.Fatalf("got %q, want no drift", driftNames(drifts))
+	}
+}
+
+func TestWriteDefinitions(t *testing.T) {
+	base := `{"users": [{"name": "guest"}], "vhosts": [{"name": "/"}], "policies": [], "exchanges": [], "queues": [], "bindings": []}`
+	topology := testTopology()
+
+	var out bytes.Buffer
+	err := WriteDefinitions(&out, strings.NewReader(base), topology.Definitions())
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	for _, want := range []string{`"users": [`, `"vhosts": [`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("got\n%s\nwant it to keep %s", out.String(), want)
+		}
+	}
+	if strings.Contains(out.String(), "null") {
+		t.Fatalf("got\n%s\nwant empty arguments rather than null", out.String())
+	}
+
+	// a broker loading the definitions holds the topology
+	live, err := ParseDefinitions(&out)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	drifts := Diff(topology, live)
+	if len(drifts) != 0 {
+		t.Fatalf("got %q, want no drift", driftNames(drifts))
+	}
+}
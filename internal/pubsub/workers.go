@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultPrefetch is how many unacknowledged deliveries a consumer holds unless told otherwise
+// with WithPrefetch.
+const DefaultPrefetch = 10
+
+// dispatch hands the deliveries to process on the given number of workers until msgs is
+// closed or ctx is done, and returns once the deliveries already handed over were processed.
+// Without an ordering key any free worker takes the next delivery. With one, deliveries of the
+// same key always go to the same worker, so they are processed, and acknowledged, in the order
+// they came in, while those of other keys go on in parallel.
+func dispatch(
+	ctx context.Context,
+	msgs <-chan amqp.Delivery,
+	workers int,
+	buffer int,
+	orderingKey func(amqp.Delivery) string,
+	process func(amqp.Delivery),
+) {
+	queues := make([]chan amqp.Delivery, 1)
+	if orderingKey != nil {
+		queues = make([]chan amqp.Delivery, workers)
+	}
+	for i := range queues {
+		// prefetch bounds what is in flight, so the buffers never make the dispatcher wait for
+		// a busy worker while another key could go on
+		queues[i] = make(chan amqp.Delivery, buffer)
+	}
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		queue := queues[i%len(queues)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range queue {
+				process(msg)
+			}
+		}()
+	}
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			queue := queues[0]
+			if orderingKey != nil {
+				queue = queues[workerFor(orderingKey(msg), workers)]
+			}
+			select {
+			case queue <- msg:
+			case <-ctx.Done():
+				return // never acknowledged, the broker delivers it again
+			}
+		}
+	}
+}
+
+// workerFor hashes the key onto one of the workers.
+func workerFor(key string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(workers))
+}
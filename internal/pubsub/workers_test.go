@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDispatchKeepsKeyOrder(t *testing.T) {
+	const perKey = 50
+	keys := []string{"AAD-1123", "AAD-1124", "AAD-1125", "AAD-1126"}
+
+	msgs := make(chan amqp.Delivery, len(keys)*perKey)
+	for i := range perKey {
+		for _, key := range keys {
+			msgs <- amqp.Delivery{
+				RoutingKey:  key,
+				DeliveryTag: uint64(i),
+			}
+		}
+	}
+	close(msgs)
+
+	// deliveries are ordered by routing key, a consumer would rather order them by sensor
+	routingKey := func(msg amqp.Delivery) string { return msg.RoutingKey }
+
+	var mu sync.Mutex
+	got := make(map[string][]uint64)
+	process := func(msg amqp.Delivery) {
+		time.Sleep(time.Duration(msg.DeliveryTag%3) * time.Millisecond) // shuffle the workers a bit
+		key := routingKey(msg)
+		mu.Lock()
+		got[key] = append(got[key], msg.DeliveryTag)
+		mu.Unlock()
+	}
+
+	dispatch(context.Background(), msgs, 3, DefaultPrefetch, routingKey, process)
+
+	for _, key := range keys {
+		if len(got[key]) != perKey {
+			t.Fatalf("got %d deliveries of %s, want %d", len(got[key]), key, perKey)
+		}
+		for i, tag := range got[key] {
+			if tag != uint64(i) {
+				t.Fatalf("got %v for %s, want them in order", got[key], key)
+			}
+		}
+	}
+}
+
+func TestDispatchRunsConcurrently(t *testing.T) {
+	const workers = 4
+
+	msgs := make(chan amqp.Delivery, workers)
+	for range workers {
+		msgs <- amqp.Delivery{}
+	}
+	close(msgs)
+
+	// every worker waits for all the others, which only returns if they run at once
+	var started sync.WaitGroup
+	started.Add(workers)
+	process := func(amqp.Delivery) {
+		started.Done()
+		started.Wait()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		dispatch(context.Background(), msgs, workers, DefaultPrefetch, nil, process)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("got deliveries handled one at a time, want %d at once", workers)
+	}
+}
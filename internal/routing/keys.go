@@ -0,0 +1,203 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/validation"
+)
+
+// Routing keys follow sensor.<serial number>.<channel>[.<action>], e.g.
+// sensor.AAD-1123.commands.sleep. They are built and read back with the functions below
+// rather than by hand, so a typo in a serial number, channel or action is an error instead
+// of a key no queue is bound for (or a queue nobody publishes to).
+
+const EntitySensor = "sensor"
+
+// Channel is the third part of a routing key, what the message is about.
+type Channel string
+
+const (
+	ChannelMeasurements Channel = "measurements"
+	ChannelCommands     Channel = "commands"
+	ChannelRegistry     Channel = "registry"
+	ChannelLogs         Channel = "logs"
+)
+
+// ChannelCommands actions, the commands a sensor takes
+const (
+	CommandActionSleep                 = "sleep"
+	CommandActionAwake                 = "awake"
+	CommandActionChangeSampleFrequency = "change_sample_frequency"
+)
+
+// Wildcards of binding keys
+const (
+	AnySensor = "*" // any serial number
+	AnyAction = "#" // any action, none included
+)
+
+var ErrInvalidKey = errors.New("invalid routing key")
+
+// actions tells which actions each channel takes, channels without any take none
+var actions = map[Channel][]string{
+	ChannelMeasurements: nil,
+	ChannelCommands:     {CommandActionSleep, CommandActionAwake, CommandActionChangeSampleFrequency},
+	ChannelRegistry: {
+		RegistryRequestRegister, RegistryRequestDeregister,
+		RegistryEventCreated, RegistryEventUpdated, RegistryEventDeleted,
+	},
+	ChannelLogs: nil,
+}
+
+// Key is a parsed routing key.
+type Key struct {
+	Entity       string
+	SerialNumber string
+	Channel      Channel
+	Action       string // empty for channels without actions
+}
+
+func (k Key) String() string {
+	key := k.Entity + "." + k.SerialNumber + "." + string(k.Channel)
+	if k.Action != "" {
+		key += "." + k.Action
+	}
+	return key
+}
+
+// NewKey builds the key of a sensor, checking the serial number and that the channel takes
+// the action.
+func NewKey(serialNumber string, channel Channel, action string) (Key, error) {
+	key := Key{Entity: EntitySensor, SerialNumber: serialNumber, Channel: channel, Action: action}
+	err := key.validate()
+	if err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// ParseKey reads a routing key back, e.g. out of a delivery or a dead letter.
+func ParseKey(routingKey string) (Key, error) {
+	parts := strings.Split(routingKey, ".")
+	if len(parts) < 3 || len(parts) > 4 {
+		return Key{}, fmt.Errorf("%w: %q is not sensor.<serial>.<channel>[.<action>]", ErrInvalidKey, routingKey)
+	}
+
+	key := Key{Entity: parts[0], SerialNumber: parts[1], Channel: Channel(parts[2])}
+	if len(parts) == 4 {
+		key.Action = parts[3]
+	}
+	err := key.validate()
+	if err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+func (k Key) validate() error {
+	if k.Entity != EntitySensor {
+		return fmt.Errorf("%w: unknown entity %q", ErrInvalidKey, k.Entity)
+	}
+	if !validation.HasValidCharacters(k.SerialNumber) {
+		return fmt.Errorf("%w: invalid serial number %q", ErrInvalidKey, k.SerialNumber)
+	}
+	return validateAction(k.Channel, k.Action)
+}
+
+func validateAction(channel Channel, action string) error {
+	channelActions, ok := actions[channel]
+	if !ok {
+		return fmt.Errorf("%w: unknown channel %q", ErrInvalidKey, channel)
+	}
+	if action == "" && len(channelActions) == 0 {
+		return nil
+	}
+	for _, channelAction := range channelActions {
+		if action == channelAction {
+			return nil
+		}
+	}
+	if action == "" {
+		return fmt.Errorf("%w: channel %q takes an action", ErrInvalidKey, channel)
+	}
+	return fmt.Errorf("%w: channel %q takes no action %q", ErrInvalidKey, channel, action)
+}
+
+func sensorKey(serialNumber string, channel Channel, action string) (string, error) {
+	key, err := NewKey(serialNumber, channel, action)
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// SensorMeasurementsKey is the key (and MQTT topic) a sensor publishes its measurements to.
+func SensorMeasurementsKey(serialNumber string) (string, error) {
+	return sensorKey(serialNumber, ChannelMeasurements, "")
+}
+
+// SensorCommandKey is the key of a command to a sensor, action being a CommandAction.
+func SensorCommandKey(serialNumber, action string) (string, error) {
+	return sensorKey(serialNumber, ChannelCommands, action)
+}
+
+// SensorRegistryKey is the key of a registry request or event about a sensor.
+func SensorRegistryKey(serialNumber, action string) (string, error) {
+	return sensorKey(serialNumber, ChannelRegistry, action)
+}
+
+func SensorLogsKey(serialNumber string) (string, error) {
+	return sensorKey(serialNumber, ChannelLogs, "")
+}
+
+// Binding is the binding key of a channel, for one sensor or AnySensor, and one action or
+// AnyAction. Channels without actions take AnyAction too, which also matches keys a future
+// version may add an action to.
+func Binding(serialNumber string, channel Channel, action string) (string, error) {
+	if serialNumber != AnySensor && !validation.HasValidCharacters(serialNumber) {
+		return "", fmt.Errorf("%w: invalid serial number %q", ErrInvalidKey, serialNumber)
+	}
+	if action != AnyAction {
+		err := validateAction(channel, action)
+		if err != nil {
+			return "", err
+		}
+	} else if _, ok := actions[channel]; !ok {
+		return "", fmt.Errorf("%w: unknown channel %q", ErrInvalidKey, channel)
+	}
+	return Key{Entity: EntitySensor, SerialNumber: serialNumber, Channel: channel, Action: action}.String(), nil
+}
+
+// AnySensorBinding is Binding for every sensor. Channel and action are constants, so it
+// panics on an invalid one instead of returning an error each caller would have to handle.
+func AnySensorBinding(channel Channel, action string) string {
+	binding, err := Binding(AnySensor, channel, action)
+	if err != nil {
+		panic(err)
+	}
+	return binding
+}
+
+// SensorCommandsQueue is the queue a sensor takes its commands from.
+func SensorCommandsQueue(serialNumber string) (string, error) {
+	if !validation.HasValidCharacters(serialNumber) {
+		return "", fmt.Errorf("%w: invalid serial number %q", ErrInvalidKey, serialNumber)
+	}
+	return fmt.Sprintf(queueSensorCommandsFormat, serialNumber), nil
+}
+
+// SensorCacheQueue is the queue of registry events of an instance keeping a SensorCache.
+func SensorCacheQueue(instance string) string {
+	return fmt.Sprintf(queueSensorCacheFormat, instance)
+}
+
+// RuntimeQueuePatterns are name patterns, as of path.Match, of the queues declared at runtime
+// by SensorCommandsQueue and SensorCacheQueue.
+func RuntimeQueuePatterns() []string {
+	return []string{
+		fmt.Sprintf(queueSensorCommandsFormat, "*"),
+		fmt.Sprintf(queueSensorCacheFormat, "*"),
+	}
+}
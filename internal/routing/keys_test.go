@@ -0,0 +1,139 @@
+package routing
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    Key
+		wantErr bool
+	}{
+		"command": {
+			input: "sensor.AAD-1123.commands.sleep",
+			want:  Key{Entity: EntitySensor, SerialNumber: "AAD-1123", Channel: ChannelCommands, Action: CommandActionSleep},
+		},
+		"registry event": {
+			input: "sensor.AAD-1123.registry.created",
+			want:  Key{Entity: EntitySensor, SerialNumber: "AAD-1123", Channel: ChannelRegistry, Action: RegistryEventCreated},
+		},
+		"measurements": {
+			input: "sensor.AAD-1123.measurements",
+			want:  Key{Entity: EntitySensor, SerialNumber: "AAD-1123", Channel: ChannelMeasurements},
+		},
+		"unknown entity": {
+			input:   "target.AAD-1123.logs",
+			wantErr: true,
+		},
+		"invalid serial number": {
+			input:   "sensor.AAD$1123.logs",
+			wantErr: true,
+		},
+		"wildcard serial number": {
+			input:   "sensor.*.logs",
+			wantErr: true,
+		},
+		"unknown channel": {
+			input:   "sensor.AAD-1123.measurments",
+			wantErr: true,
+		},
+		"unknown action": {
+			input:   "sensor.AAD-1123.commands.slep",
+			wantErr: true,
+		},
+		"missing action": {
+			input:   "sensor.AAD-1123.registry",
+			wantErr: true,
+		},
+		"action of a channel without actions": {
+			input:   "sensor.AAD-1123.logs.error",
+			wantErr: true,
+		},
+		"too short": {
+			input:   "sensor.AAD-1123",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseKey(tc.input)
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidKey) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want nil", err)
+			}
+			if tc.want != got {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+			if got.String() != tc.input {
+				t.Fatalf("got %s, want %s", got.String(), tc.input)
+			}
+		})
+	}
+}
+
+func TestKeyBuilders(t *testing.T) {
+	tests := map[string]struct {
+		build   func() (string, error)
+		want    string
+		wantErr bool
+	}{
+		"command": {
+			build: func() (string, error) { return SensorCommandKey("AAD-1123", CommandActionChangeSampleFrequency) },
+			want:  "sensor.AAD-1123.commands.change_sample_frequency",
+		},
+		"command with a typo": {
+			build:   func() (string, error) { return SensorCommandKey("AAD-1123", "awak") },
+			wantErr: true,
+		},
+		"registry request": {
+			build: func() (string, error) { return SensorRegistryKey("AAD-1123", RegistryRequestRegister) },
+			want:  "sensor.AAD-1123.registry.register",
+		},
+		"logs of an invalid serial number": {
+			build:   func() (string, error) { return SensorLogsKey("AAD.1123") },
+			wantErr: true,
+		},
+		"binding of every sensor": {
+			build: func() (string, error) { return Binding(AnySensor, ChannelMeasurements, AnyAction) },
+			want:  "sensor.*.measurements.#",
+		},
+		"binding of the commands of a sensor": {
+			build: func() (string, error) { return Binding("AAD-1123", ChannelCommands, AnyAction) },
+			want:  "sensor.AAD-1123.commands.#",
+		},
+		"binding of an unknown channel": {
+			build:   func() (string, error) { return Binding(AnySensor, "command", AnyAction) },
+			wantErr: true,
+		},
+		"commands queue": {
+			build: func() (string, error) { return SensorCommandsQueue("AAD-1123") },
+			want:  "sensor.AAD-1123.commands",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.build()
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidKey) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want nil", err)
+			}
+			if tc.want != got {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,16 @@ type Sensor struct {
 	SampleFrequency float64
 }
 
+// SensorRegistryEvent is published by the registry after a sensor is created, updated or
+// deleted, Type is one of the RegistryEvent suffixes of its routing key.
+type SensorRegistryEvent struct {
+	Type            string
+	SensorID        int
+	SerialNumber    string
+	SampleFrequency float64
+	OccurredAt      time.Time
+}
+
 // measurements-ingester service
 type SensorMeasurement struct {
 	SerialNumber string
@@ -17,6 +27,17 @@ type SensorMeasurement struct {
 	Value        float64
 }
 
+// SensorMeasurementBatch is the columnar form of a batch for fixed rate sensors: sample i was
+// taken at StartTime + i/SampleFrequency, so neither serial number nor timestamp is repeated.
+type SensorMeasurementBatch struct {
+	SerialNumber    string
+	StartTime       time.Time
+	SampleFrequency float64
+	Values          []float64
+	TraceParent     string // W3C traceparent of the publish, empty when not traced
+	MessageID       string // empty from sensors that predate message ids
+}
+
 // iotctl service
 type SensorCommandMessage struct {
 	SerialNumber string
@@ -0,0 +1,5 @@
+// Package pb holds the protobuf wire types sensors publish. The .proto files are the contract
+// for embedded C/C++ firmware, the Go types are generated from them.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative commands.proto logs.proto measurements.proto registry.proto
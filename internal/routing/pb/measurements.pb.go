@@ -0,0 +1,253 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: measurements.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type MeasurementBatch struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	SerialNumber    string                 `protobuf:"bytes,1,opt,name=serial_number,json=serialNumber,proto3" json:"serial_number,omitempty"`
+	Measurements    []*Measurement         `protobuf:"bytes,2,rep,name=measurements,proto3" json:"measurements,omitempty"`
+	StartUnixNano   int64                  `protobuf:"varint,3,opt,name=start_unix_nano,json=startUnixNano,proto3" json:"start_unix_nano,omitempty"`
+	SampleFrequency float64                `protobuf:"fixed64,4,opt,name=sample_frequency,json=sampleFrequency,proto3" json:"sample_frequency,omitempty"`
+	Values          []float64              `protobuf:"fixed64,5,rep,packed,name=values,proto3" json:"values,omitempty"`
+	GorillaValues   []byte                 `protobuf:"bytes,6,opt,name=gorilla_values,json=gorillaValues,proto3" json:"gorilla_values,omitempty"`
+	ValueCount      uint32                 `protobuf:"varint,7,opt,name=value_count,json=valueCount,proto3" json:"value_count,omitempty"`
+	TraceParent     string                 `protobuf:"bytes,8,opt,name=trace_parent,json=traceParent,proto3" json:"trace_parent,omitempty"`
+	MessageId       string                 `protobuf:"bytes,9,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *MeasurementBatch) Reset() {
+	*x = MeasurementBatch{}
+	mi := &file_measurements_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MeasurementBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MeasurementBatch) ProtoMessage() {}
+
+func (x *MeasurementBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_measurements_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MeasurementBatch.ProtoReflect.Descriptor instead.
+func (*MeasurementBatch) Descriptor() ([]byte, []int) {
+	return file_measurements_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *MeasurementBatch) GetSerialNumber() string {
+	if x != nil {
+		return x.SerialNumber
+	}
+	return ""
+}
+
+func (x *MeasurementBatch) GetMeasurements() []*Measurement {
+	if x != nil {
+		return x.Measurements
+	}
+	return nil
+}
+
+func (x *MeasurementBatch) GetStartUnixNano() int64 {
+	if x != nil {
+		return x.StartUnixNano
+	}
+	return 0
+}
+
+func (x *MeasurementBatch) GetSampleFrequency() float64 {
+	if x != nil {
+		return x.SampleFrequency
+	}
+	return 0
+}
+
+func (x *MeasurementBatch) GetValues() []float64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+func (x *MeasurementBatch) GetGorillaValues() []byte {
+	if x != nil {
+		return x.GorillaValues
+	}
+	return nil
+}
+
+func (x *MeasurementBatch) GetValueCount() uint32 {
+	if x != nil {
+		return x.ValueCount
+	}
+	return 0
+}
+
+func (x *MeasurementBatch) GetTraceParent() string {
+	if x != nil {
+		return x.TraceParent
+	}
+	return ""
+}
+
+func (x *MeasurementBatch) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+type Measurement struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	TimestampUnixNano int64                  `protobuf:"varint,1,opt,name=timestamp_unix_nano,json=timestampUnixNano,proto3" json:"timestamp_unix_nano,omitempty"`
+	Value             float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *Measurement) Reset() {
+	*x = Measurement{}
+	mi := &file_measurements_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Measurement) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Measurement) ProtoMessage() {}
+
+func (x *Measurement) ProtoReflect() protoreflect.Message {
+	mi := &file_measurements_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Measurement.ProtoReflect.Descriptor instead.
+func (*Measurement) Descriptor() ([]byte, []int) {
+	return file_measurements_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Measurement) GetTimestampUnixNano() int64 {
+	if x != nil {
+		return x.TimestampUnixNano
+	}
+	return 0
+}
+
+func (x *Measurement) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+var File_measurements_proto protoreflect.FileDescriptor
+
+const file_measurements_proto_rawDesc = "" +
+	"\n" +
+	"\x12measurements.proto\x12\riot.sensor.v1\"\xec\x02\n" +
+	"\x10MeasurementBatch\x12#\n" +
+	"\rserial_number\x18\x01 \x01(\tR\fserialNumber\x12>\n" +
+	"\fmeasurements\x18\x02 \x03(\v2\x1a.iot.sensor.v1.MeasurementR\fmeasurements\x12&\n" +
+	"\x0fstart_unix_nano\x18\x03 \x01(\x03R\rstartUnixNano\x12)\n" +
+	"\x10sample_frequency\x18\x04 \x01(\x01R\x0fsampleFrequency\x12\x16\n" +
+	"\x06values\x18\x05 \x03(\x01R\x06values\x12%\n" +
+	"\x0egorilla_values\x18\x06 \x01(\fR\rgorillaValues\x12\x1f\n" +
+	"\vvalue_count\x18\a \x01(\rR\n" +
+	"valueCount\x12!\n" +
+	"\ftrace_parent\x18\b \x01(\tR\vtraceParent\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\t \x01(\tR\tmessageId\"S\n" +
+	"\vMeasurement\x12.\n" +
+	"\x13timestamp_unix_nano\x18\x01 \x01(\x03R\x11timestampUnixNano\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05valueBEZCgithub.com/iferdel/sensor-data-streaming-server/internal/routing/pbb\x06proto3"
+
+var (
+	file_measurements_proto_rawDescOnce sync.Once
+	file_measurements_proto_rawDescData []byte
+)
+
+func file_measurements_proto_rawDescGZIP() []byte {
+	file_measurements_proto_rawDescOnce.Do(func() {
+		file_measurements_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_measurements_proto_rawDesc), len(file_measurements_proto_rawDesc)))
+	})
+	return file_measurements_proto_rawDescData
+}
+
+var file_measurements_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_measurements_proto_goTypes = []any{
+	(*MeasurementBatch)(nil), // 0: iot.sensor.v1.MeasurementBatch
+	(*Measurement)(nil),      // 1: iot.sensor.v1.Measurement
+}
+var file_measurements_proto_depIdxs = []int32{
+	1, // 0: iot.sensor.v1.MeasurementBatch.measurements:type_name -> iot.sensor.v1.Measurement
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_measurements_proto_init() }
+func file_measurements_proto_init() {
+	if File_measurements_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_measurements_proto_rawDesc), len(file_measurements_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_measurements_proto_goTypes,
+		DependencyIndexes: file_measurements_proto_depIdxs,
+		MessageInfos:      file_measurements_proto_msgTypes,
+	}.Build()
+	File_measurements_proto = out.File
+	file_measurements_proto_goTypes = nil
+	file_measurements_proto_depIdxs = nil
+}
@@ -0,0 +1,155 @@
+package routing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/gorilla"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing/pb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// conversions between the DTOs and their protobuf wire types
+
+// NewMeasurementBatch packs the measurements of one sensor into a single batch message,
+// measurements from other sensors are left out.
+func NewMeasurementBatch(serialNumber string, measurements []SensorMeasurement) *pb.MeasurementBatch {
+	batch := &pb.MeasurementBatch{
+		SerialNumber: serialNumber,
+		Measurements: make([]*pb.Measurement, 0, len(measurements)),
+	}
+	for _, m := range measurements {
+		if m.SerialNumber != serialNumber {
+			continue
+		}
+		batch.Measurements = append(batch.Measurements, &pb.Measurement{
+			TimestampUnixNano: m.Timestamp.UnixNano(),
+			Value:             m.Value,
+		})
+	}
+	return batch
+}
+
+// MeasurementsFromBatch expands a batch back into one DTO per sample.
+func MeasurementsFromBatch(batch *pb.MeasurementBatch) []SensorMeasurement {
+	measurements := make([]SensorMeasurement, 0, len(batch.GetMeasurements()))
+	for _, m := range batch.GetMeasurements() {
+		measurements = append(measurements, SensorMeasurement{
+			SerialNumber: batch.GetSerialNumber(),
+			Timestamp:    time.Unix(0, m.GetTimestampUnixNano()).UTC(),
+			Value:        m.GetValue(),
+		})
+	}
+	return measurements
+}
+
+// SensorMeasurementBatchToProto builds the columnar layout, with the values XOR compressed
+// when compress is set.
+func SensorMeasurementBatchToProto(b SensorMeasurementBatch, compress bool) *pb.MeasurementBatch {
+	batch := &pb.MeasurementBatch{
+		SerialNumber:    b.SerialNumber,
+		StartUnixNano:   b.StartTime.UnixNano(),
+		SampleFrequency: b.SampleFrequency,
+		ValueCount:      uint32(len(b.Values)),
+		TraceParent:     b.TraceParent,
+		MessageId:       b.MessageID,
+	}
+	if compress {
+		batch.GorillaValues = gorilla.Encode(b.Values)
+	} else {
+		batch.Values = b.Values
+	}
+	return batch
+}
+
+// IsColumnar tells whether a batch uses the columnar layout rather than per-sample measurements.
+func IsColumnar(batch *pb.MeasurementBatch) bool {
+	return batch.GetSampleFrequency() > 0
+}
+
+func SensorMeasurementBatchFromProto(batch *pb.MeasurementBatch) (SensorMeasurementBatch, error) {
+	values := batch.GetValues()
+	if len(batch.GetGorillaValues()) > 0 {
+		var err error
+		values, err = gorilla.Decode(batch.GetGorillaValues(), int(batch.GetValueCount()))
+		if err != nil {
+			return SensorMeasurementBatch{}, fmt.Errorf("could not decompress values: %v", err)
+		}
+	}
+	return SensorMeasurementBatch{
+		SerialNumber:    batch.GetSerialNumber(),
+		StartTime:       time.Unix(0, batch.GetStartUnixNano()).UTC(),
+		SampleFrequency: batch.GetSampleFrequency(),
+		Values:          values,
+		TraceParent:     batch.GetTraceParent(),
+		MessageID:       batch.GetMessageId(),
+	}, nil
+}
+
+func SensorToProto(s Sensor) *pb.Sensor {
+	return &pb.Sensor{
+		SerialNumber:    s.SerialNumber,
+		SampleFrequency: s.SampleFrequency,
+	}
+}
+
+func SensorFromProto(s *pb.Sensor) Sensor {
+	return Sensor{
+		SerialNumber:    s.GetSerialNumber(),
+		SampleFrequency: s.GetSampleFrequency(),
+	}
+}
+
+func SensorLogToProto(l SensorLog) *pb.SensorLog {
+	return &pb.SensorLog{
+		SerialNumber: l.SerialNumber,
+		Timestamp:    timestamppb.New(l.Timestamp),
+		Level:        l.Level,
+		Message:      l.Message,
+	}
+}
+
+func SensorLogFromProto(l *pb.SensorLog) SensorLog {
+	return SensorLog{
+		SerialNumber: l.GetSerialNumber(),
+		Timestamp:    l.GetTimestamp().AsTime(),
+		Level:        l.GetLevel(),
+		Message:      l.GetMessage(),
+	}
+}
+
+// SensorCommandToProto keeps only numeric params, which is all the current commands take.
+func SensorCommandToProto(cm SensorCommandMessage) *pb.SensorCommand {
+	params := make(map[string]float64, len(cm.Params))
+	for k, v := range cm.Params {
+		switch n := v.(type) {
+		case float64:
+			params[k] = n
+		case float32:
+			params[k] = float64(n)
+		case int:
+			params[k] = float64(n)
+		case int64:
+			params[k] = float64(n)
+		}
+	}
+	return &pb.SensorCommand{
+		SerialNumber: cm.SerialNumber,
+		Timestamp:    timestamppb.New(cm.Timestamp),
+		Command:      cm.Command,
+		Params:       params,
+	}
+}
+
+func SensorCommandFromProto(cm *pb.SensorCommand) SensorCommandMessage {
+	params := make(map[string]interface{}, len(cm.GetParams()))
+	for k, v := range cm.GetParams() {
+		params[k] = v
+	}
+	return SensorCommandMessage{
+		SerialNumber: cm.GetSerialNumber(),
+		Timestamp:    cm.GetTimestamp().AsTime(),
+		Command:      cm.GetCommand(),
+		Params:       params,
+	}
+}
@@ -0,0 +1,163 @@
+package routing
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMeasurementBatchRoundTrip(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		input []SensorMeasurement
+		want  []SensorMeasurement
+	}{
+		"empty batch": {
+			input: nil,
+			want:  []SensorMeasurement{},
+		},
+		"keeps nanosecond timestamps": {
+			input: []SensorMeasurement{
+				{SerialNumber: "AAD-1123", Timestamp: start, Value: 0.5},
+				{SerialNumber: "AAD-1123", Timestamp: start.Add(40 * time.Microsecond), Value: -0.25},
+			},
+			want: []SensorMeasurement{
+				{SerialNumber: "AAD-1123", Timestamp: start, Value: 0.5},
+				{SerialNumber: "AAD-1123", Timestamp: start.Add(40 * time.Microsecond), Value: -0.25},
+			},
+		},
+		"drops other sensors": {
+			input: []SensorMeasurement{
+				{SerialNumber: "AAD-1123", Timestamp: start, Value: 1},
+				{SerialNumber: "AAD-0001", Timestamp: start, Value: 2},
+			},
+			want: []SensorMeasurement{
+				{SerialNumber: "AAD-1123", Timestamp: start, Value: 1},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := MeasurementsFromBatch(NewMeasurementBatch("AAD-1123", tc.input))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i].SerialNumber != tc.want[i].SerialNumber ||
+					!got[i].Timestamp.Equal(tc.want[i].Timestamp) ||
+					got[i].Value != tc.want[i].Value {
+					t.Fatalf("got %v, want %v", got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSensorCommandToProto(t *testing.T) {
+	cm := SensorCommandMessage{
+		SerialNumber: "AAD-1123",
+		Command:      "changeSampleFrequency",
+		Params:       map[string]interface{}{"sampleFrequency": 1000.0, "note": "ignored"},
+	}
+	got := SensorCommandFromProto(SensorCommandToProto(cm))
+	if got.Params["sampleFrequency"] != 1000.0 {
+		t.Fatalf("got %v, want %v", got.Params["sampleFrequency"], 1000.0)
+	}
+	if _, ok := got.Params["note"]; ok {
+		t.Fatalf("got non numeric param %v, want it dropped", got.Params["note"])
+	}
+}
+
+func TestSensorMeasurementBatchRoundTrip(t *testing.T) {
+	want := SensorMeasurementBatch{
+		SerialNumber:    "AAD-1123",
+		StartTime:       time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		SampleFrequency: 25000,
+		Values:          []float64{0.1, 0.12, 0.12, -0.5},
+	}
+
+	for _, compress := range []bool{false, true} {
+		batch := SensorMeasurementBatchToProto(want, compress)
+		if !IsColumnar(batch) {
+			t.Fatalf("compress=%t: got per-sample batch, want columnar", compress)
+		}
+		got, err := SensorMeasurementBatchFromProto(batch)
+		if err != nil {
+			t.Fatalf("compress=%t: unexpected error: %v", compress, err)
+		}
+		if got.SerialNumber != want.SerialNumber || !got.StartTime.Equal(want.StartTime) || got.SampleFrequency != want.SampleFrequency {
+			t.Fatalf("compress=%t: got %v, want %v", compress, got, want)
+		}
+		if len(got.Values) != len(want.Values) {
+			t.Fatalf("compress=%t: got %v, want %v", compress, got.Values, want.Values)
+		}
+		for i := range got.Values {
+			if got.Values[i] != want.Values[i] {
+				t.Fatalf("compress=%t: got %v, want %v", compress, got.Values, want.Values)
+			}
+		}
+	}
+}
+
+// BenchmarkMeasurementPayloadSize compares what one second of 25kHz samples costs on the wire
+// in each format, see the bytes/batch metric.
+func BenchmarkMeasurementPayloadSize(b *testing.B) {
+	const sampleFrequency = 25000
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	batch := SensorMeasurementBatch{
+		SerialNumber:    "AAD-1123",
+		StartTime:       start,
+		SampleFrequency: sampleFrequency,
+		Values:          make([]float64, sampleFrequency),
+	}
+	measurements := make([]SensorMeasurement, sampleFrequency)
+	for i := range measurements {
+		elapsed := float64(i) / sampleFrequency
+		// 16 bit ADC reading of a 5Hz tone, as a real accelerometer would produce
+		value := math.Round(math.Sin(2*math.Pi*5*elapsed)*32767) / 32767
+		batch.Values[i] = value
+		measurements[i] = SensorMeasurement{
+			SerialNumber: "AAD-1123",
+			Timestamp:    start.Add(time.Duration(elapsed * float64(time.Second))),
+			Value:        value,
+		}
+	}
+
+	formats := map[string]func() ([]byte, error){
+		"json per-sample": func() ([]byte, error) {
+			return json.Marshal(measurements)
+		},
+		"protobuf per-sample": func() ([]byte, error) {
+			return proto.Marshal(NewMeasurementBatch("AAD-1123", measurements))
+		},
+		"json columnar": func() ([]byte, error) {
+			return json.Marshal(batch)
+		},
+		"protobuf columnar": func() ([]byte, error) {
+			return proto.Marshal(SensorMeasurementBatchToProto(batch, false))
+		},
+		"protobuf columnar gorilla": func() ([]byte, error) {
+			return proto.Marshal(SensorMeasurementBatchToProto(batch, true))
+		},
+	}
+
+	for name, marshal := range formats {
+		b.Run(name, func(b *testing.B) {
+			var payload []byte
+			for b.Loop() {
+				var err error
+				payload, err = marshal()
+				if err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+			b.ReportMetric(float64(len(payload)), "bytes/batch")
+			b.ReportMetric(float64(len(payload))/sampleFrequency, "bytes/sample")
+		})
+	}
+}
@@ -1,36 +1,48 @@
 package routing
 
-import "os"
-
-// PubSub Broker
-var (
-	RabbitConnString       = os.Getenv("RABBIT_AMQP_CONN_STRING")
-	RabbitMQTTConnString   = os.Getenv("RABBIT_MQTT_CONN_STRING")
-	RabbitStreamConnString = os.Getenv("RABBIT_STREAM_CONN_STRING")
-)
-
 // Streams
 const (
 	StreamConsumerName = "iot"
+
+	// SuperStreamSensorMeasurements is partitioned by sensor, each partition is the stream
+	// <SuperStreamSensorMeasurements>-<n>
+	SuperStreamSensorMeasurements           = "sensor.all.measurements.db_writer"
+	SuperStreamSensorMeasurementsPartitions = 3 // default of the measurements ingester config
 )
 
 // Exchange
 const (
-	ExchangeTopicIoT = "iot" // would be great to test as a direct exchange since it should be faster
+	ExchangeTopicIoT         = "iot"                   // would be great to test as a direct exchange since it should be faster
+	ExchangeTopicDeadLetter  = "iot.deadletter"        // topic as well so dead-lettered messages keep their original routing key
+	ExchangeUnroutable       = "iot.unroutable"        // fanout, alternate exchange of iot for messages no queue is bound for
+	ExchangeMeasurementsHash = "iot.measurements.hash" // consistent hash on the routing key, spreads measurements over the super stream partitions
 )
 
 // Queues follow pattern: entity.id.consumer.type
 const (
-	QueueSensorMeasurements   = "sensor.all.measurements.db_writer" // could be subjected to a sensor id though
-	QueueSensorCommandsFormat = "sensor.%s.commands"                // subjected to sensor id
-	QueueSensorRegistry       = "sensor.all.registry.created"       // could scale up to sensor.all.registry.notifier ??
+	queueSensorCommandsFormat = "sensor.%s.commands"          // subjected to sensor id, see SensorCommandsQueue
+	QueueSensorRegistry       = "sensor.all.registry.created" // could scale up to sensor.all.registry.notifier ??
+	QueueSensorDeregistry     = "sensor.all.registry.deleted"
+	queueSensorCacheFormat    = "sensor.all.registry.cache.%s" // subjected to the instance keeping a SensorCache, each needs every registry event, see SensorCacheQueue
 	QueueSensorLogs           = "sensor.all.logs"
+	QueueSensorDeadLetter     = "sensor.all.deadletter" // quarantine for every message rejected by the consumers above
+	QueueUnroutable           = "iot.unroutable"        // not only sensors may publish mis-addressed messages
 )
 
-// keys are used in consumers with wildcards and in publishers with the specific value
+// keys of sensors are built with the functions in keys.go, these are the catch-all ones
 const (
-	KeySensorMeasurements   = "sensor.%s.measurements"
-	KeySensorCommandsFormat = "sensor.%s.commands"
-	KeySensorRegistryFormat = "sensor.%s.registry"
-	KeySensorLogsFormat     = "sensor.%s.logs"
+	KeyDeadLetter = "#" // dead-letter exchange keeps original routing keys, so quarantine takes them all
+	KeyUnroutable = "#" // ignored by the fanout exchange
+)
+
+// ChannelRegistry actions: requests are what sensors (or the api) ask of the
+// registry, events are what the registry tells once a change is committed. They never share a
+// suffix so the registry does not consume its own events.
+const (
+	RegistryRequestRegister   = "register"
+	RegistryRequestDeregister = "deregister"
+
+	RegistryEventCreated = "created"
+	RegistryEventUpdated = "updated"
+	RegistryEventDeleted = "deleted"
 )
@@ -0,0 +1,11 @@
+package routing
+
+// Message types of the DTOs published over AMQP, their schema versions and upcasters are
+// registered by internal/topology.
+const (
+	MessageTypeSensor              = "sensor"
+	MessageTypeSensorRegistryEvent = "sensor.registry_event"
+	MessageTypeSensorMeasurement   = "sensor.measurement"
+	MessageTypeSensorCommand       = "sensor.command"
+	MessageTypeSensorLog           = "sensor.log"
+)
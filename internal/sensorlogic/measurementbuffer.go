@@ -0,0 +1,235 @@
+package sensorlogic
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+)
+
+const (
+	DefaultFlushRecords = 50_000
+	DefaultFlushAge     = time.Second
+
+	flushRetryMinBackoff = 500 * time.Millisecond
+	flushRetryMaxBackoff = 30 * time.Second
+)
+
+// MeasurementBufferEntry is what one stream message contributes to the buffer.
+type MeasurementBufferEntry struct {
+	Records []storage.SensorMeasurementRecord
+	// Stream and Commit store the position of the message in its stream once its records are
+	// written. Only the last Commit of each stream is called per flush.
+	Stream string
+	Commit func() error
+	// Flushed, if set, is called after the records are written.
+	Flushed func(at time.Time)
+}
+
+type MeasurementBufferConfig struct {
+	// MaxRecords triggers a flush once reached, it also bounds memory to about MaxRecords
+	// plus the records of a single message.
+	MaxRecords int
+	// MaxAge triggers a flush when the oldest buffered entry has waited that long.
+	MaxAge time.Duration
+	// OnFlush, if set, is called after every write attempt.
+	OnFlush func(records int, took time.Duration, err error)
+	// OnDrop, if set, is called with the records given up on because the database rejected
+	// them for good, e.g. a sensor that no longer exists.
+	OnDrop func(records int, err error)
+}
+
+// MeasurementBuffer coalesces the records of many stream messages into large writes. A flush
+// holds the buffer, so while Postgres is slow or down the consumers adding to it block, which
+// is what keeps them from reading further ahead than the buffer can hold.
+type MeasurementBuffer struct {
+	writer storage.MeasurementWriter
+	config MeasurementBufferConfig
+
+	mu      sync.Mutex
+	records []storage.SensorMeasurementRecord
+	commits map[string]func() error
+	flushed []func(at time.Time)
+	oldest  time.Time
+}
+
+func NewMeasurementBuffer(writer storage.MeasurementWriter, config MeasurementBufferConfig) *MeasurementBuffer {
+	if config.MaxRecords <= 0 {
+		config.MaxRecords = DefaultFlushRecords
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = DefaultFlushAge
+	}
+	return &MeasurementBuffer{
+		writer:  writer,
+		config:  config,
+		records: make([]storage.SensorMeasurementRecord, 0, config.MaxRecords),
+		commits: make(map[string]func() error),
+	}
+}
+
+// Add buffers the entry and flushes if the buffer is full, blocking until the flush succeeds
+// or ctx is done. An error means the entry is buffered but nothing was written.
+func (b *MeasurementBuffer) Add(ctx context.Context, entry MeasurementBufferEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.records) == 0 {
+		b.oldest = time.Now()
+	}
+	b.records = append(b.records, entry.Records...)
+	if entry.Commit != nil {
+		b.commits[entry.Stream] = entry.Commit
+	}
+	if entry.Flushed != nil {
+		b.flushed = append(b.flushed, entry.Flushed)
+	}
+
+	if len(b.records) < b.config.MaxRecords {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+// Run flushes entries that waited longer than MaxAge until ctx is done.
+func (b *MeasurementBuffer) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.config.MaxAge / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			if len(b.records) > 0 && time.Since(b.oldest) >= b.config.MaxAge {
+				err := b.flush(ctx)
+				if err != nil {
+					fmt.Printf("measurement buffer flush stopped: %v\n", err)
+				}
+			}
+			b.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush writes whatever is buffered, it is meant for shutdown.
+func (b *MeasurementBuffer) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush(ctx)
+}
+
+// DropSensor removes the buffered records of a sensor, e.g. once it was deleted, and returns
+// how many there were.
+func (b *MeasurementBuffer) DropSensor(sensorID int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	before := len(b.records)
+	b.removeSensors(map[int]struct{}{sensorID: {}})
+	return before - len(b.records)
+}
+
+// flush retries the write with backoff until it succeeds or ctx is done, it must be called
+// with mu held. Only transient errors are retried: when the database rejects the write for
+// good, the records are written sensor by sensor and those of the sensors still rejected are
+// dropped, so that one bad sensor does not hold back every partition.
+func (b *MeasurementBuffer) flush(ctx context.Context) error {
+	if len(b.records) == 0 {
+		return nil
+	}
+
+	backoff := flushRetryMinBackoff
+	for {
+		start := time.Now()
+		err := b.writer.WriteMeasurements(ctx, b.records)
+		if b.config.OnFlush != nil {
+			b.config.OnFlush(len(b.records), time.Since(start), err)
+		}
+		if err == nil {
+			break
+		}
+		if !storage.IsTransient(err) {
+			err = b.writeBySensor(ctx)
+			if err == nil {
+				break
+			}
+		}
+		fmt.Printf("could not flush %d measurements, retrying in %v: %v\n", len(b.records), backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%d measurements left unflushed: %v", len(b.records), ctx.Err())
+		}
+		backoff = min(backoff*2, flushRetryMaxBackoff)
+	}
+
+	// the records are durable, only now may the streams move past them
+	for stream, commit := range b.commits {
+		err := commit()
+		if err != nil {
+			fmt.Printf("could not store offset of %s: %v\n", stream, err)
+		}
+	}
+	now := time.Now()
+	for _, flushed := range b.flushed {
+		flushed(now)
+	}
+
+	b.records = b.records[:0]
+	clear(b.commits)
+	b.flushed = b.flushed[:0]
+	return nil
+}
+
+// writeBySensor writes the buffered records of each sensor on its own, dropping those the
+// database rejects for good. It stops at the first transient error, leaving in the buffer
+// only the records that were not dropped, and must be called with mu held.
+func (b *MeasurementBuffer) writeBySensor(ctx context.Context) error {
+	bySensor := make(map[int][]storage.SensorMeasurementRecord)
+	var sensors []int
+	for _, record := range b.records {
+		if _, ok := bySensor[record.SensorID]; !ok {
+			sensors = append(sensors, record.SensorID)
+		}
+		bySensor[record.SensorID] = append(bySensor[record.SensorID], record)
+	}
+
+	rejected := make(map[int]struct{})
+	defer func() {
+		b.removeSensors(rejected)
+	}()
+	for _, sensorID := range sensors {
+		records := bySensor[sensorID]
+		err := b.writer.WriteMeasurements(ctx, records)
+		if err == nil {
+			continue
+		}
+		if storage.IsTransient(err) {
+			return err
+		}
+		fmt.Printf("dropping %d measurements of sensor %d rejected by the database: %v\n", len(records), sensorID, err)
+		if b.config.OnDrop != nil {
+			b.config.OnDrop(len(records), err)
+		}
+		rejected[sensorID] = struct{}{}
+	}
+	return nil
+}
+
+// removeSensors drops the buffered records of the given sensors, it must be called with mu
+// held.
+func (b *MeasurementBuffer) removeSensors(sensors map[int]struct{}) {
+	if len(sensors) == 0 {
+		return
+	}
+	b.records = slices.DeleteFunc(b.records, func(record storage.SensorMeasurementRecord) bool {
+		_, ok := sensors[record.SensorID]
+		return ok
+	})
+}
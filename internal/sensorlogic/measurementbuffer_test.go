@@ -0,0 +1,219 @@
+package sensorlogic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestMeasurementBufferAdd(t *testing.T) {
+	tests := map[string]struct {
+		maxRecords  int
+		entries     []int // records per entry, all on the same stream
+		wantWrites  []int
+		wantCommits []int // index of the entry whose commit was called
+	}{
+		"below max records nothing is written": {
+			maxRecords: 10,
+			entries:    []int{3, 3},
+		},
+		"reaching max records flushes everything buffered": {
+			maxRecords:  5,
+			entries:     []int{3, 3, 1},
+			wantWrites:  []int{6},
+			wantCommits: []int{1},
+		},
+		"only the last commit of a stream is called": {
+			maxRecords:  4,
+			entries:     []int{1, 1, 1, 1, 2, 2},
+			wantWrites:  []int{4, 4},
+			wantCommits: []int{3, 5},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var writes, commits []int
+			buffer := NewMeasurementBuffer(
+				storage.MeasurementWriterFunc(func(ctx context.Context, records []storage.SensorMeasurementRecord) error {
+					writes = append(writes, len(records))
+					return nil
+				}),
+				MeasurementBufferConfig{MaxRecords: tc.maxRecords, MaxAge: time.Hour},
+			)
+
+			for i, n := range tc.entries {
+				err := buffer.Add(context.Background(), MeasurementBufferEntry{
+					Records: make([]storage.SensorMeasurementRecord, n),
+					Stream:  "partition-0",
+					Commit: func() error {
+						commits = append(commits, i)
+						return nil
+					},
+				})
+				if err != nil {
+					t.Fatalf("got error %v, want nil", err)
+				}
+			}
+
+			if !equalInts(writes, tc.wantWrites) {
+				t.Fatalf("got writes %v, want %v", writes, tc.wantWrites)
+			}
+			if !equalInts(commits, tc.wantCommits) {
+				t.Fatalf("got commits %v, want %v", commits, tc.wantCommits)
+			}
+		})
+	}
+}
+
+func TestMeasurementBufferFailedFlushDoesNotCommit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	committed := false
+	buffer := NewMeasurementBuffer(
+		storage.MeasurementWriterFunc(func(ctx context.Context, records []storage.SensorMeasurementRecord) error {
+			return errors.New("database unavailable")
+		}),
+		MeasurementBufferConfig{MaxRecords: 1, MaxAge: time.Hour},
+	)
+
+	err := buffer.Add(ctx, MeasurementBufferEntry{
+		Records: make([]storage.SensorMeasurementRecord, 1),
+		Stream:  "partition-0",
+		Commit: func() error {
+			committed = true
+			return nil
+		},
+	})
+	if err == nil {
+		t.Fatalf("got nil error, want the flush to give up")
+	}
+	if committed {
+		t.Fatalf("got offset committed, want it held back until the records are written")
+	}
+
+	// what was buffered is still there for the shutdown flush
+	buffer.writer = storage.MeasurementWriterFunc(func(ctx context.Context, records []storage.SensorMeasurementRecord) error {
+		return nil
+	})
+	err = buffer.Flush(context.Background())
+	if err != nil || !committed {
+		t.Fatalf("got error %v and committed %v, want nil and true", err, committed)
+	}
+}
+
+func TestMeasurementBufferDropsRejectedSensors(t *testing.T) {
+	var written []int
+	dropped := 0
+	buffer := NewMeasurementBuffer(
+		storage.MeasurementWriterFunc(func(ctx context.Context, records []storage.SensorMeasurementRecord) error {
+			for _, record := range records {
+				if record.SensorID == 2 {
+					// foreign key violation, the sensor was deleted
+					return &pgconn.PgError{Code: "23503"}
+				}
+			}
+			for _, record := range records {
+				written = append(written, record.SensorID)
+			}
+			return nil
+		}),
+		MeasurementBufferConfig{
+			MaxRecords: 4,
+			MaxAge:     time.Hour,
+			OnDrop: func(records int, err error) {
+				dropped += records
+			},
+		},
+	)
+
+	committed := false
+	err := buffer.Add(context.Background(), MeasurementBufferEntry{
+		Records: []storage.SensorMeasurementRecord{{SensorID: 1}, {SensorID: 2}, {SensorID: 1}, {SensorID: 2}},
+		Stream:  "partition-0",
+		Commit: func() error {
+			committed = true
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if !equalInts(written, []int{1, 1}) || dropped != 2 || !committed {
+		t.Fatalf("got written %v, dropped %d and committed %v, want [1 1], 2 and true", written, dropped, committed)
+	}
+}
+
+func TestMeasurementBufferDropSensor(t *testing.T) {
+	var written []int
+	buffer := NewMeasurementBuffer(
+		storage.MeasurementWriterFunc(func(ctx context.Context, records []storage.SensorMeasurementRecord) error {
+			for _, record := range records {
+				written = append(written, record.SensorID)
+			}
+			return nil
+		}),
+		MeasurementBufferConfig{MaxRecords: 100, MaxAge: time.Hour},
+	)
+
+	err := buffer.Add(context.Background(), MeasurementBufferEntry{
+		Records: []storage.SensorMeasurementRecord{{SensorID: 1}, {SensorID: 2}, {SensorID: 2}},
+	})
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	dropped := buffer.DropSensor(2)
+	if dropped != 2 {
+		t.Fatalf("got %d records dropped, want 2", dropped)
+	}
+	err = buffer.Flush(context.Background())
+	if err != nil || !equalInts(written, []int{1}) {
+		t.Fatalf("got error %v and written %v, want nil and [1]", err, written)
+	}
+}
+
+func TestMeasurementBufferRunFlushesOldEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flushed := make(chan int, 1)
+	buffer := NewMeasurementBuffer(
+		storage.MeasurementWriterFunc(func(ctx context.Context, records []storage.SensorMeasurementRecord) error {
+			flushed <- len(records)
+			return nil
+		}),
+		MeasurementBufferConfig{MaxRecords: 100, MaxAge: 20 * time.Millisecond},
+	)
+	go buffer.Run(ctx)
+
+	err := buffer.Add(ctx, MeasurementBufferEntry{Records: make([]storage.SensorMeasurementRecord, 3)})
+	if err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+
+	select {
+	case n := <-flushed:
+		if n != 3 {
+			t.Fatalf("got %d records flushed, want 3", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("got no flush, want one after max age")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package sensorlogic
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
+)
+
+// cacheMissTTL is how long a serial number not found in the database is taken as unknown
+// before the database is asked again, so an unregistered sensor costs one query per TTL
+// instead of one per message.
+const cacheMissTTL = 5 * time.Second
+
+// DefaultSensorCacheRefreshInterval is the full reload period. Registry events keep the cache
+// up to date in between, the reload only covers events that were lost.
+const DefaultSensorCacheRefreshInterval = 5 * time.Minute
+
+type SensorCache struct {
+	mu          sync.RWMutex
+	mapping     map[string]int
+	misses      map[string]time.Time // serial numbers not in the database, and when they were looked up
+	lastRefresh time.Time
+	lastEvent   time.Time
+	db          *storage.DB
+
+	hits         atomic.Int64
+	lookupMisses atomic.Int64
+}
+
+// SensorCacheStats is a snapshot of the cache counters, for metrics.
+type SensorCacheStats struct {
+	Size        int
+	Hits        int64 // lookups answered by the cache
+	Misses      int64 // lookups that went to the database
+	LastRefresh time.Time
+	LastEvent   time.Time
+}
+
+func newSensorCache(db *storage.DB) *SensorCache {
+	return &SensorCache{
+		db:      db,
+		mapping: make(map[string]int),
+		misses:  make(map[string]time.Time),
+	}
+}
+
+func NewSensorCache(ctx context.Context, db *storage.DB) (*SensorCache, error) {
+	cache := newSensorCache(db)
+
+	// initial fetch (refresh is stated for refreshing, but it could be used here to state it on init)
+	err := cache.refresh(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed initial sensor cache load: %v", err)
+	}
+
+	return cache, nil
+}
+
+func (sc *SensorCache) refresh(ctx context.Context) error {
+	sensorMap, err := sc.db.GetSensorIDBySerialNumberMap(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sensor IDs: %v", err)
+	}
+	sc.mu.Lock()
+	sc.mapping = sensorMap
+	clear(sc.misses)
+	sc.lastRefresh = time.Now()
+	sc.mu.Unlock()
+
+	fmt.Printf("[%s] Sensor cache refreshed: %d sensors loaded\n", time.Now().Format(time.RFC3339), len(sensorMap))
+
+	return nil
+}
+
+// StartRefreshLoop reloads the whole cache every interval, as a safety net for registry
+// events that did not make it.
+func (sc *SensorCache) StartRefreshLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := sc.refresh(ctx)
+			if err != nil {
+				fmt.Printf("ERROR: sensor cache refresh failed: %v\n", err)
+			}
+			// the registry replays them on registration, this catches what was held after that
+			err = ReplayPendingMeasurements(ctx, sc.db)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+			}
+		case <-ctx.Done():
+			fmt.Println("Sensor cache refresh loop stopped")
+			return
+		}
+	}
+}
+
+// Apply updates the cache with a registry event. A refresh that read the sensor table before
+// the change was committed may undo it, until the next event or refresh of that sensor.
+func (sc *SensorCache) Apply(event routing.SensorRegistryEvent) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	switch event.Type {
+	case routing.RegistryEventCreated, routing.RegistryEventUpdated:
+		sc.mapping[event.SerialNumber] = event.SensorID
+		delete(sc.misses, event.SerialNumber)
+	case routing.RegistryEventDeleted:
+		delete(sc.mapping, event.SerialNumber)
+	default:
+		return fmt.Errorf("unknown registry event type %q", event.Type)
+	}
+	sc.lastEvent = time.Now()
+	return nil
+}
+
+func (sc *SensorCache) Get(serialNumber string) (int, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	id, exists := sc.mapping[serialNumber]
+	return id, exists
+}
+
+// Lookup is Get falling back to the database for a serial number the cache does not know,
+// e.g. a sensor whose registry event is still on its way. Serial numbers the database does
+// not know either are not looked up again for cacheMissTTL.
+func (sc *SensorCache) Lookup(ctx context.Context, serialNumber string) (int, bool, error) {
+	sc.mu.RLock()
+	id, exists := sc.mapping[serialNumber]
+	missedAt, missed := sc.misses[serialNumber]
+	sc.mu.RUnlock()
+
+	if exists {
+		sc.hits.Add(1)
+		return id, true, nil
+	}
+	if missed && time.Since(missedAt) < cacheMissTTL {
+		sc.hits.Add(1) // known to be unknown
+		return 0, false, nil
+	}
+	sc.lookupMisses.Add(1)
+
+	id, found, err := sc.db.LookupSensorIDBySerialNumber(ctx, serialNumber)
+	if err != nil {
+		return 0, false, err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if found {
+		sc.mapping[serialNumber] = id
+		delete(sc.misses, serialNumber)
+	} else {
+		sc.misses[serialNumber] = time.Now()
+	}
+	return id, found, nil
+}
+
+func (sc *SensorCache) GetAll() map[string]int {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	mapCopy := make(map[string]int, len(sc.mapping)) // to avoid race conditions
+	maps.Copy(mapCopy, sc.mapping)
+	return mapCopy
+}
+
+func (sc *SensorCache) Stats() SensorCacheStats {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return SensorCacheStats{
+		Size:        len(sc.mapping),
+		Hits:        sc.hits.Load(),
+		Misses:      sc.lookupMisses.Load(),
+		LastRefresh: sc.lastRefresh,
+		LastEvent:   sc.lastEvent,
+	}
+}
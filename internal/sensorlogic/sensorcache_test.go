@@ -0,0 +1,77 @@
+package sensorlogic
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+)
+
+func TestSensorCacheApply(t *testing.T) {
+	tests := map[string]struct {
+		initial  map[string]int
+		event    routing.SensorRegistryEvent
+		wantID   int
+		wantSeen bool
+		wantErr  bool
+	}{
+		"created sensor is added": {
+			initial:  map[string]int{},
+			event:    routing.SensorRegistryEvent{Type: routing.RegistryEventCreated, SensorID: 3, SerialNumber: "NEW-0001"},
+			wantID:   3,
+			wantSeen: true,
+		},
+		"updated sensor keeps its id": {
+			initial:  map[string]int{"AAD-1123": 1},
+			event:    routing.SensorRegistryEvent{Type: routing.RegistryEventUpdated, SensorID: 1, SerialNumber: "AAD-1123", SampleFrequency: 200},
+			wantID:   1,
+			wantSeen: true,
+		},
+		"deleted sensor is removed": {
+			initial:  map[string]int{"AAD-1123": 1},
+			event:    routing.SensorRegistryEvent{Type: routing.RegistryEventDeleted, SensorID: 1, SerialNumber: "AAD-1123"},
+			wantSeen: false,
+		},
+		"unknown event type is rejected": {
+			initial:  map[string]int{"AAD-1123": 1},
+			event:    routing.SensorRegistryEvent{Type: "renamed", SerialNumber: "AAD-1123"},
+			wantID:   1,
+			wantSeen: true,
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newSensorCache(nil)
+			cache.mapping = tc.initial
+
+			err := cache.Apply(tc.event)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+
+			id, seen := cache.Get(tc.event.SerialNumber)
+			if seen != tc.wantSeen || id != tc.wantID {
+				t.Fatalf("got %d, %v, want %d, %v", id, seen, tc.wantID, tc.wantSeen)
+			}
+		})
+	}
+}
+
+func TestSensorCacheLookupCountsHits(t *testing.T) {
+	cache := newSensorCache(nil)
+	cache.mapping = map[string]int{"AAD-1123": 1}
+
+	for range 3 {
+		_, found, err := cache.Lookup(context.Background(), "AAD-1123")
+		if err != nil || !found {
+			t.Fatalf("got found %v and error %v, want true and nil", found, err)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 3 || stats.Misses != 0 || stats.Size != 1 {
+		t.Fatalf("got %+v, want 3 hits, 0 misses and size 1", stats)
+	}
+}
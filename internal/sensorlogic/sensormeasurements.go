@@ -2,112 +2,147 @@ package sensorlogic
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"maps"
-	"sync"
 	"time"
 
 	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
 	"github.com/iferdel/sensor-data-streaming-server/internal/storage"
 )
 
-type SensorCache struct {
-	mu          sync.RWMutex
-	mapping     map[string]int
-	lastRefresh time.Time
-	db          *storage.DB
+// ErrInvalidMeasurementBatch means the batch cannot be stored as sent, retrying does not help.
+var ErrInvalidMeasurementBatch = errors.New("non valid measurement batch")
+
+// pendingMeasurementsTTL is how long measurements of a sensor that does not register are held.
+const pendingMeasurementsTTL = 24 * time.Hour
+
+// MeasurementsSplit holds the records of registered sensors, ready to be written, apart from
+// the measurements of unknown ones, to be held until they register.
+type MeasurementsSplit struct {
+	Records []storage.SensorMeasurementRecord
+	Pending []storage.PendingMeasurementRecord
 }
 
-func NewSensorCache(ctx context.Context, db *storage.DB) (*SensorCache, error) {
-	cache := &SensorCache{
-		db:      db,
-		mapping: make(map[string]int),
-	}
+// SplitMeasurements maps measurements of registered sensors to records, resolve returns the
+// sensor ID of a serial number and whether it is registered.
+func SplitMeasurements(dtos []routing.SensorMeasurement, resolve func(serialNumber string) (int, bool, error)) (MeasurementsSplit, error) {
+	var split MeasurementsSplit
+	split.Records = make([]storage.SensorMeasurementRecord, 0, len(dtos))
 
-	// initial fetch (refresh is stated for refreshing, but it could be used here to state it on init)
-	err := cache.refresh(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed initial sensor cache load: %v", err)
+	for _, dto := range dtos {
+		sensorID, exists, err := resolve(dto.SerialNumber)
+		if err != nil {
+			return MeasurementsSplit{}, fmt.Errorf("failed to resolve sensor %s: %v", dto.SerialNumber, err)
+		}
+		if !exists {
+			split.Pending = append(split.Pending, storage.PendingMeasurementRecord{
+				SerialNumber: dto.SerialNumber,
+				Timestamp:    dto.Timestamp,
+				Measurement:  dto.Value,
+			})
+			continue
+		}
+
+		// Map DTO -to- DB Record
+		split.Records = append(split.Records, storage.SensorMeasurementRecord{
+			Timestamp:   dto.Timestamp,
+			SensorID:    sensorID,
+			Measurement: dto.Value,
+		})
 	}
 
-	return cache, nil
+	return split, nil
 }
 
-func (sc *SensorCache) refresh(ctx context.Context) error {
-	sensorMap, err := sc.db.GetSensorIDBySerialNumberMap(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to fetch sensor IDs: %v", err)
+// SplitMeasurementBatch is SplitMeasurements for a columnar batch, whose samples all go to
+// one side or the other.
+func SplitMeasurementBatch(batch routing.SensorMeasurementBatch, resolve func(serialNumber string) (int, bool, error)) (MeasurementsSplit, error) {
+	if batch.SampleFrequency <= 0 {
+		return MeasurementsSplit{}, fmt.Errorf("%w: sample frequency %v of sensor %s", ErrInvalidMeasurementBatch, batch.SampleFrequency, batch.SerialNumber)
 	}
-	sc.mu.Lock()
-	sc.mapping = sensorMap
-	sc.lastRefresh = time.Now()
-	sc.mu.Unlock()
 
-	fmt.Printf("[%s] Sensor cache refreshed: %d sensors loaded\n", time.Now().Format(time.RFC3339), len(sensorMap))
-
-	return nil
-}
+	sensorID, exists, err := resolve(batch.SerialNumber)
+	if err != nil {
+		return MeasurementsSplit{}, fmt.Errorf("failed to resolve sensor %s: %v", batch.SerialNumber, err)
+	}
+	if exists {
+		return MeasurementsSplit{Records: ExpandMeasurementBatch(batch, sensorID)}, nil
+	}
 
-func (sc *SensorCache) StartRefreshLoop(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			err := sc.refresh(ctx)
-			if err != nil {
-				fmt.Printf("ERROR: sensor cache refresh failed: %v\n", err)
-			}
-		case <-ctx.Done():
-			fmt.Println("Sensor cache refresh loop stopped")
-			return
+	records := ExpandMeasurementBatch(batch, 0)
+	pending := make([]storage.PendingMeasurementRecord, len(records))
+	for i, record := range records {
+		pending[i] = storage.PendingMeasurementRecord{
+			SerialNumber: batch.SerialNumber,
+			Timestamp:    record.Timestamp,
+			Measurement:  record.Measurement,
 		}
 	}
+	return MeasurementsSplit{Pending: pending}, nil
 }
 
-func (sc *SensorCache) Get(serialNumber string) (int, bool) {
-	sc.mu.RLock()
-	defer sc.mu.RUnlock()
-	id, exists := sc.mapping[serialNumber]
-	return id, exists
+// CacheResolver resolves serial numbers with the cache, looking up misses in the database.
+func CacheResolver(ctx context.Context, cache *SensorCache) func(serialNumber string) (int, bool, error) {
+	return func(serialNumber string) (int, bool, error) {
+		return cache.Lookup(ctx, serialNumber)
+	}
 }
 
-func (sc *SensorCache) GetAll() map[string]int {
-	sc.mu.RLock()
-	defer sc.mu.RUnlock()
-	mapCopy := make(map[string]int, len(sc.mapping)) // to avoid race conditions
-	maps.Copy(mapCopy, sc.mapping)
-	return mapCopy
+// MapResolver resolves serial numbers with a snapshot of the sensor table.
+func MapResolver(sensorMap map[string]int) func(serialNumber string) (int, bool, error) {
+	return func(serialNumber string) (int, bool, error) {
+		sensorID, exists := sensorMap[serialNumber]
+		return sensorID, exists, nil
+	}
 }
 
-func HandleMeasurementsWithCache(ctx context.Context, cache *SensorCache, db *storage.DB, dtos []routing.SensorMeasurement) error {
-	sensorMap := cache.GetAll()
-
-	records := make([]storage.SensorMeasurementRecord, len(dtos))
-
-	for i, dto := range dtos {
+// HoldPendingMeasurements stores the measurements of unknown sensors until they register.
+func HoldPendingMeasurements(ctx context.Context, db *storage.DB, pending []storage.PendingMeasurementRecord) error {
+	if err := db.WritePendingMeasurements(ctx, pending); err != nil {
+		return fmt.Errorf("failed to hold measurements of unknown sensors: %w", err)
+	}
+	return nil
+}
 
-		sensorID, exists := sensorMap[dto.SerialNumber]
-		if !exists {
-			return fmt.Errorf("sensor serial number not found: %s", dto.SerialNumber)
-		}
+// ReplayPendingMeasurements moves held measurements of sensors registered by now to the
+// measurements table, and drops those held for too long.
+func ReplayPendingMeasurements(ctx context.Context, db *storage.DB) error {
+	replayed, err := db.ReplayPendingMeasurements(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to replay pending measurements: %v", err)
+	}
+	if replayed > 0 {
+		fmt.Printf("Replayed %d pending measurements of newly registered sensors\n", replayed)
+	}
 
-		// Map DTO -to- DB Record
-		records[i] = storage.SensorMeasurementRecord{
-			Timestamp:   dto.Timestamp,
-			SensorID:    sensorID,
-			Measurement: dto.Value,
-		}
+	purged, err := db.PurgePendingMeasurements(ctx, pendingMeasurementsTTL)
+	if err != nil {
+		return fmt.Errorf("failed to purge pending measurements: %v", err)
 	}
+	if purged > 0 {
+		fmt.Printf("Purged %d pending measurements of sensors that never registered\n", purged)
+	}
+	return nil
+}
 
-	if err := db.BatchArrayWriteMeasurement(ctx, records); err != nil {
+func writeMeasurementsSplit(ctx context.Context, db *storage.DB, split MeasurementsSplit) error {
+	if err := HoldPendingMeasurements(ctx, db, split.Pending); err != nil {
+		return err
+	}
+	if err := db.BatchArrayWriteMeasurement(ctx, split.Records); err != nil {
 		return fmt.Errorf("failed to write measurement: %v", err)
 	}
-
 	return nil
 }
 
+func HandleMeasurementsWithCache(ctx context.Context, cache *SensorCache, db *storage.DB, dtos []routing.SensorMeasurement) error {
+	split, err := SplitMeasurements(dtos, CacheResolver(ctx, cache))
+	if err != nil {
+		return err
+	}
+	return writeMeasurementsSplit(ctx, db, split)
+}
+
 func HandleMeasurements(ctx context.Context, db *storage.DB, dtos []routing.SensorMeasurement) error {
 
 	sensorMap, err := db.GetSensorIDBySerialNumberMap(ctx)
@@ -115,26 +150,46 @@ func HandleMeasurements(ctx context.Context, db *storage.DB, dtos []routing.Sens
 		return fmt.Errorf("failed to fetch sensor IDs: %v", err)
 	}
 
-	records := make([]storage.SensorMeasurementRecord, len(dtos))
-	for i, dto := range dtos {
-
-		sensorID, exists := sensorMap[dto.SerialNumber]
-		if !exists {
-			return fmt.Errorf("sensor serial number not found: %s", dto.SerialNumber)
-		}
+	split, err := SplitMeasurements(dtos, MapResolver(sensorMap))
+	if err != nil {
+		return err
+	}
+	return writeMeasurementsSplit(ctx, db, split)
+}
 
-		// Map DTO -to- DB Record
+// ExpandMeasurementBatch turns a columnar batch back into one record per sample, placing
+// sample i at StartTime + i/SampleFrequency. Offsets are computed from the start instead of
+// accumulated so rounding does not drift over long batches.
+func ExpandMeasurementBatch(batch routing.SensorMeasurementBatch, sensorID int) []storage.SensorMeasurementRecord {
+	records := make([]storage.SensorMeasurementRecord, len(batch.Values))
+	for i, value := range batch.Values {
+		offset := time.Duration(float64(i) * float64(time.Second) / batch.SampleFrequency)
 		records[i] = storage.SensorMeasurementRecord{
-			Timestamp:   dto.Timestamp,
+			Timestamp:   batch.StartTime.Add(offset),
 			SensorID:    sensorID,
-			Measurement: dto.Value,
+			Measurement: value,
 		}
+	}
+	return records
+}
 
+func HandleMeasurementBatchWithCache(ctx context.Context, cache *SensorCache, db *storage.DB, batch routing.SensorMeasurementBatch) error {
+	split, err := SplitMeasurementBatch(batch, CacheResolver(ctx, cache))
+	if err != nil {
+		return err
 	}
+	return writeMeasurementsSplit(ctx, db, split)
+}
 
-	if err := db.BatchArrayWriteMeasurement(ctx, records); err != nil {
-		return fmt.Errorf("failed to write measurement: %v", err)
+func HandleMeasurementBatch(ctx context.Context, db *storage.DB, batch routing.SensorMeasurementBatch) error {
+	sensorMap, err := db.GetSensorIDBySerialNumberMap(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sensor IDs: %v", err)
 	}
 
-	return nil
+	split, err := SplitMeasurementBatch(batch, MapResolver(sensorMap))
+	if err != nil {
+		return err
+	}
+	return writeMeasurementsSplit(ctx, db, split)
 }
@@ -0,0 +1,144 @@
+package sensorlogic
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+)
+
+func TestExpandMeasurementBatch(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		input     routing.SensorMeasurementBatch
+		wantLast  time.Time
+		wantCount int
+	}{
+		"empty batch": {
+			input:     routing.SensorMeasurementBatch{StartTime: start, SampleFrequency: 1000},
+			wantCount: 0,
+		},
+		"one second at 25kHz": {
+			input: routing.SensorMeasurementBatch{
+				StartTime:       start,
+				SampleFrequency: 25000,
+				Values:          make([]float64, 25000),
+			},
+			wantLast:  start.Add(time.Second - 40*time.Microsecond),
+			wantCount: 25000,
+		},
+		"non integer period does not drift": {
+			input: routing.SensorMeasurementBatch{
+				StartTime:       start,
+				SampleFrequency: 3,
+				Values:          make([]float64, 4),
+			},
+			wantLast:  start.Add(time.Second),
+			wantCount: 4,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := ExpandMeasurementBatch(tc.input, 7)
+			if len(got) != tc.wantCount {
+				t.Fatalf("got %d records, want %d", len(got), tc.wantCount)
+			}
+			if tc.wantCount == 0 {
+				return
+			}
+			if !got[0].Timestamp.Equal(start) {
+				t.Fatalf("got first timestamp %v, want %v", got[0].Timestamp, start)
+			}
+			if last := got[len(got)-1]; !last.Timestamp.Equal(tc.wantLast) || last.SensorID != 7 {
+				t.Fatalf("got last record %v, want timestamp %v and sensor 7", last, tc.wantLast)
+			}
+		})
+	}
+}
+
+func TestSplitMeasurements(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	resolve := MapResolver(map[string]int{"AAD-1123": 1, "BBB-3423": 2})
+
+	tests := map[string]struct {
+		input       []routing.SensorMeasurement
+		wantRecords int
+		wantPending []string
+	}{
+		"all registered": {
+			input: []routing.SensorMeasurement{
+				{SerialNumber: "AAD-1123", Timestamp: now, Value: 1},
+				{SerialNumber: "BBB-3423", Timestamp: now, Value: 2},
+			},
+			wantRecords: 2,
+		},
+		"unknown sensor does not fail the rest": {
+			input: []routing.SensorMeasurement{
+				{SerialNumber: "AAD-1123", Timestamp: now, Value: 1},
+				{SerialNumber: "NEW-0001", Timestamp: now, Value: 2},
+				{SerialNumber: "BBB-3423", Timestamp: now, Value: 3},
+			},
+			wantRecords: 2,
+			wantPending: []string{"NEW-0001"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := SplitMeasurements(tc.input, resolve)
+			if err != nil {
+				t.Fatalf("got error %v, want nil", err)
+			}
+			if len(got.Records) != tc.wantRecords {
+				t.Fatalf("got %d records, want %d", len(got.Records), tc.wantRecords)
+			}
+			if len(got.Pending) != len(tc.wantPending) {
+				t.Fatalf("got %d pending, want %d", len(got.Pending), len(tc.wantPending))
+			}
+			for i, pending := range got.Pending {
+				if pending.SerialNumber != tc.wantPending[i] {
+					t.Fatalf("got pending %s, want %s", pending.SerialNumber, tc.wantPending[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitMeasurementBatch(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	resolve := MapResolver(map[string]int{"AAD-1123": 1})
+
+	tests := map[string]struct {
+		input       routing.SensorMeasurementBatch
+		wantRecords int
+		wantPending int
+		wantErr     error
+	}{
+		"registered sensor": {
+			input:       routing.SensorMeasurementBatch{SerialNumber: "AAD-1123", StartTime: start, SampleFrequency: 10, Values: make([]float64, 10)},
+			wantRecords: 10,
+		},
+		"unknown sensor is held whole": {
+			input:       routing.SensorMeasurementBatch{SerialNumber: "NEW-0001", StartTime: start, SampleFrequency: 10, Values: make([]float64, 10)},
+			wantPending: 10,
+		},
+		"non valid sample frequency": {
+			input:   routing.SensorMeasurementBatch{SerialNumber: "AAD-1123", StartTime: start, Values: make([]float64, 10)},
+			wantErr: ErrInvalidMeasurementBatch,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := SplitMeasurementBatch(tc.input, resolve)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			if len(got.Records) != tc.wantRecords || len(got.Pending) != tc.wantPending {
+				t.Fatalf("got %d records and %d pending, want %d and %d", len(got.Records), len(got.Pending), tc.wantRecords, tc.wantPending)
+			}
+		})
+	}
+}
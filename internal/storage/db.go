@@ -3,16 +3,10 @@ package storage
 import (
 	"context"
 	"fmt"
-	"os"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// Relational Database
-var (
-	PostgresConnString = os.Getenv("POSTGRES_CONN_STRING")
-)
-
 type DB struct {
 	pool *pgxpool.Pool
 }
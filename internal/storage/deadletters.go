@@ -0,0 +1,165 @@
+/*
+- Contains CRUD operations for dead_letter table.
+- Rows are quarantined messages that consumers rejected, kept for operators to inspect.
+*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+func (db *DB) WriteDeadLetter(ctx context.Context, dl DeadLetterRecord) error {
+
+	queryInsertDeadLetter := `
+		INSERT INTO dead_letter (reason, source_queue, routing_key, serial_number, content_type, headers, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	;`
+
+	_, err := db.pool.Exec(ctx, queryInsertDeadLetter,
+		dl.Reason,
+		dl.SourceQueue,
+		dl.RoutingKey,
+		dl.SerialNumber,
+		dl.ContentType,
+		dl.Headers,
+		dl.Payload,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to insert dead letter into database: %v", err)
+	}
+	fmt.Printf("Quarantined message from `%s` (%s) into `dead_letter` table\n", dl.RoutingKey, dl.Reason)
+
+	return nil
+}
+
+func (db *DB) GetDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetterRecord, error) {
+
+	where, args := filter.where()
+	query := `
+		SELECT id, received_at, reason, source_queue, routing_key, COALESCE(serial_number, ''), COALESCE(content_type, ''), headers
+		FROM dead_letter` + where + `
+		ORDER BY received_at DESC`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get dead letters: %v", err)
+	}
+	defer rows.Close()
+
+	var deadLetters []DeadLetterRecord
+
+	for rows.Next() {
+		var dl DeadLetterRecord
+		err = rows.Scan(
+			&dl.ID,
+			&dl.ReceivedAt,
+			&dl.Reason,
+			&dl.SourceQueue,
+			&dl.RoutingKey,
+			&dl.SerialNumber,
+			&dl.ContentType,
+			&dl.Headers,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	return deadLetters, nil
+}
+
+func (db *DB) GetDeadLetter(ctx context.Context, id int64) (dl DeadLetterRecord, err error) {
+
+	queryGetDeadLetter := `
+		SELECT id, received_at, reason, source_queue, routing_key, COALESCE(serial_number, ''), COALESCE(content_type, ''), headers, payload
+		FROM dead_letter
+		WHERE id = ($1)
+	;`
+
+	err = db.pool.QueryRow(ctx, queryGetDeadLetter, id).Scan(
+		&dl.ID,
+		&dl.ReceivedAt,
+		&dl.Reason,
+		&dl.SourceQueue,
+		&dl.RoutingKey,
+		&dl.SerialNumber,
+		&dl.ContentType,
+		&dl.Headers,
+		&dl.Payload,
+	)
+	if err != nil {
+		return DeadLetterRecord{}, fmt.Errorf("unable to query dead letter: %w", err)
+	}
+
+	return dl, nil
+}
+
+func (db *DB) DeleteDeadLetter(ctx context.Context, id int64) error {
+
+	queryDeleteDeadLetter := `DELETE FROM dead_letter WHERE id = ($1);`
+
+	_, err := db.pool.Exec(ctx, queryDeleteDeadLetter, id)
+	if err != nil {
+		return fmt.Errorf("unable to delete dead letter from database: %v", err)
+	}
+
+	return nil
+}
+
+// PurgeDeadLetters deletes every dead letter matching the filter (Limit is ignored) and
+// returns how many were deleted.
+func (db *DB) PurgeDeadLetters(ctx context.Context, filter DeadLetterFilter) (int64, error) {
+
+	where, args := filter.where()
+	queryPurgeDeadLetters := `DELETE FROM dead_letter` + where
+
+	tag, err := db.pool.Exec(ctx, queryPurgeDeadLetters, args...)
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge dead letters from database: %v", err)
+	}
+	fmt.Printf("Purged %d rows from `dead_letter` table\n", tag.RowsAffected())
+
+	return tag.RowsAffected(), nil
+}
+
+func (f DeadLetterFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.RoutingKey != "" {
+		add("routing_key = $%d", f.RoutingKey)
+	}
+	if f.SerialNumber != "" {
+		add("serial_number = $%d", f.SerialNumber)
+	}
+	if f.Reason != "" {
+		add("reason = $%d", f.Reason)
+	}
+	if !f.Since.IsZero() {
+		add("received_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("received_at < $%d", f.Until)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
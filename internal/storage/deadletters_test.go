@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadLetterFilterWhere(t *testing.T) {
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		input     DeadLetterFilter
+		wantWhere string
+		wantArgs  int
+	}{
+		"no filter": {
+			input:     DeadLetterFilter{},
+			wantWhere: "",
+			wantArgs:  0,
+		},
+		"sensor and reason": {
+			input:     DeadLetterFilter{SerialNumber: "AAD-1123", Reason: "rejected"},
+			wantWhere: " WHERE serial_number = $1 AND reason = $2",
+			wantArgs:  2,
+		},
+		"limit is not part of the where clause": {
+			input:     DeadLetterFilter{RoutingKey: "sensor.AAD-1123.logs", Since: since, Limit: 10},
+			wantWhere: " WHERE routing_key = $1 AND received_at >= $2",
+			wantArgs:  2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			gotWhere, gotArgs := tc.input.where()
+			if tc.wantWhere != gotWhere {
+				t.Fatalf("got %q, want %q", gotWhere, tc.wantWhere)
+			}
+			if tc.wantArgs != len(gotArgs) {
+				t.Fatalf("got %v args, want %v", len(gotArgs), tc.wantArgs)
+			}
+		})
+	}
+}
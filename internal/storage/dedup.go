@@ -0,0 +1,78 @@
+/*
+- Contains operations for processed_message table.
+- Rows are ids of messages a consumer handled, so their redeliveries are dropped.
+*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DedupStore remembers the messages a consumer handled in the processed_message table, so
+// redeliveries are recognized across restarts and by every instance of the consumer. It is
+// the pubsub.DedupStore of consumers that cannot afford handling a message twice.
+type DedupStore struct {
+	db       *DB
+	consumer string
+	ttl      time.Duration
+}
+
+// DedupStore returns the store of a consumer (e.g. its queue name), which forgets messages
+// handled longer than ttl ago.
+func (db *DB) DedupStore(consumer string, ttl time.Duration) *DedupStore {
+	return &DedupStore{db: db, consumer: consumer, ttl: ttl}
+}
+
+func (s *DedupStore) Seen(ctx context.Context, messageID string) (bool, error) {
+
+	querySeen := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM processed_message
+			WHERE consumer = $1 AND message_id = $2 AND processed_at > NOW() - $3::interval
+		)
+	;`
+
+	var seen bool
+	err := s.db.pool.QueryRow(ctx, querySeen, s.consumer, messageID, s.ttl).Scan(&seen)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up processed message: %v", err)
+	}
+
+	return seen, nil
+}
+
+func (s *DedupStore) Mark(ctx context.Context, messageID string) error {
+
+	queryMark := `
+		INSERT INTO processed_message (consumer, message_id)
+		VALUES ($1, $2)
+		ON CONFLICT (consumer, message_id) DO UPDATE SET processed_at = NOW()
+	;`
+
+	_, err := s.db.pool.Exec(ctx, queryMark, s.consumer, messageID)
+	if err != nil {
+		return fmt.Errorf("unable to insert processed message into database: %v", err)
+	}
+
+	return nil
+}
+
+// PurgeProcessedMessages drops the ids of messages handled longer than olderThan ago, which
+// no store looks at anymore.
+func (db *DB) PurgeProcessedMessages(ctx context.Context, olderThan time.Duration) (int64, error) {
+
+	queryPurgeProcessed := `
+		DELETE FROM processed_message
+		WHERE processed_at < NOW() - $1::interval
+	;`
+
+	tag, err := db.pool.Exec(ctx, queryPurgeProcessed, olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge processed messages: %v", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// IsTransient reports whether a write that failed with err may succeed if tried again. Errors
+// Postgres answered with are classified by their SQLSTATE class: connection problems,
+// transaction rollbacks, lack of resources and operator intervention are transient, the rest
+// (data exceptions, constraint violations, syntax errors...) fail the same way every time.
+// Errors that did not come from Postgres, such as a dropped connection, are transient.
+func IsTransient(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return true
+	}
+	if len(pgErr.Code) < 2 {
+		return false
+	}
+	switch pgErr.Code[:2] {
+	case "08", // connection exception
+		"40", // transaction rollback, e.g. serialization failure or deadlock
+		"53", // insufficient resources
+		"57", // operator intervention, e.g. admin shutdown
+		"58": // system error
+		return true
+	default:
+		return false
+	}
+}
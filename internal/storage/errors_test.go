@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := map[string]struct {
+		input error
+		want  bool
+	}{
+		"connection lost": {
+			input: errors.New("unexpected EOF"),
+			want:  true,
+		},
+		"connection failure": {
+			input: &pgconn.PgError{Code: "08006"},
+			want:  true,
+		},
+		"deadlock wrapped by a writer": {
+			input: fmt.Errorf("failed inserting batch [0:10]: %w", &pgconn.PgError{Code: "40P01"}),
+			want:  true,
+		},
+		"admin shutdown": {
+			input: &pgconn.PgError{Code: "57P01"},
+			want:  true,
+		},
+		"foreign key violation": {
+			input: &pgconn.PgError{Code: "23503"},
+			want:  false,
+		},
+		"unique violation": {
+			input: &pgconn.PgError{Code: "23505"},
+			want:  false,
+		},
+		"value too long": {
+			input: &pgconn.PgError{Code: "22001"},
+			want:  false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := IsTransient(tc.input)
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
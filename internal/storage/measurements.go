@@ -23,7 +23,7 @@ func (DB *DB) WriteMeasurement(ctx context.Context, measurement SensorMeasuremen
 
 	_, err := DB.pool.Exec(ctx, queryInsertTimeseriesData, measurement.Timestamp, measurement.SensorID, measurement.Measurement)
 	if err != nil {
-		return fmt.Errorf("unable to insert sample into Timescale %v", err)
+		return fmt.Errorf("unable to insert sample into Timescale: %w", err)
 	}
 	fmt.Printf("%v - Successfully inserted sample into `measurement` hypertable", time.Now())
 	// TODO: as many inserts as rows of data, the idea is to deploy it with this pattern, measure the way the whole system behaves (broker, backend, db) and then optmize with batch processing
@@ -50,7 +50,7 @@ func (DB *DB) BatchWriteMeasurement(ctx context.Context, measurements []SensorMe
 
 	_, err := DB.pool.Exec(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("unable to insert batch of sensor measurements into Timescale %v", err)
+		return fmt.Errorf("unable to insert batch of sensor measurements into Timescale: %w", err)
 	}
 	fmt.Printf("%v - Successfully inserted batches of %v into `measurement` hypertable", time.Now(), len(measurements))
 
@@ -123,7 +123,7 @@ func (DB *DB) CopyWriteMeasurement(ctx context.Context, measurements []SensorMea
 			}),
 	)
 	if err != nil {
-		return fmt.Errorf("unable to COPY sensor measurements into Timescale %v", err)
+		return fmt.Errorf("unable to COPY sensor measurements into Timescale: %w", err)
 	}
 	fmt.Printf("%v - Successfully COPY (%d) points into `measurement` hypertable", time.Now(), copyCount)
 
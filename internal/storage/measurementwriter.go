@@ -0,0 +1,76 @@
+/*
+- Write strategies for the sensor_measurement hypertable behind a single interface.
+- The ingester picks one by name, the loadtest tool and benchmarks compare them.
+*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type MeasurementWriter interface {
+	WriteMeasurements(ctx context.Context, measurements []SensorMeasurementRecord) error
+}
+
+// MeasurementWriterFunc lets a plain function act as a MeasurementWriter.
+type MeasurementWriterFunc func(ctx context.Context, measurements []SensorMeasurementRecord) error
+
+func (f MeasurementWriterFunc) WriteMeasurements(ctx context.Context, measurements []SensorMeasurementRecord) error {
+	return f(ctx, measurements)
+}
+
+const (
+	WriteStrategySingle = "single" // one INSERT per measurement
+	WriteStrategyBatch  = "batch"  // multi-row INSERT ... VALUES
+	WriteStrategyArray  = "array"  // INSERT ... SELECT FROM unnest of one array per column
+	WriteStrategyCopy   = "copy"   // COPY FROM
+
+	DefaultWriteStrategy = WriteStrategyArray
+)
+
+// WriteStrategies lists every strategy MeasurementWriter accepts.
+var WriteStrategies = []string{WriteStrategySingle, WriteStrategyBatch, WriteStrategyArray, WriteStrategyCopy}
+
+// IdempotentWriteStrategies lists the strategies that skip rows already written, the only ones
+// fit to write from a stream, whose replay after a crash re-delivers what was written before
+// the offset was stored. The others fail on the duplicates and are left to the load test.
+var IdempotentWriteStrategies = []string{WriteStrategyBatch, WriteStrategyArray}
+
+// batchWriteMaxRows keeps a multi-row INSERT under the 65535 bind parameters postgres takes,
+// at three parameters per row.
+const batchWriteMaxRows = 20_000
+
+// MeasurementWriter returns the writer of the given strategy, an empty one is the default.
+func (DB *DB) MeasurementWriter(strategy string) (MeasurementWriter, error) {
+	switch strings.ToLower(strategy) {
+	case WriteStrategySingle:
+		return MeasurementWriterFunc(func(ctx context.Context, measurements []SensorMeasurementRecord) error {
+			for _, measurement := range measurements {
+				err := DB.WriteMeasurement(ctx, measurement)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}), nil
+	case WriteStrategyBatch:
+		return MeasurementWriterFunc(func(ctx context.Context, measurements []SensorMeasurementRecord) error {
+			for start := 0; start < len(measurements); start += batchWriteMaxRows {
+				end := min(start+batchWriteMaxRows, len(measurements))
+				err := DB.BatchWriteMeasurement(ctx, measurements[start:end])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}), nil
+	case WriteStrategyArray, "":
+		return MeasurementWriterFunc(DB.BatchArrayWriteMeasurement), nil
+	case WriteStrategyCopy:
+		return MeasurementWriterFunc(DB.CopyWriteMeasurement), nil
+	default:
+		return nil, fmt.Errorf("unknown measurement write strategy %q, want one of %s", strategy, strings.Join(WriteStrategies, ", "))
+	}
+}
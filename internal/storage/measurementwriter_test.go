@@ -0,0 +1,28 @@
+package storage
+
+import "testing"
+
+func TestMeasurementWriterStrategy(t *testing.T) {
+	tests := map[string]struct {
+		strategy string
+		wantErr  bool
+	}{
+		"default":          {strategy: "", wantErr: false},
+		"copy":             {strategy: WriteStrategyCopy, wantErr: false},
+		"case insensitive": {strategy: "ARRAY", wantErr: false},
+		"unknown":          {strategy: "bulk", wantErr: true},
+	}
+
+	db := &DB{}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			writer, err := db.MeasurementWriter(tc.strategy)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && writer == nil {
+				t.Fatalf("got nil writer, want one")
+			}
+		})
+	}
+}
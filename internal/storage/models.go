@@ -1,6 +1,9 @@
 package storage
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // TODO: add created_at and updated_at audit fields
 type TargetRecord struct {
@@ -21,9 +24,49 @@ type SensorMeasurementRecord struct {
 	Measurement float64
 }
 
+// PendingMeasurementRecord is a measurement of a sensor that is not registered (yet), kept by
+// serial number since it has no sensor ID.
+type PendingMeasurementRecord struct {
+	SerialNumber string
+	Timestamp    time.Time
+	Measurement  float64
+}
+
 type SensorLogRecord struct {
 	Timestamp    time.Time `json:"timestamp"`
 	SerialNumber string    `json:"serialNumber"`
 	Level        string    `json:"level"`
 	Message      string    `json:"message"`
 }
+
+type DeadLetterRecord struct {
+	ID           int64           `json:"id"`
+	ReceivedAt   time.Time       `json:"received_at"`
+	Reason       string          `json:"reason"`
+	SourceQueue  string          `json:"source_queue"`
+	RoutingKey   string          `json:"routing_key"`
+	SerialNumber string          `json:"serial_number"`
+	ContentType  string          `json:"content_type"`
+	Headers      json.RawMessage `json:"headers"`
+	Payload      []byte          `json:"payload,omitempty"` // left out when listing
+}
+
+type UnroutableMessageRecord struct {
+	ID           int64     `json:"id"`
+	ReceivedAt   time.Time `json:"received_at"`
+	Exchange     string    `json:"exchange"`
+	RoutingKey   string    `json:"routing_key"`
+	SerialNumber string    `json:"serial_number"`
+	ContentType  string    `json:"content_type"`
+	SizeBytes    int       `json:"size_bytes"`
+}
+
+// DeadLetterFilter narrows dead letter queries, zero values are ignored.
+type DeadLetterFilter struct {
+	RoutingKey   string
+	SerialNumber string
+	Reason       string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+}
@@ -0,0 +1,89 @@
+/*
+- Contains operations for pending_measurement table.
+- Rows are measurements of sensors not registered when they arrived, held until they are.
+*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func (db *DB) WritePendingMeasurements(ctx context.Context, measurements []PendingMeasurementRecord) error {
+
+	if len(measurements) == 0 {
+		return nil
+	}
+
+	serialNumberSlice := make([]string, len(measurements))
+	timeSlice := make([]time.Time, len(measurements))
+	measurementSlice := make([]float64, len(measurements))
+
+	for i, measurement := range measurements {
+		serialNumberSlice[i] = measurement.SerialNumber
+		timeSlice[i] = measurement.Timestamp
+		measurementSlice[i] = measurement.Measurement
+	}
+
+	queryInsertPending := `
+		INSERT INTO pending_measurement (serial_number, time, measurement)
+			SELECT *
+			FROM unnest(
+				$1::text[],
+				$2::timestamptz[],
+				$3::double precision[]
+			)
+		ON CONFLICT (serial_number, time) DO NOTHING
+	;`
+
+	_, err := db.pool.Exec(ctx, queryInsertPending, serialNumberSlice, timeSlice, measurementSlice)
+	if err != nil {
+		return fmt.Errorf("unable to insert pending measurements into database: %w", err)
+	}
+	fmt.Printf("%v - Held %d measurements of unregistered sensors in `pending_measurement`\n", time.Now(), len(measurements))
+
+	return nil
+}
+
+// ReplayPendingMeasurements moves the pending measurements of every sensor registered by now
+// into sensor_measurement, in a single statement so none is lost or moved twice.
+func (db *DB) ReplayPendingMeasurements(ctx context.Context) (int64, error) {
+
+	queryReplayPending := `
+		WITH moved AS (
+			DELETE FROM pending_measurement p
+			USING sensor s
+			WHERE p.serial_number = s.serial_number
+			RETURNING p.time, s.id AS sensor_id, p.measurement
+		)
+		INSERT INTO sensor_measurement (time, sensor_id, measurement)
+			SELECT time, sensor_id, measurement
+			FROM moved
+			ON CONFLICT (sensor_id, time) DO NOTHING
+	;`
+
+	tag, err := db.pool.Exec(ctx, queryReplayPending)
+	if err != nil {
+		return 0, fmt.Errorf("unable to replay pending measurements: %v", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// PurgePendingMeasurements drops pending measurements held longer than olderThan, for sensors
+// that never registered.
+func (db *DB) PurgePendingMeasurements(ctx context.Context, olderThan time.Duration) (int64, error) {
+
+	queryPurgePending := `
+		DELETE FROM pending_measurement
+		WHERE received_at < NOW() - $1::interval
+	;`
+
+	tag, err := db.pool.Exec(ctx, queryPurgePending, olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge pending measurements: %v", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -5,8 +5,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+
+	"github.com/jackc/pgx/v5"
 )
 
 func (db *DB) GetSensorIDBySerialNumber(ctx context.Context, serialNumber string) (sensorID int, err error) {
@@ -25,6 +28,27 @@ func (db *DB) GetSensorIDBySerialNumber(ctx context.Context, serialNumber string
 	return sensorID, nil
 }
 
+// LookupSensorIDBySerialNumber is GetSensorIDBySerialNumber telling an unregistered sensor
+// apart from a failed query.
+func (db *DB) LookupSensorIDBySerialNumber(ctx context.Context, serialNumber string) (sensorID int, found bool, err error) {
+
+	queryGetSensor := `
+		SELECT id 
+		FROM sensor
+		WHERE serial_number = ($1)
+	;`
+
+	err = db.pool.QueryRow(ctx, queryGetSensor, serialNumber).Scan(&sensorID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to query sensor ID: %v", err)
+	}
+
+	return sensorID, true, nil
+}
+
 func (db *DB) GetSensorBySerialNumber(ctx context.Context, serialNumber string) (sensor SensorRecord, err error) {
 
 	queryGetSensor := `
@@ -137,6 +161,79 @@ func (db *DB) WriteSensor(ctx context.Context, sr SensorRecord) error {
 	return nil
 }
 
+type SensorChange int
+
+const (
+	SensorUnchanged SensorChange = iota
+	SensorCreated
+	SensorUpdated
+)
+
+// RegisterSensor inserts the sensor, or updates its sample frequency if it is registered with
+// another one, and tells which of the two happened, if any.
+func (db *DB) RegisterSensor(ctx context.Context, sr SensorRecord) (SensorRecord, SensorChange, error) {
+
+	/********************************************/
+	/* UPSERT into relational table             */
+	/********************************************/
+
+	// xmax is zero for a row version this statement inserted, an update sets it. An existing
+	// sensor with the same frequency is left alone and returns no row.
+	queryRegisterSensor := `
+		INSERT INTO sensor (serial_number, sample_frequency) VALUES ($1, $2)
+		ON CONFLICT (serial_number) DO UPDATE
+			SET sample_frequency = EXCLUDED.sample_frequency
+			WHERE sensor.sample_frequency IS DISTINCT FROM EXCLUDED.sample_frequency
+		RETURNING id, serial_number, sample_frequency, (xmax = 0) AS inserted
+	;`
+
+	var record SensorRecord
+	var inserted bool
+	err := db.pool.QueryRow(ctx, queryRegisterSensor, sr.SerialNumber, sr.SampleFrequency).Scan(
+		&record.ID,
+		&record.SerialNumber,
+		&record.SampleFrequency,
+		&inserted,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		fmt.Printf("Entry for sensor `%s` already exists. Skipping...\n", sr.SerialNumber)
+		return SensorRecord{}, SensorUnchanged, nil
+	}
+	if err != nil {
+		return SensorRecord{}, SensorUnchanged, fmt.Errorf("unable to register sensor into database: %v", err)
+	}
+
+	if inserted {
+		fmt.Printf("Inserted sensor (%s) into `sensor` table\n", record.SerialNumber)
+		return record, SensorCreated, nil
+	}
+	fmt.Printf("Updated sensor (%s) in `sensor` table\n", record.SerialNumber)
+	return record, SensorUpdated, nil
+}
+
+// DeregisterSensor is DeleteSensor returning the deleted sensor, found is false if there was
+// none.
+func (db *DB) DeregisterSensor(ctx context.Context, serialNumber string) (record SensorRecord, found bool, err error) {
+
+	queryDeleteSensor := `
+		DELETE FROM sensor
+		WHERE serial_number = ($1)
+		RETURNING id, serial_number, sample_frequency
+	;`
+
+	err = db.pool.QueryRow(ctx, queryDeleteSensor, serialNumber).Scan(&record.ID, &record.SerialNumber, &record.SampleFrequency)
+	if errors.Is(err, pgx.ErrNoRows) {
+		fmt.Printf("Entry for sensor `%s` does not exist. Skipping...\n", serialNumber)
+		return SensorRecord{}, false, nil
+	}
+	if err != nil {
+		return SensorRecord{}, false, fmt.Errorf("unable to delete sensor metadata from database: %v", err)
+	}
+	fmt.Printf("Deleted sensor (%s) from `sensor` table (and all its measurements)\n", serialNumber)
+
+	return record, true, nil
+}
+
 func (db *DB) DeleteSensor(ctx context.Context, serialNumber string) error {
 
 	/********************************************/
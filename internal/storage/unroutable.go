@@ -0,0 +1,32 @@
+/*
+- Contains write operations for unroutable_message table.
+- Rows are messages the iot exchange could not route, collected by its alternate exchange.
+*/
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+func (db *DB) WriteUnroutableMessage(ctx context.Context, um UnroutableMessageRecord) error {
+
+	queryInsertUnroutableMessage := `
+		INSERT INTO unroutable_message (exchange, routing_key, serial_number, content_type, size_bytes)
+		VALUES ($1, $2, $3, $4, $5)
+	;`
+
+	_, err := db.pool.Exec(ctx, queryInsertUnroutableMessage,
+		um.Exchange,
+		um.RoutingKey,
+		um.SerialNumber,
+		um.ContentType,
+		um.SizeBytes,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to insert unroutable message into database: %v", err)
+	}
+	fmt.Printf("Recorded unroutable message to `%s` on `%s`\n", um.RoutingKey, um.Exchange)
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package topology
+
+import (
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+)
+
+// Schema versions of the DTOs published over AMQP, registered for every service since each
+// one imports the package to declare its topology. Bump the version of a DTO when changing
+// it, keep the previous layout as e.g. routing.SensorV1 and register an upcaster from it, so
+// that consumers keep accepting what not yet upgraded producers send:
+//
+//	pubsub.RegisterUpcaster(routing.MessageTypeSensor, 1, pubsub.Upcast(func(old routing.SensorV1) routing.Sensor {
+//		return routing.Sensor{SerialNumber: old.SerialNumber, SampleFrequency: old.SampleFrequency}
+//	}))
+func init() {
+	pubsub.RegisterSchema[routing.Sensor](routing.MessageTypeSensor, 1)
+	pubsub.RegisterSchema[routing.SensorRegistryEvent](routing.MessageTypeSensorRegistryEvent, 1)
+	pubsub.RegisterSchema[routing.SensorMeasurement](routing.MessageTypeSensorMeasurement, 1)
+	pubsub.RegisterSchema[routing.SensorCommandMessage](routing.MessageTypeSensorCommand, 1)
+	pubsub.RegisterSchema[routing.SensorLog](routing.MessageTypeSensorLog, 1)
+}
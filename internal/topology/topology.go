@@ -0,0 +1,94 @@
+// Package topology is the broker side of the services: the exchanges, queues and bindings
+// routing names, as pubsub declares them, and the schemas of the DTOs routing defines.
+package topology
+
+import (
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+	"github.com/iferdel/sensor-data-streaming-server/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PolicyUnroutableMaxLength bounds iot.unroutable, which nothing but the dead-letter ingester
+// drains, dropping the oldest messages first.
+const PolicyUnroutableMaxLength = "iot-unroutable-max-length"
+
+// Topology is the broker topology every service relies on, declared by each of them when
+// connecting. Queues created per sensor or per instance at runtime are ignored, and the
+// measurements super stream is left to its ingester, see SensorMeasurementsSuperStream.
+// cmd/iot-topology compares it with a live broker.
+func Topology() pubsub.Topology {
+	deadLetter := pubsub.DeadLetterConfig{
+		Exchange: routing.ExchangeTopicDeadLetter,
+	}
+	logsDeadLetter := pubsub.DeadLetterConfig{
+		Exchange:      routing.ExchangeTopicDeadLetter,
+		DeliveryLimit: pubsub.MaxRedeliveries,
+	}
+
+	queues := []pubsub.Queue{
+		pubsub.NewQueue(routing.QueueSensorRegistry, pubsub.QueueDurable, pubsub.QueueClassic, &deadLetter),
+		pubsub.NewQueue(routing.QueueSensorDeregistry, pubsub.QueueDurable, pubsub.QueueClassic, &deadLetter),
+		pubsub.NewQueue(routing.QueueSensorLogs, pubsub.QueueDurable, pubsub.QueueQuorum, &logsDeadLetter),
+		pubsub.NewQueue(routing.QueueSensorDeadLetter, pubsub.QueueDurable, pubsub.QueueQuorum, nil),
+		pubsub.NewQueue(routing.QueueUnroutable, pubsub.QueueDurable, pubsub.QueueQuorum, nil),
+	}
+	for _, queue := range []string{routing.QueueSensorRegistry, routing.QueueSensorDeregistry, routing.QueueSensorLogs} {
+		queues = append(queues, pubsub.DefaultRetryPolicy.Queues(queue, pubsub.QueueDurable)...)
+	}
+
+	return pubsub.Topology{
+		Exchanges: []pubsub.Exchange{
+			{
+				Name:      routing.ExchangeTopicIoT,
+				Type:      amqp.ExchangeTopic,
+				Durable:   true,
+				Arguments: map[string]any{"alternate-exchange": routing.ExchangeUnroutable},
+			},
+			{Name: routing.ExchangeTopicDeadLetter, Type: amqp.ExchangeTopic, Durable: true},
+			{Name: routing.ExchangeUnroutable, Type: amqp.ExchangeFanout, Durable: true},
+		},
+		Queues: queues,
+		Bindings: []pubsub.Binding{
+			pubsub.NewBinding(routing.ExchangeTopicIoT, routing.QueueSensorRegistry, routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryRequestRegister)),
+			pubsub.NewBinding(routing.ExchangeTopicIoT, routing.QueueSensorDeregistry, routing.AnySensorBinding(routing.ChannelRegistry, routing.RegistryRequestDeregister)),
+			pubsub.NewBinding(routing.ExchangeTopicIoT, routing.QueueSensorLogs, routing.AnySensorBinding(routing.ChannelLogs, routing.AnyAction)),
+			pubsub.NewBinding(routing.ExchangeTopicDeadLetter, routing.QueueSensorDeadLetter, routing.KeyDeadLetter),
+			pubsub.NewBinding(routing.ExchangeUnroutable, routing.QueueUnroutable, routing.KeyUnroutable),
+		},
+		Policies: []pubsub.Policy{
+			{
+				Name:       PolicyUnroutableMaxLength,
+				Pattern:    `^iot\.unroutable$`,
+				ApplyTo:    "queues",
+				Definition: map[string]any{"max-length": 100000, "overflow": "drop-head"},
+			},
+		},
+		SuperStreams: []pubsub.SuperStream{
+			SensorMeasurementsSuperStream(routing.SuperStreamSensorMeasurementsPartitions, pubsub.DefaultStreamMaxLengthGB),
+		},
+		Obsolete: []pubsub.Binding{
+			// registration requests and every registry event, before deregistration got a
+			// queue of its own and events a suffix of their own
+			pubsub.NewBinding(routing.ExchangeTopicIoT, routing.QueueSensorRegistry, routing.AnySensorBinding(routing.ChannelRegistry, routing.AnyAction)),
+		},
+		Ignore: append(
+			routing.RuntimeQueuePatterns(),
+			"amq.gen-*", // server-named
+		),
+	}
+}
+
+// SensorMeasurementsSuperStream is the super stream measurements are written from, hashed by
+// routing key so the samples of a sensor stay in order.
+func SensorMeasurementsSuperStream(partitions int, maxLengthGB int64) pubsub.SuperStream {
+	return pubsub.SuperStream{
+		Name:        routing.SuperStreamSensorMeasurements,
+		Partitions:  partitions,
+		MaxLengthGB: maxLengthGB,
+		HashRouting: &pubsub.HashRouting{
+			Exchange:     routing.ExchangeTopicIoT,
+			BindingKey:   routing.AnySensorBinding(routing.ChannelMeasurements, routing.AnyAction),
+			HashExchange: routing.ExchangeMeasurementsHash,
+		},
+	}
+}
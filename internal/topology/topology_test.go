@@ -0,0 +1,77 @@
+package topology
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/iferdel/sensor-data-streaming-server/internal/pubsub"
+)
+
+// testdata/definitions.json is the export of a broker the services ran against, with a
+// simulator connected.
+func TestTopologyDrift(t *testing.T) {
+	f, err := os.Open("testdata/definitions.json")
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	defer f.Close()
+	live, err := pubsub.ParseDefinitions(f)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	tests := map[string]struct {
+		topology func() pubsub.Topology
+		want     []string
+	}{
+		"as declared": {
+			topology: Topology,
+			want:     []string{},
+		},
+		"more partitions": {
+			topology: func() pubsub.Topology {
+				topology := Topology()
+				topology.SuperStreams = []pubsub.SuperStream{SensorMeasurementsSuperStream(4, pubsub.DefaultStreamMaxLengthGB)}
+				return topology
+			},
+			want: []string{
+				"queue sensor.all.measurements.db_writer-3 missing",
+				"binding sensor.all.measurements.db_writer -> queue sensor.all.measurements.db_writer-3 [3] missing",
+				"binding iot.measurements.hash -> queue sensor.all.measurements.db_writer-3 [1] missing",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			drifts := pubsub.Diff(tc.topology(), live)
+			got := make([]string, len(drifts))
+			for i, d := range drifts {
+				got[i] = d.String()
+			}
+			if !slices.Equal(tc.want, got) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// The definitions a fresh broker loads on boot hold the topology, so that sensors publishing
+// before any service connected are routed. Regenerate them with iot-topology export.
+func TestBootDefinitions(t *testing.T) {
+	f, err := os.Open("../../dependencies/rabbitmq/definitions.json")
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	defer f.Close()
+	boot, err := pubsub.ParseDefinitions(f)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	drifts := pubsub.Diff(Topology(), boot)
+	if len(drifts) != 0 {
+		t.Fatalf("got %q, want no drift", drifts)
+	}
+}
@@ -0,0 +1,201 @@
+// Package tracing follows a message across the services with OpenTelemetry: spans are started
+// where work is done, their context travels in a W3C traceparent along with the message (AMQP
+// headers, HTTP headers, the measurement batch envelope or stream application properties) and
+// ended spans are exported over OTLP/HTTP or written as JSON.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceParentHeader is the W3C header, and the key of AMQP headers and stream application
+// properties, the span context travels in.
+const TraceParentHeader = "traceparent"
+
+const instrumentationScope = "github.com/iferdel/sensor-data-streaming-server/internal/tracing"
+
+// propagator reads and writes the W3C trace context, tracestate included.
+var propagator = propagation.TraceContext{}
+
+type SpanKind = trace.SpanKind
+
+const (
+	SpanKindInternal = trace.SpanKindInternal
+	SpanKindServer   = trace.SpanKindServer
+	SpanKindClient   = trace.SpanKindClient
+	SpanKindProducer = trace.SpanKindProducer
+	SpanKindConsumer = trace.SpanKindConsumer
+)
+
+// Span is an operation being timed, the few calls the services make of an OpenTelemetry span.
+// Ending it more than once only counts the first time.
+type Span struct {
+	span trace.Span
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *Span) End() {
+	s.span.End()
+}
+
+// EndAt ends the span at a time already past, e.g. when the work it stands for is known to
+// have finished only after the fact.
+func (s *Span) EndAt(end time.Time) {
+	s.span.End(trace.WithTimestamp(end))
+}
+
+// TraceID is the id of the trace of the span, empty when it is not traced.
+func (s *Span) TraceID() string {
+	sc := s.span.SpanContext()
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// TraceParent returns the traceparent to send along with work done under the span.
+func (s *Span) TraceParent() string {
+	return TraceParent(trace.ContextWithSpan(context.Background(), s.span))
+}
+
+// Start starts a span, a child of the span or remote parent in ctx when there is one, and
+// returns it along with a context carrying it.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	ctx, span := otel.Tracer(instrumentationScope).Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &Span{span: span}
+}
+
+// TraceParent returns the traceparent to send along with work done on behalf of ctx, empty
+// when ctx is not traced.
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TraceParentHeader)
+}
+
+// Extract returns ctx with the traceparent as remote parent, ctx as it is when the traceparent
+// is missing or invalid.
+func Extract(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{TraceParentHeader: traceParent})
+}
+
+// InjectHeaders adds the trace context of ctx to message headers, e.g. an amqp.Table.
+func InjectHeaders(ctx context.Context, headers map[string]any) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	for key, value := range carrier {
+		headers[key] = value
+	}
+}
+
+// ExtractHeaders is Extract for message headers, e.g. an amqp.Table.
+func ExtractHeaders(ctx context.Context, headers map[string]any) context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, key := range propagator.Fields() {
+		if value, ok := headers[key].(string); ok {
+			carrier[key] = value
+		}
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+// Config tells where a service sends its spans:
+//   - OTLPEndpoint sends them to an OTLP/HTTP collector, e.g. http://collector:4318
+//   - File appends them as JSON to a file, or to stdout when set to "stdout"
+//
+// Without either, spans are not exported but trace contexts still travel along. ServiceName
+// overrides the name a service reports itself with.
+type Config struct {
+	ServiceName  string `json:"service_name" env:"OTEL_SERVICE_NAME" flag:"service-name" help:"service name spans are reported with"`
+	OTLPEndpoint string `json:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" flag:"otlp-endpoint" help:"OTLP/HTTP collector to export spans to"`
+	File         string `json:"file" env:"TRACES_FILE" flag:"traces-file" help:"file to append spans to as JSON, or stdout"`
+}
+
+// Tracer is the tracer provider of a service, set up by Init.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	file     *os.File
+}
+
+// Init sets up the global tracer provider of a service, the one Start uses. Without an
+// exporter spans are still started, so the trace context keeps travelling through services
+// that do not export.
+func Init(service string, cfg Config) (*Tracer, error) {
+	if cfg.ServiceName != "" {
+		service = cfg.ServiceName
+	}
+
+	tracer := &Tracer{}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch {
+	case cfg.OTLPEndpoint != "":
+		exporter, err = otlptracehttp.New(
+			context.Background(),
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(cfg.OTLPEndpoint, "/")+"/v1/traces"),
+		)
+	case cfg.File == "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case cfg.File != "":
+		tracer.file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open traces file: %v", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(tracer.file))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create span exporter: %v", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	tracer.provider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tracer.provider)
+	return tracer, nil
+}
+
+// Shutdown exports the spans ended so far and stops exporting, spans ended after are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	err := t.provider.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("could not export remaining spans: %w", err)
+	}
+	if t.file != nil {
+		return t.file.Close()
+	}
+	return nil
+}
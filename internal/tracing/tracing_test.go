@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestExtract(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  string
+	}{
+		"sampled": {
+			input: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		"not sampled": {
+			input: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			want:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		},
+		"all zero trace id": {
+			input: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			want:  "",
+		},
+		"short span id": {
+			input: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01",
+			want:  "",
+		},
+		"forbidden version": {
+			input: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:  "",
+		},
+		"missing": {
+			input: "",
+			want:  "",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := TraceParent(Extract(context.Background(), tc.input))
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	headers := map[string]any{}
+	InjectHeaders(Extract(context.Background(), traceParent), headers)
+	if headers[TraceParentHeader] != traceParent {
+		t.Fatalf("got %v, want %s", headers, traceParent)
+	}
+	if got := TraceParent(ExtractHeaders(context.Background(), headers)); got != traceParent {
+		t.Fatalf("got %s, want %s", got, traceParent)
+	}
+}
+
+func TestStartFollowsRemoteParent(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, parent := Start(Extract(context.Background(), traceParent), "consume sensor.all.registry.created", SpanKindConsumer)
+	parent.SetAttribute("messaging.rabbitmq.routing_key", "sensor.AAD-1123.registry.register")
+	_, child := Start(ctx, "register sensor", SpanKindInternal)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	parent.End()
+
+	if got := TraceParent(ctx); got != parent.TraceParent() {
+		t.Fatalf("got %s, want %s", got, parent.TraceParent())
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	gotChild, gotParent := spans[0], spans[1]
+	if gotParent.Parent().SpanID().String() != "00f067aa0ba902b7" || gotParent.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("got %v, want a child of %s", gotParent.Parent(), traceParent)
+	}
+	if gotChild.Parent().SpanID() != gotParent.SpanContext().SpanID() || gotChild.Status().Code != codes.Error {
+		t.Fatalf("got %v with status %v, want a failed child of %v", gotChild.Parent(), gotChild.Status(), gotParent.SpanContext())
+	}
+}